@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/takehaya/xdperf/pkg/rfc2544"
+	"github.com/takehaya/xdperf/pkg/xdperf"
+	"github.com/urfave/cli"
+)
+
+func benchCommand() cli.Command {
+	return cli.Command{
+		Name:  "bench",
+		Usage: "measure packets per second per core of the TX program",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "frame-sizes",
+				Usage: "comma separated frame sizes in bytes including FCS (default: 64,128,256,512,1024,1280,1518)",
+			},
+			cli.IntFlag{
+				Name:  "packets",
+				Value: 10000000,
+				Usage: "packets per frame size",
+			},
+			cli.BoolFlag{
+				Name:  "live",
+				Usage: "transmit on --device instead of a dry run of the program",
+			},
+			cli.BoolFlag{
+				Name:  "baseline",
+				Usage: "also dry run the TX program with the per-byte template copy it replaced",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Value: "text",
+				Usage: "report format: text or json",
+			},
+		},
+		Action: runBench,
+	}
+}
+
+func runBench(ctx *cli.Context) error {
+	c, err := buildConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if c.ServerFlag {
+		return fmt.Errorf("bench runs on the client")
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("config validation failed: %w", err)
+	}
+
+	format := ctx.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid format %q", format)
+	}
+	packets := ctx.Int("packets")
+	if packets <= 0 || packets > 1<<31 {
+		return fmt.Errorf("packets must be between 1 and %d", 1<<31)
+	}
+	bc := xdperf.BenchConfig{
+		FrameSizes: rfc2544.DefaultFrameSizes,
+		Packets:    uint32(packets),
+		Live:       ctx.Bool("live"),
+		Baseline:   ctx.Bool("baseline"),
+	}
+	if s := ctx.String("frame-sizes"); s != "" {
+		if bc.FrameSizes, err = parseInts(s); err != nil {
+			return fmt.Errorf("invalid frame sizes: %w", err)
+		}
+	}
+
+	xdp, err := xdperf.NewXdperf(c)
+	if err != nil {
+		return fmt.Errorf("xdperf initialization failed: %w", err)
+	}
+	defer xdp.Close()
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results, err := xdp.Bench(runCtx, bc)
+	if err != nil {
+		return fmt.Errorf("bench failed: %w", err)
+	}
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	return xdperf.WriteBenchText(os.Stdout, results)
+}
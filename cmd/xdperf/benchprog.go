@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/takehaya/xdperf/pkg/xdperf"
+	"github.com/urfave/cli"
+)
+
+func benchProgCommand() cli.Command {
+	return cli.Command{
+		Name:  "bench-prog",
+		Usage: "measure an XDP program with the plugin's templates using BPF_PROG_RUN, no NIC needed",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "prog",
+				Usage: "BPF object with the XDP program to measure",
+			},
+			cli.StringFlag{
+				Name:  "section",
+				Usage: "section or name of the program in --prog (default: its only XDP program)",
+			},
+			cli.Uint64Flag{
+				Name:  "packets",
+				Value: 10000000,
+				Usage: "packets over all templates, split by their share of the mix",
+			},
+			cli.IntFlag{
+				Name:  "batch",
+				Value: 1000,
+				Usage: "repetitions per BPF_PROG_RUN call, the verdict of the last one counts for all",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Value: "text",
+				Usage: "report format: text or json",
+			},
+		},
+		Action: runBenchProg,
+	}
+}
+
+func runBenchProg(ctx *cli.Context) error {
+	c, err := buildConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if c.ServerFlag {
+		return fmt.Errorf("bench-prog runs on the client")
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("config validation failed: %w", err)
+	}
+
+	format := ctx.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid format %q", format)
+	}
+	bc := xdperf.BenchProgConfig{
+		Path:    ctx.String("prog"),
+		Section: ctx.String("section"),
+		Packets: ctx.Uint64("packets"),
+	}
+	if bc.Path == "" {
+		return fmt.Errorf("--prog is required")
+	}
+	if bc.Packets == 0 {
+		return fmt.Errorf("packets must be positive")
+	}
+	batch := ctx.Int("batch")
+	if batch <= 0 || batch > 1<<31 {
+		return fmt.Errorf("batch must be between 1 and %d", 1<<31)
+	}
+	bc.Batch = uint32(batch)
+
+	xdp, err := xdperf.NewXdperf(c)
+	if err != nil {
+		return fmt.Errorf("xdperf initialization failed: %w", err)
+	}
+	defer xdp.Close()
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := xdp.BenchProg(runCtx, bc)
+	if err != nil {
+		return fmt.Errorf("bench-prog failed: %w", err)
+	}
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	return xdperf.WriteBenchProgText(os.Stdout, result)
+}
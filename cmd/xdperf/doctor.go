@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/takehaya/xdperf/pkg/doctor"
+	"github.com/urfave/cli"
+)
+
+func doctorCommand() cli.Command {
+	return cli.Command{
+		Name:  "doctor",
+		Usage: "check the kernel, capabilities and --device for what xdperf needs",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "probe-attach",
+				Usage: "on kernels without XDP feature reporting, attach a test program to --device; many drivers reset the rings and drop the link for it",
+			},
+		},
+		Action: runDoctor,
+	}
+}
+
+func runDoctor(ctx *cli.Context) error {
+	c, err := buildConfig(ctx)
+	if err != nil {
+		return err
+	}
+	results := doctor.Run(doctor.Options{
+		Device:      c.Device,
+		Parallelism: c.Parallelism,
+		Engine:      c.Engine,
+		ProbeAttach: ctx.Bool("probe-attach"),
+	})
+	if fails := doctor.Print(os.Stdout, results); fails > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d check(s) failed", fails), 1)
+	}
+	return nil
+}
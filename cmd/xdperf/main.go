@@ -8,6 +8,8 @@ import (
 	"os"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/takehaya/xdperf/pkg/control"
+	"github.com/takehaya/xdperf/pkg/sysinfo"
 	"github.com/takehaya/xdperf/pkg/xdperf"
 	"github.com/urfave/cli"
 )
@@ -56,36 +58,240 @@ func newApp(version string) *cli.App {
 		cli.StringFlag{
 			Name:     "device, d",
 			Required: true,
-			Usage:    "network device name to send packets",
+			Usage:    "network device name to send or receive packets",
+		},
+		cli.StringFlag{
+			Name:  "engine",
+			Value: "xdp",
+			Usage: "transmit engine: xdp (BPF_PROG_RUN live frames, kernel 5.18+), afxdp (AF_XDP socket per queue, zero-copy when supported) or afpacket (TPACKET_V3 tx ring, no XDP needed)",
+		},
+		cli.BoolFlag{
+			Name:  "qdisc-bypass",
+			Usage: "afpacket engine: send past the qdisc layer (PACKET_QDISC_BYPASS)",
+		},
+		cli.StringFlag{
+			Name:  "tx-prog",
+			Usage: "BPF object with a custom XDP TX program sharing xdperf's maps (tx_override_map, seq_state_map, stats_map), replaces the built-in programs",
+		},
+		cli.StringFlag{
+			Name:  "tx-section",
+			Usage: "section or name of the program in --tx-prog (default: its only XDP program)",
+		},
+		cli.StringFlag{
+			Name:  "xdp-mode",
+			Usage: "xdp attach mode for receiving: native, generic or offload (default: auto)",
+		},
+		cli.BoolFlag{
+			Name:  "seq",
+			Usage: "stamp a per-cpu sequence number into every packet (client) or track loss, duplicates and reordering within 64 packets (server)",
+		},
+		cli.IntFlag{
+			Name:  "stamp-offset",
+			Value: 0,
+			Usage: "offset of the sequence stamp from the start of the UDP/TCP payload (must be even)",
+		},
+		cli.IntFlag{
+			Name:  "stream-id",
+			Value: 0,
+			Usage: "stream group stamped with the sequence number (0-65535)",
+		},
+		cli.BoolFlag{
+			Name:  "latency",
+			Usage: "stamp a timestamp into every packet (client) or measure one-way latency (server)",
+		},
+		cli.StringFlag{
+			Name:  "latency-clock",
+			Value: "mono",
+			Usage: "timestamp clock: mono (same host) or realtime (hosts synchronized by NTP/PTP)",
+		},
+		cli.BoolFlag{
+			Name:  "rtt",
+			Usage: "measure round-trip latency of packets reflected by a server running with --rx-action reflect",
+		},
+		cli.StringFlag{
+			Name:  "rx-action",
+			Value: "drop",
+			Usage: "server mode: action after counting a packet: drop, pass, redirect or reflect",
+		},
+		cli.StringFlag{
+			Name:  "peer, C",
+			Usage: "client mode: xdperf server to negotiate the test with and collect results from (host[:port])",
+		},
+		cli.BoolFlag{
+			Name:  "reverse, R",
+			Usage: "client mode: the server transmits and the client receives (needs --peer)",
+		},
+		cli.BoolFlag{
+			Name:  "bidir",
+			Usage: "client mode: client and server transmit at the same time (needs --peer)",
+		},
+		cli.IntFlag{
+			Name:  "control-port",
+			Value: control.DefaultPort,
+			Usage: "server mode: control channel port, 0 disables it",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			EnvVar: "XDPERF_TOKEN",
+			Usage:  "pre-shared token required by the server",
+		},
+		cli.BoolFlag{
+			Name:  "no-token",
+			Usage: "server mode: accept control channel clients without a token",
+		},
+		cli.BoolFlag{
+			Name:  "tls",
+			Usage: "client mode: connect to the control channel with TLS",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "client mode: CA bundle to verify the server certificate",
+		},
+		cli.BoolFlag{
+			Name:  "tls-insecure",
+			Usage: "client mode: do not verify the server certificate",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "server mode: TLS certificate for the control channel",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "server mode: TLS private key for the control channel",
+		},
+		cli.StringFlag{
+			Name:  "redirect-device",
+			Usage: "server mode: device to redirect received packets to (with --rx-action redirect)",
 		},
 		cli.IntFlag{
 			Name:  "parallelism, l",
 			Value: 1,
 			Usage: "number of parallel packet sending threads",
 		},
+		cli.StringFlag{
+			Name:  "cpus",
+			Usage: "cpus of the sending threads, e.g. 8-15,24 (default: cpus on the device's NUMA node, avoiding its IRQ cores)",
+		},
+		cli.StringFlag{
+			Name:  "queues",
+			Usage: "device queue of every sending thread, e.g. 0-7 (default: thread index modulo the rx queues)",
+		},
+		cli.StringFlag{
+			Name:  "rate, r",
+			Usage: "target TX rate split across the parallel threads, in pps or bps (e.g. 10Mpps, 40Gbps), default as fast as possible",
+		},
+		cli.StringFlag{
+			Name:  "tx-order",
+			Value: "sequential",
+			Usage: "order in which each thread cycles through the plugin's templates: sequential or random",
+		},
+		cli.StringFlag{
+			Name:  "distribution",
+			Usage: "how templates are spread over the threads: replicate, partition, flow-hash or cpu-hint, default from the plugin or replicate",
+		},
+		cli.StringFlag{
+			Name:  "imix",
+			Usage: "send a weighted mix of frame sizes: simple, tolly or size:weight[:template_id],... (sizes include FCS), default from the plugin",
+		},
 		cli.IntFlag{
 			Name:  "count, c",
 			Value: 1,
-			Usage: "number of packets to send",
+			Usage: "number of packets to send, 0 for unlimited (default with --duration)",
+		},
+		cli.DurationFlag{
+			Name:  "duration, t",
+			Usage: "stop sending after this time (e.g. 30s), default until count is reached",
 		},
 	}
 	app.Action = run
+	app.Commands = []cli.Command{
+		rfc2544Command(),
+		y1564Command(),
+		doctorCommand(),
+		benchCommand(),
+		benchProgCommand(),
+	}
 	return app
 }
 
-func run(ctx *cli.Context) error {
+// buildConfig reads the global flags. It works from the top-level action
+// as well as from subcommands.
+func buildConfig(ctx *cli.Context) (xdperf.Config, error) {
 	var c xdperf.Config
 	err := envconfig.Process("manager", &c)
 	if err != nil {
-		return fmt.Errorf("config parsing failed: %w", err)
+		return c, fmt.Errorf("config parsing failed: %w", err)
+	}
+	c.PluginName = ctx.GlobalString("plugin")
+	c.PluginPath = ctx.GlobalString("plugin-path")
+	c.PluginConfig = ctx.GlobalString("plugin-config")
+	c.ServerFlag = ctx.GlobalBool("server")
+	c.Device = ctx.GlobalString("device")
+	c.Parallelism = ctx.GlobalInt("parallelism")
+	c.CPUs = ctx.GlobalString("cpus")
+	if c.CPUs != "" && !ctx.GlobalIsSet("parallelism") {
+		// one thread per listed cpu
+		cpus, err := sysinfo.ParseCPUList(c.CPUs)
+		if err != nil {
+			return c, err
+		}
+		c.Parallelism = len(cpus)
+	}
+	c.Queues = ctx.GlobalString("queues")
+	c.Count = ctx.GlobalInt("count")
+	c.Rate = ctx.GlobalString("rate")
+	c.TxOrder = ctx.GlobalString("tx-order")
+	c.IMIX = ctx.GlobalString("imix")
+	c.Distribution = ctx.GlobalString("distribution")
+	c.Duration = ctx.GlobalDuration("duration")
+	// the default of one packet would end a timed run at once
+	if c.Duration > 0 && !ctx.GlobalIsSet("count") {
+		c.Count = 0
+	}
+	c.XDPMode = ctx.GlobalString("xdp-mode")
+	c.Engine = ctx.GlobalString("engine")
+	c.QdiscBypass = ctx.GlobalBool("qdisc-bypass")
+	c.TxProg = ctx.GlobalString("tx-prog")
+	c.TxSection = ctx.GlobalString("tx-section")
+	c.Seq = ctx.GlobalBool("seq")
+	c.StampOffset = ctx.GlobalInt("stamp-offset")
+	c.StreamGroup = ctx.GlobalInt("stream-id")
+	c.RTT = ctx.GlobalBool("rtt")
+	// round-trip latency is read from the latency stamps
+	c.Latency = ctx.GlobalBool("latency") || c.RTT
+	c.LatencyClock = ctx.GlobalString("latency-clock")
+	c.RxAction = ctx.GlobalString("rx-action")
+	c.RedirectDevice = ctx.GlobalString("redirect-device")
+	c.Peer = ctx.GlobalString("peer")
+	c.ControlPort = ctx.GlobalInt("control-port")
+	c.Reverse = ctx.GlobalBool("reverse")
+	c.Bidir = ctx.GlobalBool("bidir")
+	c.Token = ctx.GlobalString("token")
+	c.NoToken = ctx.GlobalBool("no-token")
+	c.TLS = ctx.GlobalBool("tls")
+	c.TLSCA = ctx.GlobalString("tls-ca")
+	c.TLSInsecure = ctx.GlobalBool("tls-insecure")
+	c.TLSCert = ctx.GlobalString("tls-cert")
+	c.TLSKey = ctx.GlobalString("tls-key")
+
+	// plugin config load
+	if c.PluginConfig != "" {
+		configData, err := os.ReadFile(c.PluginConfig)
+		if err != nil {
+			return c, fmt.Errorf("failed to read plugin config file: %w", err)
+		}
+		if err := json.Unmarshal(configData, &c.LoadedPluginConfig); err != nil {
+			return c, fmt.Errorf("failed to parse plugin config: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func run(ctx *cli.Context) error {
+	c, err := buildConfig(ctx)
+	if err != nil {
+		return err
 	}
-	c.PluginName = ctx.String("plugin")
-	c.PluginPath = ctx.String("plugin-path")
-	c.PluginConfig = ctx.String("plugin-config")
-	c.ServerFlag = ctx.Bool("server")
-	c.Device = ctx.String("device")
-	c.Parallelism = ctx.Int("parallelism")
-	c.Count = ctx.Int("count")
 
 	// Validate config
 	if err := c.Validate(); err != nil {
@@ -98,20 +304,11 @@ func run(ctx *cli.Context) error {
 	}
 	defer xdp.Close()
 
-	// plugin config load
-	if c.PluginConfig != "" {
-		configData, err := os.ReadFile(c.PluginConfig)
+	if c.ServerFlag {
+		err = xdp.StartServer(context.Background())
 		if err != nil {
-			return fmt.Errorf("failed to read plugin config file: %w", err)
+			return fmt.Errorf("xdperf server start failed: %w", err)
 		}
-		if err := json.Unmarshal(configData, &c.LoadedPluginConfig); err != nil {
-			return fmt.Errorf("failed to parse plugin config: %w", err)
-		}
-	}
-
-	if c.ServerFlag {
-		// TODO: サーバーモードの実装
-		log.Printf("server mode not implemented yet")
 		return nil
 	}
 
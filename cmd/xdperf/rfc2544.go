@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/takehaya/xdperf/pkg/rfc2544"
+	"github.com/takehaya/xdperf/pkg/sysinfo"
+	"github.com/takehaya/xdperf/pkg/xdperf"
+	"github.com/urfave/cli"
+)
+
+func rfc2544Command() cli.Command {
+	return cli.Command{
+		Name:  "rfc2544",
+		Usage: "run the RFC 2544 benchmark suite against a device under test",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "tests",
+				Value: "throughput,latency,frameloss,back-to-back",
+				Usage: "comma separated tests to run",
+			},
+			cli.StringFlag{
+				Name:  "frame-sizes",
+				Usage: "comma separated frame sizes in bytes including FCS (default: 64,128,256,512,1024,1280,1518)",
+			},
+			cli.BoolFlag{
+				Name:  "jumbo",
+				Usage: "also test 9000 byte frames",
+			},
+			cli.Float64Flag{
+				Name:  "line-rate",
+				Usage: "line rate in Mbps (default: link speed of --device)",
+			},
+			cli.DurationFlag{
+				Name:  "trial-duration",
+				Value: 60 * time.Second,
+				Usage: "duration of every throughput, latency and frame loss trial",
+			},
+			cli.Float64Flag{
+				Name:  "loss-tolerance",
+				Value: 0,
+				Usage: "acceptable frame loss in percent",
+			},
+			cli.Float64Flag{
+				Name:  "resolution",
+				Value: 0.1,
+				Usage: "throughput search resolution in percent of line rate",
+			},
+			cli.IntFlag{
+				Name:  "max-iterations",
+				Value: 20,
+				Usage: "maximum throughput search iterations",
+			},
+			cli.IntFlag{
+				Name:  "latency-trials",
+				Value: 20,
+				Usage: "number of latency trials",
+			},
+			cli.Float64Flag{
+				Name:  "frameloss-step",
+				Value: 10,
+				Usage: "frame loss rate step in percent of line rate",
+			},
+			cli.IntFlag{
+				Name:  "b2b-trials",
+				Value: 50,
+				Usage: "number of back-to-back trials",
+			},
+			cli.DurationFlag{
+				Name:  "b2b-duration",
+				Value: 2 * time.Second,
+				Usage: "initial back-to-back burst length at line rate",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Value: "text",
+				Usage: "report format: text or json",
+			},
+			cli.StringFlag{
+				Name:  "rx-device",
+				Usage: "local device receiving the output of the device under test (instead of --peer)",
+			},
+		},
+		Action: runRFC2544,
+	}
+}
+
+func parseInts(s string) ([]int, error) {
+	var out []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", f)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// parseTestList parses a comma separated list of tests, each one of valid.
+func parseTestList[T ~string](s string, valid []T) ([]T, error) {
+	var out []T
+	for _, f := range strings.Split(s, ",") {
+		t := T(strings.TrimSpace(f))
+		if t == "" {
+			continue
+		}
+		if !slices.Contains(valid, t) {
+			return nil, fmt.Errorf("unknown test %q", t)
+		}
+		out = append(out, t)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no tests selected")
+	}
+	return out, nil
+}
+
+func runRFC2544(ctx *cli.Context) error {
+	c, err := buildConfig(ctx)
+	if err != nil {
+		return err
+	}
+	c.RxDevice = ctx.String("rx-device")
+	if c.ServerFlag {
+		return fmt.Errorf("rfc2544 runs on the client, start the receiver with --server")
+	}
+	if c.Peer == "" && c.RxDevice == "" {
+		return fmt.Errorf("rfc2544 needs --peer or --rx-device to count received frames")
+	}
+	if c.Reverse || c.Bidir || c.RTT {
+		return fmt.Errorf("rfc2544 does not support --reverse, --bidir or --rtt")
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("config validation failed: %w", err)
+	}
+
+	format := ctx.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid format %q", format)
+	}
+
+	rc := rfc2544.Config{
+		FrameSizes:         rfc2544.DefaultFrameSizes,
+		LineRateMbps:       ctx.Float64("line-rate"),
+		TrialDuration:      ctx.Duration("trial-duration"),
+		LossTolerance:      ctx.Float64("loss-tolerance"),
+		Resolution:         ctx.Float64("resolution"),
+		MaxIterations:      ctx.Int("max-iterations"),
+		LatencyTrials:      ctx.Int("latency-trials"),
+		FrameLossStep:      ctx.Float64("frameloss-step"),
+		BackToBackTrials:   ctx.Int("b2b-trials"),
+		BackToBackDuration: ctx.Duration("b2b-duration"),
+		Progress: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		},
+	}
+	if rc.Tests, err = parseTestList(ctx.String("tests"), rfc2544.AllTests); err != nil {
+		return err
+	}
+	if s := ctx.String("frame-sizes"); s != "" {
+		if rc.FrameSizes, err = parseInts(s); err != nil {
+			return fmt.Errorf("invalid frame sizes: %w", err)
+		}
+	}
+	if ctx.Bool("jumbo") {
+		rc.FrameSizes = append(rc.FrameSizes, rfc2544.JumboFrameSize)
+	}
+	if rc.LineRateMbps == 0 {
+		speed, err := sysinfo.LinkSpeed(c.Device)
+		if err != nil {
+			return fmt.Errorf("%w, set --line-rate", err)
+		}
+		rc.LineRateMbps = float64(speed)
+	}
+	if err := rc.Validate(); err != nil {
+		return fmt.Errorf("rfc2544 config validation failed: %w", err)
+	}
+
+	xdp, err := xdperf.NewXdperf(c)
+	if err != nil {
+		return fmt.Errorf("xdperf initialization failed: %w", err)
+	}
+	defer xdp.Close()
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := xdp.PrepareTrials(runCtx); err != nil {
+		return fmt.Errorf("failed to prepare trials: %w", err)
+	}
+	report, err := rfc2544.Run(runCtx, xdp, rc)
+	if report == nil {
+		return fmt.Errorf("rfc2544 failed: %w", err)
+	}
+	// an interrupted run still prints the tests it completed
+	if werr := writeRFC2544Report(report, format); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return fmt.Errorf("rfc2544 interrupted: %w", err)
+	}
+	return nil
+}
+
+func writeRFC2544Report(report *rfc2544.Report, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.WriteText(os.Stdout)
+}
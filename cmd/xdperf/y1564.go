@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/takehaya/xdperf/pkg/xdperf"
+	"github.com/takehaya/xdperf/pkg/y1564"
+	"github.com/urfave/cli"
+)
+
+func y1564Command() cli.Command {
+	return cli.Command{
+		Name:  "y1564",
+		Usage: "run the ITU-T Y.1564 service activation test",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "services",
+				Usage: "JSON file describing the services and their acceptance criteria",
+			},
+			cli.StringFlag{
+				Name:  "tests",
+				Value: "configuration,performance",
+				Usage: "comma separated tests to run",
+			},
+			cli.StringFlag{
+				Name:  "cir-steps",
+				Value: "25,50,75,100",
+				Usage: "comma separated CIR steps of the configuration test in percent",
+			},
+			cli.DurationFlag{
+				Name:  "step-duration",
+				Value: 60 * time.Second,
+				Usage: "duration of every configuration test step",
+			},
+			cli.DurationFlag{
+				Name:  "performance-duration",
+				Value: 15 * time.Minute,
+				Usage: "duration of the service performance test",
+			},
+			cli.Float64Flag{
+				Name:  "margin",
+				Value: 5,
+				Usage: "accepted deviation of the received information rate in percent",
+			},
+			cli.BoolFlag{
+				Name:  "skip-policing",
+				Usage: "skip the policing step of the configuration test",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Value: "text",
+				Usage: "report format: text or json",
+			},
+			cli.StringFlag{
+				Name:  "rx-device",
+				Usage: "local device receiving the traffic of the network under test (instead of --peer)",
+			},
+		},
+		Action: runY1564,
+	}
+}
+
+func parseFloats(s string) ([]float64, error) {
+	var out []float64
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", f)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func runY1564(ctx *cli.Context) error {
+	c, err := buildConfig(ctx)
+	if err != nil {
+		return err
+	}
+	c.RxDevice = ctx.String("rx-device")
+	if c.ServerFlag {
+		return fmt.Errorf("y1564 runs on the client, start the receiver with --server")
+	}
+	if c.Peer == "" && c.RxDevice == "" {
+		return fmt.Errorf("y1564 needs --peer or --rx-device to measure received frames")
+	}
+	if c.Reverse || c.Bidir || c.RTT {
+		return fmt.Errorf("y1564 does not support --reverse, --bidir or --rtt")
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("config validation failed: %w", err)
+	}
+
+	format := ctx.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid format %q", format)
+	}
+	if ctx.String("services") == "" {
+		return fmt.Errorf("--services is required")
+	}
+
+	yc := y1564.Config{
+		StepDuration:        ctx.Duration("step-duration"),
+		PerformanceDuration: ctx.Duration("performance-duration"),
+		Margin:              ctx.Float64("margin"),
+		SkipPolicing:        ctx.Bool("skip-policing"),
+		Progress: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		},
+	}
+	if yc.Services, err = y1564.LoadServices(ctx.String("services")); err != nil {
+		return err
+	}
+	if len(yc.Services) > xdperf.LatencyClasses {
+		return fmt.Errorf("at most %d services are supported", xdperf.LatencyClasses)
+	}
+	if yc.Tests, err = parseTestList(ctx.String("tests"), y1564.AllTests); err != nil {
+		return err
+	}
+	for _, t := range yc.Tests {
+		if t == y1564.TestPerformance && len(yc.Services) > c.Parallelism {
+			return fmt.Errorf("the performance test sends every service from its own cpu, set --parallelism to at least %d", len(yc.Services))
+		}
+	}
+	if yc.CIRSteps, err = parseFloats(ctx.String("cir-steps")); err != nil {
+		return fmt.Errorf("invalid cir steps: %w", err)
+	}
+	if err := yc.Validate(); err != nil {
+		return fmt.Errorf("y1564 config validation failed: %w", err)
+	}
+
+	xdp, err := xdperf.NewXdperf(c)
+	if err != nil {
+		return fmt.Errorf("xdperf initialization failed: %w", err)
+	}
+	defer xdp.Close()
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := xdp.PrepareTrials(runCtx); err != nil {
+		return fmt.Errorf("failed to prepare trials: %w", err)
+	}
+	report, err := y1564.Run(runCtx, xdp, yc)
+	if report == nil {
+		return fmt.Errorf("y1564 failed: %w", err)
+	}
+	// an interrupted run still prints the services it tested
+	if werr := writeY1564Report(report, format); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return fmt.Errorf("y1564 interrupted: %w", err)
+	}
+	return nil
+}
+
+func writeY1564Report(report *y1564.Report, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.WriteText(os.Stdout)
+}
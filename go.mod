@@ -6,10 +6,10 @@ require (
 	github.com/cilium/ebpf v0.19.0
 	github.com/google/gopacket v1.1.19
 	github.com/kelseyhightower/envconfig v1.4.0
-	github.com/pkg/errors v0.9.1
 	github.com/tetratelabs/wazero v1.9.0
 	github.com/urfave/cli v1.22.17
 	go.uber.org/zap v1.27.0
+	golang.org/x/sync v0.17.0
 	golang.org/x/sys v0.31.0
 	golang.org/x/text v0.30.0
 )
@@ -0,0 +1,220 @@
+package control
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// DefaultPort is the TCP port of the control channel.
+const DefaultPort = 5301
+
+// ProtocolVersion is bumped on incompatible message changes.
+const ProtocolVersion = 2
+
+// Message types exchanged over the control channel.
+const (
+	TypeHello   = "hello"   // client -> server: test parameters
+	TypeReady   = "ready"   // server -> client: receiver is armed
+	TypeDone    = "done"    // client -> server: transmission finished
+	TypeResults = "results" // server -> client: receiver counters
+	TypeTxDone  = "tx_done" // server -> client: reverse transmission finished
+	TypeError   = "error"   // either side: abort with a message
+)
+
+// MaxMessageSize caps the bytes read for one message, so a peer streaming
+// an endless value fails instead of growing the decoder's buffer.
+const MaxMessageSize = 64 << 20
+
+var errMessageTooLarge = errors.New("message exceeds the size limit")
+
+// Message is the envelope of every control message. Messages are
+// newline-delimited JSON.
+type Message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type errorPayload struct {
+	Message string `json:"message"`
+}
+
+// Conn is a control connection.
+type Conn struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+	in   *messageReader
+}
+
+func NewConn(c net.Conn) *Conn {
+	in := &messageReader{r: c}
+	return &Conn{
+		conn: c,
+		enc:  json.NewEncoder(c),
+		dec:  json.NewDecoder(in),
+		in:   in,
+	}
+}
+
+// messageReader fails reads once n bytes were read, Recv resets n for
+// every message.
+type messageReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *messageReader) Read(p []byte) (int, error) {
+	if m.n <= 0 {
+		return 0, errMessageTooLarge
+	}
+	if int64(len(p)) > m.n {
+		p = p[:m.n]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	return n, err
+}
+
+// Dial connects to a control server. tlsCfg may be nil for plain TCP.
+func Dial(ctx context.Context, addr string, tlsCfg *tls.Config) (*Conn, error) {
+	var c net.Conn
+	var err error
+	if tlsCfg != nil {
+		d := &tls.Dialer{Config: tlsCfg}
+		c, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		c, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	return NewConn(c), nil
+}
+
+// Listen opens the control listener. tlsCfg may be nil for plain TCP.
+func Listen(addr string, tlsCfg *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if tlsCfg != nil {
+		return tls.NewListener(ln, tlsCfg), nil
+	}
+	return ln, nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline bounds the wait of the following Recv calls, the zero
+// time clears it.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) Send(typ string, v interface{}) error {
+	msg := Message{Type: typ}
+	if v != nil {
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", typ, err)
+		}
+		msg.Payload = payload
+	}
+	if err := c.enc.Encode(&msg); err != nil {
+		return fmt.Errorf("failed to send %s: %w", typ, err)
+	}
+	return nil
+}
+
+// SendError tells the peer why the test is aborted.
+func (c *Conn) SendError(cause error) error {
+	return c.Send(TypeError, &errorPayload{Message: cause.Error()})
+}
+
+// Recv waits for a message of the given type and decodes its payload into v.
+// An error message from the peer is returned as an error.
+func (c *Conn) Recv(ctx context.Context, typ string, v interface{}) error {
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	c.in.n = MaxMessageSize
+	var msg Message
+	if err := c.dec.Decode(&msg); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to receive %s: %w", typ, err)
+	}
+	if msg.Type == TypeError {
+		var ep errorPayload
+		if err := json.Unmarshal(msg.Payload, &ep); err != nil {
+			return fmt.Errorf("peer aborted")
+		}
+		return fmt.Errorf("peer aborted: %s", ep.Message)
+	}
+	if msg.Type != typ {
+		return fmt.Errorf("unexpected message %q, want %q", msg.Type, typ)
+	}
+	if v == nil || len(msg.Payload) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", typ, err)
+	}
+	return nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// CheckToken compares the pre-shared token in constant time.
+func CheckToken(expected, got string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(got)) == 1
+}
+
+func ServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls key pair: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// ClientTLSConfig verifies the server against caFile, or the system roots
+// when caFile is empty.
+func ClientTLSConfig(serverName, caFile string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: insecure, //nolint:gosec // explicit opt-in, the token still authenticates the client
+	}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
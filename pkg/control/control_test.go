@@ -0,0 +1,71 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRecvMessageSizeLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		// an endless string value
+		client.Write([]byte(`{"type":"hello","payload":"`))
+		chunk := bytes.Repeat([]byte("a"), 1<<20)
+		for {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	err := NewConn(server).Recv(context.Background(), TypeHello, nil)
+	if !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("Recv error = %v, want %v", err, errMessageTooLarge)
+	}
+}
+
+func TestRecvReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := NewConn(server)
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	err := conn.Recv(context.Background(), TypeHello, nil)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Recv error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestRecvAfterLargeMessages(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// every message gets the whole limit
+	payload := string(bytes.Repeat([]byte("a"), MaxMessageSize/2))
+	go func() {
+		c := NewConn(client)
+		for range 3 {
+			if err := c.Send(TypeHello, payload); err != nil {
+				return
+			}
+		}
+	}()
+	conn := NewConn(server)
+	for i := range 3 {
+		var got string
+		if err := conn.Recv(context.Background(), TypeHello, &got); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if got != payload {
+			t.Fatalf("message %d: payload differs", i)
+		}
+	}
+}
@@ -19,12 +19,83 @@ type BpfDatarec struct {
 	RxBytes   uint64
 }
 
-type BpfPktTemplate struct {
+type BpfLatStats struct {
+	_        structs.HostLayout
+	Count    uint64
+	Sum      uint64
+	Min      uint64
+	Max      uint64
+	Negative uint64
+}
+
+type BpfPktTail struct {
 	_    structs.HostLayout
-	Len  uint32
+	Data [7168]uint8
+}
+
+type BpfPktTemplate struct {
+	_         structs.HostLayout
+	Len       uint32
+	StampOff  uint16
+	L4CsumOff uint16
+	L4Proto   uint8
+	NrMods    uint8
+	IpCsumOff uint16
+	Tail      uint32
+	Mods      [4]struct {
+		_      structs.HostLayout
+		Offset uint16
+		Len    uint8
+		Op     uint8
+		Flags  uint8
+		_      [3]byte
+		Min    uint32
+		Span   uint32
+		Step   uint32
+	}
 	Data [2048]uint8
 }
 
+type BpfRxConfig struct {
+	_           structs.HostLayout
+	Action      uint32
+	Flags       uint32
+	StampOff    uint32
+	_           [4]byte
+	ClockOffset int64
+}
+
+type BpfRxStream struct {
+	_    structs.HostLayout
+	Lock struct {
+		_   structs.HostLayout
+		Val uint32
+	}
+	Started   uint32
+	Top       uint64
+	Window    uint64
+	Received  uint64
+	Lost      uint64
+	Duplicate uint64
+	Reordered uint64
+}
+
+type BpfTxConfig struct {
+	_           structs.HostLayout
+	Flags       uint32
+	StreamGroup uint32
+	ClockOffset int64
+	ModStride   uint32
+	ModOffset   uint32
+}
+
+type BpfTxState struct {
+	_     structs.HostLayout
+	Idx   uint32
+	Count uint32
+	Order uint32
+}
+
 // LoadBpf returns the embedded CollectionSpec for Bpf.
 func LoadBpf() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_BpfBytes)
@@ -67,16 +138,34 @@ type BpfSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type BpfProgramSpecs struct {
-	XdpTx *ebpf.ProgramSpec `ebpf:"xdp_tx"`
+	XdpRx         *ebpf.ProgramSpec `ebpf:"xdp_rx"`
+	XdpTx         *ebpf.ProgramSpec `ebpf:"xdp_tx"`
+	XdpTxByteloop *ebpf.ProgramSpec `ebpf:"xdp_tx_byteloop"`
+	XdpTxFixed    *ebpf.ProgramSpec `ebpf:"xdp_tx_fixed"`
+	XdpTxFrags    *ebpf.ProgramSpec `ebpf:"xdp_tx_frags"`
+	XdpTxMods     *ebpf.ProgramSpec `ebpf:"xdp_tx_mods"`
+	XdpTxMulti    *ebpf.ProgramSpec `ebpf:"xdp_tx_multi"`
 }
 
 // BpfMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type BpfMapSpecs struct {
+	LatHistMap    *ebpf.MapSpec `ebpf:"lat_hist_map"`
+	LatStatsMap   *ebpf.MapSpec `ebpf:"lat_stats_map"`
+	ModStateMap   *ebpf.MapSpec `ebpf:"mod_state_map"`
+	RxConfigMap   *ebpf.MapSpec `ebpf:"rx_config_map"`
+	RxRedirectMap *ebpf.MapSpec `ebpf:"rx_redirect_map"`
+	RxSeqEvents   *ebpf.MapSpec `ebpf:"rx_seq_events"`
+	RxSeqMap      *ebpf.MapSpec `ebpf:"rx_seq_map"`
+	RxStatsMap    *ebpf.MapSpec `ebpf:"rx_stats_map"`
 	SeqStateMap   *ebpf.MapSpec `ebpf:"seq_state_map"`
 	StatsMap      *ebpf.MapSpec `ebpf:"stats_map"`
+	TxConfigMap   *ebpf.MapSpec `ebpf:"tx_config_map"`
+	TxIndexMap    *ebpf.MapSpec `ebpf:"tx_index_map"`
 	TxOverrideMap *ebpf.MapSpec `ebpf:"tx_override_map"`
+	TxSeqMap      *ebpf.MapSpec `ebpf:"tx_seq_map"`
+	TxTailMap     *ebpf.MapSpec `ebpf:"tx_tail_map"`
 }
 
 // BpfVariableSpecs contains global variables before they are loaded into the kernel.
@@ -105,16 +194,40 @@ func (o *BpfObjects) Close() error {
 //
 // It can be passed to LoadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type BpfMaps struct {
+	LatHistMap    *ebpf.Map `ebpf:"lat_hist_map"`
+	LatStatsMap   *ebpf.Map `ebpf:"lat_stats_map"`
+	ModStateMap   *ebpf.Map `ebpf:"mod_state_map"`
+	RxConfigMap   *ebpf.Map `ebpf:"rx_config_map"`
+	RxRedirectMap *ebpf.Map `ebpf:"rx_redirect_map"`
+	RxSeqEvents   *ebpf.Map `ebpf:"rx_seq_events"`
+	RxSeqMap      *ebpf.Map `ebpf:"rx_seq_map"`
+	RxStatsMap    *ebpf.Map `ebpf:"rx_stats_map"`
 	SeqStateMap   *ebpf.Map `ebpf:"seq_state_map"`
 	StatsMap      *ebpf.Map `ebpf:"stats_map"`
+	TxConfigMap   *ebpf.Map `ebpf:"tx_config_map"`
+	TxIndexMap    *ebpf.Map `ebpf:"tx_index_map"`
 	TxOverrideMap *ebpf.Map `ebpf:"tx_override_map"`
+	TxSeqMap      *ebpf.Map `ebpf:"tx_seq_map"`
+	TxTailMap     *ebpf.Map `ebpf:"tx_tail_map"`
 }
 
 func (m *BpfMaps) Close() error {
 	return _BpfClose(
+		m.LatHistMap,
+		m.LatStatsMap,
+		m.ModStateMap,
+		m.RxConfigMap,
+		m.RxRedirectMap,
+		m.RxSeqEvents,
+		m.RxSeqMap,
+		m.RxStatsMap,
 		m.SeqStateMap,
 		m.StatsMap,
+		m.TxConfigMap,
+		m.TxIndexMap,
 		m.TxOverrideMap,
+		m.TxSeqMap,
+		m.TxTailMap,
 	)
 }
 
@@ -128,12 +241,24 @@ type BpfVariables struct {
 //
 // It can be passed to LoadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type BpfPrograms struct {
-	XdpTx *ebpf.Program `ebpf:"xdp_tx"`
+	XdpRx         *ebpf.Program `ebpf:"xdp_rx"`
+	XdpTx         *ebpf.Program `ebpf:"xdp_tx"`
+	XdpTxByteloop *ebpf.Program `ebpf:"xdp_tx_byteloop"`
+	XdpTxFixed    *ebpf.Program `ebpf:"xdp_tx_fixed"`
+	XdpTxFrags    *ebpf.Program `ebpf:"xdp_tx_frags"`
+	XdpTxMods     *ebpf.Program `ebpf:"xdp_tx_mods"`
+	XdpTxMulti    *ebpf.Program `ebpf:"xdp_tx_multi"`
 }
 
 func (p *BpfPrograms) Close() error {
 	return _BpfClose(
+		p.XdpRx,
 		p.XdpTx,
+		p.XdpTxByteloop,
+		p.XdpTxFixed,
+		p.XdpTxFrags,
+		p.XdpTxMods,
+		p.XdpTxMulti,
 	)
 }
 
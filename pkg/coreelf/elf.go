@@ -1,10 +1,11 @@
 package coreelf
 
 import (
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/cilium/ebpf"
-	"github.com/pkg/errors"
 )
 
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc $BPF_CLANG -cflags $BPF_CFLAGS Bpf ../../src/xdp_prog.c -- -I ./src -I /usr/include/x86_64-linux-gnu
@@ -28,3 +29,100 @@ func ReadCollection() (*BpfObjects, error) {
 	}
 	return objs, nil
 }
+
+// TxSizes are the max_entries of the TX template maps, set at load time
+// from the templates of a run.
+type TxSizes struct {
+	Templates uint32 // tx_override_map, distinct templates
+	Tails     uint32 // tx_tail_map, templates over MAX_TEMPLATE_SIZE
+	Slots     uint32 // tx_index_map and mod_state_map, longest per-cpu list
+}
+
+// LoadTx loads the TX programs using the template maps again with maps of
+// the given sizes and swaps them into objs, closing the previous ones. The
+// other maps of objs are shared with the new programs. An error closing the
+// previous objects is returned after the swap, objs holds the new ones then.
+func LoadTx(objs *BpfObjects, sizes TxSizes) error {
+	spec, err := LoadBpf()
+	if err != nil {
+		return fmt.Errorf("fail to load bpf spec: %w", err)
+	}
+	for name, n := range map[string]uint32{
+		"tx_override_map": sizes.Templates,
+		"tx_tail_map":     sizes.Tails,
+		"tx_index_map":    sizes.Slots,
+		"mod_state_map":   sizes.Slots,
+	} {
+		ms, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("map %s not found in the bpf object", name)
+		}
+		// array maps need at least one entry
+		ms.MaxEntries = max(n, 1)
+	}
+
+	var tx struct {
+		XdpTx         *ebpf.Program `ebpf:"xdp_tx"`
+		XdpTxByteloop *ebpf.Program `ebpf:"xdp_tx_byteloop"`
+		XdpTxFrags    *ebpf.Program `ebpf:"xdp_tx_frags"`
+		XdpTxMods     *ebpf.Program `ebpf:"xdp_tx_mods"`
+		XdpTxMulti    *ebpf.Program `ebpf:"xdp_tx_multi"`
+		ModStateMap   *ebpf.Map     `ebpf:"mod_state_map"`
+		TxIndexMap    *ebpf.Map     `ebpf:"tx_index_map"`
+		TxOverrideMap *ebpf.Map     `ebpf:"tx_override_map"`
+		TxTailMap     *ebpf.Map     `ebpf:"tx_tail_map"`
+	}
+	err = spec.LoadAndAssign(&tx, &ebpf.CollectionOptions{
+		MapReplacements: map[string]*ebpf.Map{
+			"seq_state_map": objs.SeqStateMap,
+			"stats_map":     objs.StatsMap,
+			"tx_config_map": objs.TxConfigMap,
+			"tx_seq_map":    objs.TxSeqMap,
+		},
+	})
+	if err != nil {
+		var verr *ebpf.VerifierError
+		if errors.As(err, &verr) {
+			fmt.Printf("%+v\n", verr)
+		}
+		return fmt.Errorf("fail to load tx programs: %w", err)
+	}
+
+	replaced := []io.Closer{
+		objs.XdpTx, objs.XdpTxByteloop, objs.XdpTxFrags, objs.XdpTxMods, objs.XdpTxMulti,
+		objs.ModStateMap, objs.TxIndexMap, objs.TxOverrideMap, objs.TxTailMap,
+	}
+	objs.XdpTx, objs.XdpTxByteloop, objs.XdpTxFrags = tx.XdpTx, tx.XdpTxByteloop, tx.XdpTxFrags
+	objs.XdpTxMods, objs.XdpTxMulti = tx.XdpTxMods, tx.XdpTxMulti
+	objs.ModStateMap, objs.TxIndexMap = tx.ModStateMap, tx.TxIndexMap
+	objs.TxOverrideMap, objs.TxTailMap = tx.TxOverrideMap, tx.TxTailMap
+	if err := closeAll(replaced); err != nil {
+		return fmt.Errorf("failed to close the replaced tx objects: %w", err)
+	}
+	return nil
+}
+
+// closeAll closes every closer and returns the errors joined.
+func closeAll(closers []io.Closer) error {
+	var errs []error
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TxMaps returns the maps of objs the TX programs use, by name.
+func TxMaps(objs *BpfObjects) map[string]*ebpf.Map {
+	return map[string]*ebpf.Map{
+		"mod_state_map":   objs.ModStateMap,
+		"seq_state_map":   objs.SeqStateMap,
+		"stats_map":       objs.StatsMap,
+		"tx_config_map":   objs.TxConfigMap,
+		"tx_index_map":    objs.TxIndexMap,
+		"tx_override_map": objs.TxOverrideMap,
+		"tx_seq_map":      objs.TxSeqMap,
+		"tx_tail_map":     objs.TxTailMap,
+	}
+}
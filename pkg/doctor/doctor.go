@@ -0,0 +1,409 @@
+// Package doctor checks that the host and device can run xdperf and
+// explains how to fix what is missing.
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/takehaya/xdperf/pkg/sysinfo"
+	"golang.org/x/sys/unix"
+)
+
+type Status int
+
+const (
+	OK Status = iota
+	Info
+	Warn
+	Fail
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return " OK "
+	case Info:
+		return "INFO"
+	case Warn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Name   string
+	Status Status
+	Detail string
+	Fix    string // what to do about a Warn or Fail
+}
+
+// Options selects what is checked.
+type Options struct {
+	Device      string
+	Parallelism int    // threads the run will use, 0 = skip the queue check
+	Engine      string // "xdp", "afxdp" or "afpacket"
+	// ProbeAttach allows attaching a program to Device when the kernel does
+	// not report its XDP features. Drivers such as mlx5, ixgbe and i40e
+	// reconfigure their rings for it and drop the link.
+	ProbeAttach bool
+}
+
+type checker struct {
+	opts    Options
+	kernel  sysinfo.KernelVersion
+	ifindex int
+	results []Result
+}
+
+func (c *checker) add(name string, st Status, detail, fix string) {
+	c.results = append(c.results, Result{Name: name, Status: st, Detail: detail, Fix: fix})
+}
+
+// Run runs every check. Checks that cannot run report why instead of
+// stopping the others.
+func Run(opts Options) []Result {
+	c := &checker{opts: opts}
+	c.checkKernel()
+	c.checkBTF()
+	c.checkCaps()
+	c.checkMemlock()
+	c.checkLiveFrames()
+	if c.checkDevice() {
+		c.checkXDP()
+		c.checkChannels()
+		c.checkRings()
+		c.checkIRQs()
+	}
+	c.checkIsolation()
+	return c.results
+}
+
+// Print writes the results and returns the number of failures.
+func Print(w io.Writer, results []Result) int {
+	fails := 0
+	for _, r := range results {
+		fmt.Fprintf(w, "[%s] %-14s %s\n", r.Status, r.Name, r.Detail)
+		if r.Fix != "" && r.Status >= Warn {
+			fmt.Fprintf(w, "       %-14s fix: %s\n", "", r.Fix)
+		}
+		if r.Status == Fail {
+			fails++
+		}
+	}
+	return fails
+}
+
+func (c *checker) checkKernel() {
+	v, err := sysinfo.Kernel()
+	if err != nil {
+		c.add("kernel", Fail, err.Error(), "")
+		return
+	}
+	c.kernel = v
+	switch {
+	case v.AtLeast(5, 18):
+		c.add("kernel", OK, v.Release, "")
+	case c.opts.Engine == "xdp" || c.opts.Engine == "":
+		c.add("kernel", Fail, v.Release+", live frames (BPF_F_TEST_XDP_LIVE_FRAMES) need 5.18",
+			"upgrade the kernel, or use --engine afxdp (5.4+) or --engine afpacket")
+	default:
+		c.add("kernel", Warn, v.Release+", the default xdp engine needs 5.18", "")
+	}
+}
+
+func (c *checker) checkBTF() {
+	if sysinfo.HasBTF() {
+		c.add("btf", OK, "/sys/kernel/btf/vmlinux", "")
+		return
+	}
+	c.add("btf", Fail, "kernel BTF is missing, the BPF objects cannot be relocated",
+		"use a kernel built with CONFIG_DEBUG_INFO_BTF=y")
+}
+
+func (c *checker) checkCaps() {
+	caps, err := sysinfo.EffectiveCaps()
+	if err != nil {
+		c.add("capabilities", Warn, err.Error(), "")
+		return
+	}
+	has := func(cap uint) bool { return caps&(1<<cap) != 0 }
+	var missing []string
+	if !has(sysinfo.CapNetAdmin) {
+		missing = append(missing, "CAP_NET_ADMIN")
+	}
+	// CAP_SYS_ADMIN covers CAP_BPF and CAP_PERFMON, which older kernels lack
+	if !has(sysinfo.CapSysAdmin) {
+		if !c.kernel.AtLeast(5, 8) || !has(sysinfo.CapBPF) {
+			missing = append(missing, "CAP_BPF (or CAP_SYS_ADMIN)")
+		}
+		if !c.kernel.AtLeast(5, 8) || !has(sysinfo.CapPerfmon) {
+			missing = append(missing, "CAP_PERFMON (or CAP_SYS_ADMIN)")
+		}
+	}
+	if len(missing) > 0 {
+		c.add("capabilities", Fail, "missing "+strings.Join(missing, ", "),
+			"run with sudo, or: setcap cap_net_admin,cap_bpf,cap_perfmon,cap_sys_admin+ep $(which xdperf)")
+		return
+	}
+	c.add("capabilities", OK, fmt.Sprintf("CapEff %#x", caps), "")
+}
+
+func (c *checker) checkMemlock() {
+	var rl unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &rl); err != nil {
+		c.add("memlock", Warn, err.Error(), "")
+		return
+	}
+	limit := "unlimited"
+	if rl.Cur != math.MaxUint64 {
+		limit = fmt.Sprintf("%d KiB", rl.Cur/1024)
+	}
+	switch {
+	case c.kernel.AtLeast(5, 11):
+		c.add("memlock", OK, limit+", BPF memory is charged to the memory cgroup", "")
+	case rl.Cur == math.MaxUint64:
+		c.add("memlock", OK, limit, "")
+	default:
+		c.add("memlock", Warn, limit+", maps may fail to load with EPERM", "ulimit -l unlimited")
+	}
+}
+
+// checkLiveFrames runs a program returning XDP_DROP once in live frames
+// mode, which also proves that BPF programs can be loaded.
+func (c *checker) checkLiveFrames() {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:    ebpf.XDP,
+		License: "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 1), // XDP_DROP
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		c.add("bpf", Fail, fmt.Sprintf("cannot load a BPF program: %v", err),
+			"check the capabilities above and kernel.unprivileged_bpf_disabled")
+		return
+	}
+	defer prog.Close()
+	c.add("bpf", OK, "programs load", "")
+
+	_, err = prog.Run(&ebpf.RunOptions{
+		Data:   make([]byte, 64),
+		Repeat: 1,
+		Flags:  unix.BPF_F_TEST_XDP_LIVE_FRAMES,
+	})
+	if err != nil {
+		c.add("live frames", Fail, fmt.Sprintf("bpf_prog_run with live frames failed: %v", err),
+			"use a 5.18+ kernel, or --engine afxdp / --engine afpacket")
+		return
+	}
+	c.add("live frames", OK, "BPF_F_TEST_XDP_LIVE_FRAMES works", "")
+}
+
+func (c *checker) checkDevice() bool {
+	if c.opts.Device == "" {
+		c.add("device", Info, "no --device given, device checks skipped", "")
+		return false
+	}
+	ifc, err := net.InterfaceByName(c.opts.Device)
+	if err != nil {
+		c.add("device", Fail, err.Error(), "ip link show")
+		return false
+	}
+	c.ifindex = ifc.Index
+	detail := fmt.Sprintf("%s mtu %d", ifc.Name, ifc.MTU)
+	if drv, fw, err := sysinfo.Driver(ifc.Name); err == nil {
+		detail += ", driver " + drv
+		if fw != "" {
+			detail += " (" + fw + ")"
+		}
+	}
+	if ifc.Flags&net.FlagUp == 0 {
+		c.add("device", Fail, detail+", link is down", "ip link set "+ifc.Name+" up")
+		return true
+	}
+	c.add("device", OK, detail, "")
+	return true
+}
+
+func (c *checker) checkXDP() {
+	feat, err := sysinfo.XDPFeatures(c.ifindex)
+	if errors.Is(err, sysinfo.ErrNoXDPFeatures) {
+		if !c.opts.ProbeAttach {
+			c.add("xdp", Info, "unknown, the kernel does not report xdp features before 6.3; "+
+				"doctor --probe-attach tries a native attach, which can drop the link of the device", "")
+			return
+		}
+		c.checkXDPAttach()
+		return
+	}
+	if err != nil {
+		c.add("xdp", Warn, err.Error(), "")
+		return
+	}
+	var acts []string
+	for _, f := range []struct {
+		bit  uint64
+		name string
+	}{
+		{sysinfo.XDPBasic, "basic"},
+		{sysinfo.XDPRedirect, "redirect"},
+		{sysinfo.XDPNdoXmit, "ndo_xmit"},
+		{sysinfo.XDPXSKZeroCopy, "xsk_zerocopy"},
+		{sysinfo.XDPRxSG, "rx_sg"},
+		{sysinfo.XDPNdoXmitSG, "ndo_xmit_sg"},
+	} {
+		if feat&f.bit != 0 {
+			acts = append(acts, f.name)
+		}
+	}
+	if len(acts) == 0 {
+		acts = []string{"none"}
+	}
+	detail := "features: " + strings.Join(acts, ",")
+	if feat&sysinfo.XDPBasic == 0 {
+		c.add("xdp", Warn, detail+", no native XDP, the receiver falls back to generic mode",
+			"use a driver with native XDP (mlx5, ice, i40e, ixgbe, bnxt, virtio_net, veth)")
+	} else {
+		c.add("xdp", OK, detail, "")
+	}
+	// live frames turn XDP_TX into a redirect to the device
+	if feat&sysinfo.XDPNdoXmit == 0 {
+		c.add("xdp tx", Warn, "device is not an XDP redirect target (ndo_xdp_xmit), live frames cannot transmit on it",
+			"some drivers (virtio_net, veth) enable it only while an XDP program is attached, run the server or --rtt; otherwise use --engine afxdp")
+	} else {
+		c.add("xdp tx", OK, "device accepts redirected frames", "")
+	}
+	if c.opts.Engine == "afxdp" && feat&sysinfo.XDPXSKZeroCopy == 0 {
+		c.add("af_xdp", Warn, "no AF_XDP zero-copy, the afxdp engine runs in copy mode", "")
+	}
+}
+
+// checkXDPAttach tries a native attach on kernels that do not report the
+// xdp features, only with --probe-attach: the attach can reset the rings of
+// the device. It fails without touching a device that already has a
+// program.
+func (c *checker) checkXDPAttach() {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.XDP,
+		License:      "GPL",
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 2), asm.Return()}, // XDP_PASS
+	})
+	if err != nil {
+		c.add("xdp", Warn, fmt.Sprintf("cannot probe native XDP: %v", err), "")
+		return
+	}
+	defer prog.Close()
+	l, err := link.AttachXDP(link.XDPOptions{Program: prog, Interface: c.ifindex, Flags: link.XDPDriverMode})
+	if err != nil {
+		c.add("xdp", Warn, fmt.Sprintf("native XDP attach failed: %v", err),
+			"detach other XDP programs (ip link set dev "+c.opts.Device+" xdp off) or use a driver with native XDP")
+		return
+	}
+	l.Close()
+	c.add("xdp", OK, "native XDP attach works (XDP_TX support is not reported before 6.3)", "")
+}
+
+func (c *checker) checkChannels() {
+	ch, err := sysinfo.DeviceChannels(c.opts.Device)
+	if err != nil {
+		c.add("channels", Info, err.Error(), "")
+		return
+	}
+	tx := ch.CombinedCount + ch.TxCount
+	detail := fmt.Sprintf("combined %d/%d, tx %d/%d", ch.CombinedCount, ch.MaxCombined, ch.TxCount, ch.MaxTx)
+	if c.opts.Parallelism > int(tx) && c.opts.Engine == "afxdp" {
+		c.add("channels", Fail, detail+fmt.Sprintf(", afxdp needs one queue per thread (%d)", c.opts.Parallelism),
+			fmt.Sprintf("ethtool -L %s combined %d", c.opts.Device, c.opts.Parallelism))
+		return
+	}
+	c.add("channels", OK, detail, "")
+}
+
+func (c *checker) checkRings() {
+	r, err := sysinfo.DeviceRings(c.opts.Device)
+	if err != nil {
+		c.add("rings", Info, err.Error(), "")
+		return
+	}
+	detail := fmt.Sprintf("tx %d/%d, rx %d/%d", r.TxPending, r.TxMaxPending, r.RxPending, r.RxMaxPending)
+	if r.TxPending < r.TxMaxPending || r.RxPending < r.RxMaxPending {
+		c.add("rings", Warn, detail+", larger rings absorb bursts at high rates",
+			fmt.Sprintf("ethtool -G %s tx %d rx %d", c.opts.Device, r.TxMaxPending, r.RxMaxPending))
+		return
+	}
+	c.add("rings", OK, detail, "")
+}
+
+func (c *checker) checkIRQs() {
+	irq, err := sysinfo.IRQCPUs(c.opts.Device)
+	if err != nil {
+		c.add("irq affinity", Info, err.Error(), "")
+		return
+	}
+	if len(irq) == 0 {
+		c.add("irq affinity", Info, "device has no MSI interrupts", "")
+		return
+	}
+	detail := "irqs on cpus " + cpuList(irq)
+	if node, err := sysinfo.NUMANode(c.opts.Device); err == nil && node >= 0 {
+		detail += fmt.Sprintf(", numa node %d", node)
+	}
+	if sysinfo.ProcessRunning("irqbalance") {
+		c.add("irq affinity", Warn, detail+", irqbalance may move them onto the sending cores",
+			"systemctl stop irqbalance and pin the irqs, or pick cores away from them with --cpus")
+		return
+	}
+	c.add("irq affinity", OK, detail+" (xdperf keeps its threads off these cores when it can)", "")
+}
+
+func (c *checker) checkIsolation() {
+	isolated, nohz, err := sysinfo.IsolatedCPUs()
+	if err != nil {
+		c.add("cpu isolation", Info, err.Error(), "")
+		return
+	}
+	if len(isolated) == 0 && len(nohz) == 0 {
+		c.add("cpu isolation", Info, "no isolated cpus, other tasks may disturb the sending threads",
+			"for stable rates boot with isolcpus=<cpus> nohz_full=<cpus> and pass them to --cpus")
+		return
+	}
+	detail := "isolated " + cpuList(isolated)
+	if len(nohz) > 0 {
+		detail += ", nohz_full " + cpuList(nohz)
+	}
+	c.add("cpu isolation", OK, detail+", pass them to --cpus", "")
+}
+
+func cpuList(cpus []int) string {
+	cpus = slices.Clone(cpus)
+	slices.Sort(cpus)
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprint(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ",")
+}
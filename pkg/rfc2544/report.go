@@ -0,0 +1,74 @@
+package rfc2544
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// WriteText prints the report as the usual RFC 2544 tables.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "RFC 2544 (line rate %.0f Mbps, trial %v, loss tolerance %.4f%%)\n\n",
+		r.LineRateMbps, r.TrialDuration, r.LossTolerance)
+
+	if len(r.Throughput) > 0 {
+		fmt.Fprintln(w, "Throughput")
+		fmt.Fprintln(tw, "Frame size\tRate (fps)\tRate (Mbps)\tLine rate (%)\tLoss (%)\tIterations\t")
+		for _, t := range r.Throughput {
+			if t.Error != "" {
+				fmt.Fprintf(tw, "%d\t%s\t\t\t\t%d\t\n", t.FrameSize, t.Error, t.Iterations)
+				continue
+			}
+			fmt.Fprintf(tw, "%d\t%.0f\t%.2f\t%.2f\t%.4f\t%d\t\n",
+				t.FrameSize, t.RatePPS, t.RateMbps, t.LineRatePercent, t.LossPercent, t.Iterations)
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Latency) > 0 {
+		fmt.Fprintln(w, "Latency")
+		fmt.Fprintln(tw, "Frame size\tRate (fps)\tMin\tMean\tP50\tP99\tP99.9\tMax\tTrials\t")
+		for _, l := range r.Latency {
+			if l.Error != "" {
+				fmt.Fprintf(tw, "%d\t%.0f\t%s\t\t\t\t\t\t%d\t\n", l.FrameSize, l.RatePPS, l.Error, l.Trials)
+				continue
+			}
+			fmt.Fprintf(tw, "%d\t%.0f\t%v\t%v\t%v\t%v\t%v\t%v\t%d\t\n",
+				l.FrameSize, l.RatePPS, l.Latency.Min, l.Latency.Mean, l.Latency.P50,
+				l.Latency.P99, l.Latency.P999, l.Latency.Max, l.Trials)
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+
+	if len(r.FrameLoss) > 0 {
+		fmt.Fprintln(w, "Frame loss rate")
+		fmt.Fprintln(tw, "Frame size\tLine rate (%)\tSent\tReceived\tLoss (%)\t")
+		for _, f := range r.FrameLoss {
+			if f.Error != "" {
+				fmt.Fprintf(tw, "%d\t%s\t\t\t\t\n", f.FrameSize, f.Error)
+			}
+			for _, p := range f.Points {
+				fmt.Fprintf(tw, "%d\t%.0f\t%d\t%d\t%.4f\t\n", f.FrameSize, p.LineRatePercent, p.Sent, p.Received, p.LossPercent)
+			}
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+
+	if len(r.BackToBack) > 0 {
+		fmt.Fprintln(w, "Back-to-back frames")
+		fmt.Fprintln(tw, "Frame size\tFrames\tTrials\t")
+		for _, b := range r.BackToBack {
+			if b.Error != "" {
+				fmt.Fprintf(tw, "%d\t%s\t%d\t\n", b.FrameSize, b.Error, b.Trials)
+				continue
+			}
+			fmt.Fprintf(tw, "%d\t%.0f\t%d\t\n", b.FrameSize, b.Frames, b.Trials)
+		}
+		tw.Flush()
+	}
+	return nil
+}
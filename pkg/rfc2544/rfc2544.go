@@ -0,0 +1,386 @@
+// Package rfc2544 implements the benchmarking methodology of RFC 2544:
+// throughput, latency, frame loss rate and back-to-back frames.
+package rfc2544
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// wireOverhead is preamble, SFD and inter-frame gap of every frame.
+	wireOverhead = 20
+	// FCSLen is the ethernet frame check sequence, included in RFC 2544
+	// frame sizes but not in generated templates.
+	FCSLen = 4
+	// JumboFrameSize is appended to the frame sizes when jumbo frames are
+	// requested.
+	JumboFrameSize = 9000
+)
+
+// DefaultFrameSizes are the ethernet frame sizes of RFC 2544 section 9.1.
+var DefaultFrameSizes = []int{64, 128, 256, 512, 1024, 1280, 1518}
+
+type Test string
+
+const (
+	TestThroughput Test = "throughput"
+	TestLatency    Test = "latency"
+	TestFrameLoss  Test = "frameloss"
+	TestBackToBack Test = "back-to-back"
+)
+
+var AllTests = []Test{TestThroughput, TestLatency, TestFrameLoss, TestBackToBack}
+
+// Trial is one transmission at a fixed frame size and offered load.
+type Trial struct {
+	FrameSize int           // bytes including FCS
+	RatePPS   float64       // 0 = as fast as possible
+	Duration  time.Duration // ignored when Count is set
+	Count     uint64        // burst length for back-to-back
+	Latency   bool          // stamp and measure latency
+}
+
+type Latency struct {
+	Min  time.Duration `json:"min"`
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P99  time.Duration `json:"p99"`
+	P999 time.Duration `json:"p99_9"`
+	Max  time.Duration `json:"max"`
+}
+
+type TrialResult struct {
+	Sent     uint64
+	Received uint64
+	Elapsed  time.Duration
+	Latency  *Latency
+}
+
+func (r *TrialResult) LossPercent() float64 {
+	if r.Sent == 0 || r.Received >= r.Sent {
+		return 0
+	}
+	return float64(r.Sent-r.Received) * 100 / float64(r.Sent)
+}
+
+// OfferedPPS is the load the generator actually achieved.
+func (r *TrialResult) OfferedPPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Elapsed.Seconds()
+}
+
+// Tester runs trials against the device under test.
+type Tester interface {
+	RunTrial(ctx context.Context, t Trial) (*TrialResult, error)
+}
+
+type Config struct {
+	Tests              []Test
+	FrameSizes         []int
+	LineRateMbps       float64
+	TrialDuration      time.Duration
+	LossTolerance      float64 // percent of frames
+	Resolution         float64 // percent of line rate
+	MaxIterations      int
+	LatencyTrials      int
+	FrameLossStep      float64 // percent of line rate
+	BackToBackTrials   int
+	BackToBackDuration time.Duration // initial burst length
+	Progress           func(format string, args ...interface{})
+}
+
+func (c *Config) Validate() error {
+	if len(c.FrameSizes) == 0 {
+		return fmt.Errorf("no frame sizes")
+	}
+	for _, s := range c.FrameSizes {
+		if s < 64 {
+			return fmt.Errorf("frame size %d is below the ethernet minimum of 64", s)
+		}
+	}
+	if c.LineRateMbps <= 0 {
+		return fmt.Errorf("line rate must be positive")
+	}
+	if c.TrialDuration <= 0 {
+		return fmt.Errorf("trial duration must be positive")
+	}
+	if c.LossTolerance < 0 || c.LossTolerance >= 100 {
+		return fmt.Errorf("loss tolerance must be between 0 and 100")
+	}
+	if c.Resolution <= 0 || c.Resolution > 100 {
+		return fmt.Errorf("resolution must be between 0 and 100")
+	}
+	if c.MaxIterations <= 0 || c.LatencyTrials <= 0 || c.BackToBackTrials <= 0 {
+		return fmt.Errorf("iterations and trials must be positive")
+	}
+	if c.FrameLossStep <= 0 || c.FrameLossStep > 100 {
+		return fmt.Errorf("frame loss step must be between 0 and 100")
+	}
+	if c.BackToBackDuration <= 0 {
+		return fmt.Errorf("back-to-back duration must be positive")
+	}
+	return nil
+}
+
+// LineRatePPS is the theoretical maximum frame rate for a frame size.
+func (c *Config) LineRatePPS(frameSize int) float64 {
+	return c.LineRateMbps * 1e6 / float64((frameSize+wireOverhead)*8)
+}
+
+func (c *Config) has(t Test) bool {
+	for _, tt := range c.Tests {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) progress(format string, args ...interface{}) {
+	if c.Progress != nil {
+		c.Progress(format, args...)
+	}
+}
+
+type ThroughputResult struct {
+	FrameSize       int     `json:"frame_size"`
+	RatePPS         float64 `json:"rate_pps"`
+	RateMbps        float64 `json:"rate_mbps"`
+	LineRatePercent float64 `json:"line_rate_percent"`
+	LossPercent     float64 `json:"loss_percent"`
+	Iterations      int     `json:"iterations"`
+	Error           string  `json:"error,omitempty"`
+}
+
+type LatencyResult struct {
+	FrameSize int      `json:"frame_size"`
+	RatePPS   float64  `json:"rate_pps"`
+	Trials    int      `json:"trials"`
+	Latency   *Latency `json:"latency,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type FrameLossPoint struct {
+	LineRatePercent float64 `json:"line_rate_percent"`
+	Sent            uint64  `json:"sent"`
+	Received        uint64  `json:"received"`
+	LossPercent     float64 `json:"loss_percent"`
+}
+
+type FrameLossResult struct {
+	FrameSize int              `json:"frame_size"`
+	Points    []FrameLossPoint `json:"points"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type BackToBackResult struct {
+	FrameSize int     `json:"frame_size"`
+	Frames    float64 `json:"frames"` // average over trials
+	Trials    int     `json:"trials"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	LineRateMbps  float64            `json:"line_rate_mbps"`
+	TrialDuration time.Duration      `json:"trial_duration"`
+	LossTolerance float64            `json:"loss_tolerance_percent"`
+	Throughput    []ThroughputResult `json:"throughput,omitempty"`
+	Latency       []LatencyResult    `json:"latency,omitempty"`
+	FrameLoss     []FrameLossResult  `json:"frame_loss,omitempty"`
+	BackToBack    []BackToBackResult `json:"back_to_back,omitempty"`
+}
+
+// Run executes the selected tests for every frame size. A failing frame
+// size is recorded in the report and the suite continues; only context
+// cancellation aborts it.
+func Run(ctx context.Context, t Tester, cfg Config) (*Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	rep := &Report{
+		LineRateMbps:  cfg.LineRateMbps,
+		TrialDuration: cfg.TrialDuration,
+		LossTolerance: cfg.LossTolerance,
+	}
+
+	// latency is measured at the throughput rate. When ctx is cancelled the
+	// report holds the tests run so far, the interrupted one included.
+	needThroughput := cfg.has(TestThroughput) || cfg.has(TestLatency)
+	for _, size := range cfg.FrameSizes {
+		var tput *ThroughputResult
+		if needThroughput {
+			tput = throughput(ctx, t, &cfg, size)
+			rep.Throughput = append(rep.Throughput, *tput)
+			if err := ctx.Err(); err != nil {
+				return rep, err
+			}
+		}
+		if cfg.has(TestLatency) {
+			rep.Latency = append(rep.Latency, latency(ctx, t, &cfg, tput))
+			if err := ctx.Err(); err != nil {
+				return rep, err
+			}
+		}
+		if cfg.has(TestFrameLoss) {
+			rep.FrameLoss = append(rep.FrameLoss, frameLoss(ctx, t, &cfg, size))
+			if err := ctx.Err(); err != nil {
+				return rep, err
+			}
+		}
+		if cfg.has(TestBackToBack) {
+			rep.BackToBack = append(rep.BackToBack, backToBack(ctx, t, &cfg, size))
+			if err := ctx.Err(); err != nil {
+				return rep, err
+			}
+		}
+	}
+	return rep, nil
+}
+
+// throughput binary-searches the highest rate with loss within tolerance
+// (RFC 2544 section 26.1).
+func throughput(ctx context.Context, t Tester, cfg *Config, size int) *ThroughputResult {
+	res := &ThroughputResult{FrameSize: size}
+	line := cfg.LineRatePPS(size)
+	lo, hi := 0.0, line
+	rate := line
+	var best *TrialResult
+	for res.Iterations < cfg.MaxIterations {
+		res.Iterations++
+		tr, err := t.RunTrial(ctx, Trial{FrameSize: size, RatePPS: rate, Duration: cfg.TrialDuration})
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		loss := tr.LossPercent()
+		cfg.progress("throughput %dB: %.0f pps offered, %.4f%% loss", size, tr.OfferedPPS(), loss)
+		if loss <= cfg.LossTolerance {
+			lo = rate
+			best = tr
+			res.LossPercent = loss
+		} else {
+			hi = rate
+		}
+		if hi-lo <= line*cfg.Resolution/100 {
+			break
+		}
+		rate = (lo + hi) / 2
+	}
+	if best == nil {
+		res.Error = "no rate within loss tolerance"
+		return res
+	}
+	res.RatePPS = min(best.OfferedPPS(), lo)
+	res.RateMbps = res.RatePPS * float64(size*8) / 1e6
+	res.LineRatePercent = res.RatePPS * 100 / line
+	return res
+}
+
+// latency runs trials at the throughput rate (RFC 2544 section 26.2).
+// Min and max are over all trials, the other values are trial averages.
+func latency(ctx context.Context, t Tester, cfg *Config, tput *ThroughputResult) LatencyResult {
+	res := LatencyResult{FrameSize: tput.FrameSize, RatePPS: tput.RatePPS}
+	if tput.Error != "" {
+		res.Error = "throughput unknown: " + tput.Error
+		return res
+	}
+
+	var agg Latency
+	for i := 0; i < cfg.LatencyTrials; i++ {
+		tr, err := t.RunTrial(ctx, Trial{FrameSize: tput.FrameSize, RatePPS: tput.RatePPS, Duration: cfg.TrialDuration, Latency: true})
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if tr.Latency == nil {
+			res.Error = "no latency samples"
+			return res
+		}
+		l := tr.Latency
+		cfg.progress("latency %dB: trial %d, mean %v, max %v", tput.FrameSize, i+1, l.Mean, l.Max)
+		if res.Trials == 0 || l.Min < agg.Min {
+			agg.Min = l.Min
+		}
+		agg.Max = max(agg.Max, l.Max)
+		agg.Mean += l.Mean
+		agg.P50 += l.P50
+		agg.P99 += l.P99
+		agg.P999 += l.P999
+		res.Trials++
+	}
+	n := time.Duration(res.Trials)
+	agg.Mean /= n
+	agg.P50 /= n
+	agg.P99 /= n
+	agg.P999 /= n
+	res.Latency = &agg
+	return res
+}
+
+// frameLoss steps down from line rate until two successive trials have no
+// loss (RFC 2544 section 26.3).
+func frameLoss(ctx context.Context, t Tester, cfg *Config, size int) FrameLossResult {
+	res := FrameLossResult{FrameSize: size}
+	line := cfg.LineRatePPS(size)
+	zero := 0
+	for pct := 100.0; pct > 0 && zero < 2; pct -= cfg.FrameLossStep {
+		tr, err := t.RunTrial(ctx, Trial{FrameSize: size, RatePPS: line * pct / 100, Duration: cfg.TrialDuration})
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		loss := tr.LossPercent()
+		cfg.progress("frame loss %dB: %.0f%% of line rate, %.4f%% loss", size, pct, loss)
+		res.Points = append(res.Points, FrameLossPoint{
+			LineRatePercent: pct,
+			Sent:            tr.Sent,
+			Received:        tr.Received,
+			LossPercent:     loss,
+		})
+		if loss == 0 {
+			zero++
+		} else {
+			zero = 0
+		}
+	}
+	return res
+}
+
+// backToBack searches the longest burst at maximum rate without loss and
+// averages it over the trials (RFC 2544 section 26.4).
+func backToBack(ctx context.Context, t Tester, cfg *Config, size int) BackToBackResult {
+	res := BackToBackResult{FrameSize: size}
+	burst := uint64(cfg.LineRatePPS(size) * cfg.BackToBackDuration.Seconds())
+	step := max(1, uint64(float64(burst)*cfg.Resolution/100))
+
+	var total uint64
+	for trial := 0; trial < cfg.BackToBackTrials; trial++ {
+		lo, hi := uint64(0), burst
+		n := burst
+		for i := 0; i < cfg.MaxIterations; i++ {
+			tr, err := t.RunTrial(ctx, Trial{FrameSize: size, Count: n})
+			if err != nil {
+				res.Error = err.Error()
+				return res
+			}
+			if tr.LossPercent() == 0 {
+				lo = n
+			} else {
+				hi = n - 1
+			}
+			if hi <= lo || hi-lo <= step {
+				break
+			}
+			n = lo + (hi-lo+1)/2
+		}
+		cfg.progress("back-to-back %dB: trial %d, %d frames", size, trial+1, lo)
+		total += lo
+		res.Trials++
+	}
+	res.Frames = float64(total) / float64(res.Trials)
+	return res
+}
@@ -0,0 +1,230 @@
+package rfc2544
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// fakeDUT forwards up to capacity frames per second and buffers burst
+// frames of a back-to-back trial. cancel, when set, is called on trial
+// cancelAt, as by a signal during that trial.
+type fakeDUT struct {
+	capacity float64 // pps
+	buffer   uint64  // frames
+	err      error
+	trials   []Trial
+	cancel   context.CancelFunc
+	cancelAt int
+}
+
+func (d *fakeDUT) RunTrial(ctx context.Context, t Trial) (*TrialResult, error) {
+	d.trials = append(d.trials, t)
+	if d.cancel != nil && len(d.trials) == d.cancelAt {
+		d.cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if t.Count > 0 {
+		recv := min(t.Count, d.buffer)
+		return &TrialResult{Sent: t.Count, Received: recv, Elapsed: time.Millisecond}, nil
+	}
+	sent := uint64(t.RatePPS * t.Duration.Seconds())
+	recv := sent
+	if t.RatePPS > d.capacity {
+		recv = uint64(d.capacity * t.Duration.Seconds())
+	}
+	tr := &TrialResult{Sent: sent, Received: recv, Elapsed: t.Duration}
+	if t.Latency {
+		tr.Latency = &Latency{Min: time.Microsecond, Mean: 2 * time.Microsecond, Max: 5 * time.Microsecond}
+	}
+	return tr, nil
+}
+
+func testConfig(tests ...Test) Config {
+	return Config{
+		Tests:              tests,
+		FrameSizes:         []int{64},
+		LineRateMbps:       1000,
+		TrialDuration:      time.Second,
+		Resolution:         0.1,
+		MaxIterations:      20,
+		LatencyTrials:      2,
+		FrameLossStep:      10,
+		BackToBackTrials:   2,
+		BackToBackDuration: 10 * time.Millisecond,
+	}
+}
+
+func TestThroughputSearch(t *testing.T) {
+	cfg := testConfig(TestThroughput)
+	line := cfg.LineRatePPS(64)
+
+	tests := []struct {
+		name      string
+		capacity  float64 // fraction of line rate
+		tolerance float64
+		wantPct   float64
+		wantErr   bool
+	}{
+		{name: "line rate", capacity: 1, wantPct: 100},
+		{name: "half", capacity: 0.5, wantPct: 50},
+		{name: "low", capacity: 0.1, wantPct: 10},
+		{name: "tolerance", capacity: 0.995, tolerance: 1, wantPct: 100},
+		{name: "always loss", capacity: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cfg
+			c.LossTolerance = tt.tolerance
+			dut := &fakeDUT{capacity: line * tt.capacity}
+			res := throughput(context.Background(), dut, &c, 64)
+			if tt.wantErr {
+				if res.Error == "" {
+					t.Fatalf("want an error, got %+v", res)
+				}
+				return
+			}
+			if res.Error != "" {
+				t.Fatal(res.Error)
+			}
+			// the search ends within the resolution below the capacity
+			if res.LineRatePercent > tt.wantPct+1e-9 || res.LineRatePercent < tt.wantPct-2*c.Resolution {
+				t.Errorf("throughput %.3f%% of line rate, want %.1f%%", res.LineRatePercent, tt.wantPct)
+			}
+			if res.LossPercent > tt.tolerance {
+				t.Errorf("loss %.3f%% above tolerance %.1f%%", res.LossPercent, tt.tolerance)
+			}
+			if res.Iterations > c.MaxIterations || res.Iterations != len(dut.trials) {
+				t.Errorf("%d iterations for %d trials, max %d", res.Iterations, len(dut.trials), c.MaxIterations)
+			}
+		})
+	}
+}
+
+func TestThroughputMaxIterations(t *testing.T) {
+	cfg := testConfig(TestThroughput)
+	cfg.MaxIterations = 3
+	dut := &fakeDUT{capacity: cfg.LineRatePPS(64) * 0.3}
+	res := throughput(context.Background(), dut, &cfg, 64)
+	if res.Iterations != 3 || len(dut.trials) != 3 {
+		t.Errorf("%d iterations, %d trials, want 3", res.Iterations, len(dut.trials))
+	}
+	// 100%, 50% and 25% of line rate: only the last one passes. The offered
+	// rate is whole packets over the trial, hence the tolerance.
+	if math.Abs(res.LineRatePercent-25) > 1e-3 {
+		t.Errorf("throughput %.3f%% of line rate, want 25%%", res.LineRatePercent)
+	}
+}
+
+func TestBackToBackSearch(t *testing.T) {
+	cfg := testConfig(TestBackToBack)
+	burst := uint64(cfg.LineRatePPS(64) * cfg.BackToBackDuration.Seconds())
+	step := uint64(float64(burst) * cfg.Resolution / 100)
+
+	tests := []struct {
+		name   string
+		buffer uint64
+	}{
+		{"no loss", burst * 2},
+		{"half", burst / 2},
+		{"small", 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dut := &fakeDUT{buffer: tt.buffer}
+			res := backToBack(context.Background(), dut, &cfg, 64)
+			if res.Error != "" {
+				t.Fatal(res.Error)
+			}
+			want := float64(min(tt.buffer, burst))
+			if res.Frames > want || res.Frames < want-float64(step) {
+				t.Errorf("%.0f frames, want %.0f within %d", res.Frames, want, step)
+			}
+			if res.Trials != cfg.BackToBackTrials {
+				t.Errorf("%d trials, want %d", res.Trials, cfg.BackToBackTrials)
+			}
+			for _, tr := range dut.trials {
+				if tr.Count == 0 || tr.Count > burst {
+					t.Errorf("burst of %d frames outside (0, %d]", tr.Count, burst)
+				}
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	cfg := testConfig(AllTests...)
+	cfg.FrameSizes = []int{64, 1518}
+	dut := &fakeDUT{capacity: cfg.LineRatePPS(64) / 2, buffer: 1000}
+	rep, err := Run(context.Background(), dut, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Throughput) != 2 || len(rep.Latency) != 2 || len(rep.FrameLoss) != 2 || len(rep.BackToBack) != 2 {
+		t.Fatalf("want results for both frame sizes, got %+v", rep)
+	}
+	// 1518 byte frames stay below the capacity in frames per second
+	if math.Abs(rep.Throughput[1].LineRatePercent-100) > 1e-3 {
+		t.Errorf("1518B throughput %.3f%%, want 100%%", rep.Throughput[1].LineRatePercent)
+	}
+	if l := rep.Latency[0]; l.Error != "" || l.Trials != cfg.LatencyTrials || l.Latency.Mean != 2*time.Microsecond {
+		t.Errorf("latency %+v", l)
+	}
+	// frame loss stops after two trials without loss
+	pts := rep.FrameLoss[0].Points
+	if n := len(pts); n < 2 || pts[n-1].LossPercent != 0 || pts[n-2].LossPercent != 0 {
+		t.Errorf("frame loss points %+v", pts)
+	}
+}
+
+func TestRunTrialError(t *testing.T) {
+	cfg := testConfig(TestThroughput, TestLatency)
+	dut := &fakeDUT{err: errors.New("no peer")}
+	rep, err := Run(context.Background(), dut, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Throughput[0].Error != "no peer" {
+		t.Errorf("throughput error %q", rep.Throughput[0].Error)
+	}
+	if rep.Latency[0].Error == "" {
+		t.Error("latency without throughput has no error")
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	cfg := testConfig(AllTests...)
+	cfg.FrameSizes = []int{64, 128}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the first latency trial of 64 byte frames is interrupted
+	dut := &fakeDUT{capacity: cfg.LineRatePPS(64) / 2, buffer: 1000, cancel: cancel}
+	dut.cancelAt = throughput(context.Background(), &fakeDUT{capacity: dut.capacity}, &cfg, 64).Iterations + 1
+
+	rep, err := Run(ctx, dut, cfg)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	if rep == nil {
+		t.Fatal("no partial report")
+	}
+	if len(rep.Throughput) != 1 || rep.Throughput[0].Error != "" {
+		t.Errorf("throughput %+v, want the completed 64B search", rep.Throughput)
+	}
+	if len(rep.Latency) != 1 || rep.Latency[0].Error == "" {
+		t.Errorf("latency %+v, want the interrupted 64B test", rep.Latency)
+	}
+	if len(rep.FrameLoss) != 0 || len(rep.BackToBack) != 0 {
+		t.Errorf("tests after the interruption ran: %+v %+v", rep.FrameLoss, rep.BackToBack)
+	}
+	if n := len(dut.trials); n != dut.cancelAt {
+		t.Errorf("%d trials, want none after trial %d", n, dut.cancelAt)
+	}
+}
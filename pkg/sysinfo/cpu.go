@@ -0,0 +1,122 @@
+package sysinfo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SysDevicesSystem is the sysfs directory of cpus and NUMA nodes.
+var SysDevicesSystem = "/sys/devices/system"
+
+// ProcIRQ is the procfs directory of IRQ affinities.
+var ProcIRQ = "/proc/irq"
+
+// ParseCPUList parses a cpu list such as "8-15,24" into sorted, unique cpus.
+func ParseCPUList(s string) ([]int, error) {
+	return ParseList(s, "cpu")
+}
+
+// ParseList parses a list in the cpu list format, such as "0-3,6", into
+// sorted, unique numbers. item names an element in the errors.
+func ParseList(s, item string) ([]int, error) {
+	seen := map[int]bool{}
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid %s %q in list %q", item, part, s)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid %s range %q in list %q", item, part, s)
+			}
+		}
+		for c := first; c <= last; c++ {
+			seen[c] = true
+		}
+	}
+	cpus := make([]int, 0, len(seen))
+	for c := range seen {
+		cpus = append(cpus, c)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// OnlineCPUs returns the online cpus.
+func OnlineCPUs() ([]int, error) {
+	s, err := readTrimmed(filepath.Join(SysDevicesSystem, "cpu", "online"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read online cpus: %w", err)
+	}
+	return ParseCPUList(s)
+}
+
+// NUMANode returns the NUMA node of the PCI device behind dev, -1 if the
+// device has no node (single socket, virtual device).
+func NUMANode(dev string) (int, error) {
+	s, err := readTrimmed(filepath.Join(SysClassNet, dev, "device", "numa_node"))
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to read numa node of %s: %w", dev, err)
+	}
+	node, err := strconv.Atoi(s)
+	if err != nil {
+		return -1, fmt.Errorf("invalid numa node of %s: %q", dev, s)
+	}
+	return node, nil
+}
+
+// NodeCPUs returns the cpus of a NUMA node.
+func NodeCPUs(node int) ([]int, error) {
+	s, err := readTrimmed(filepath.Join(SysDevicesSystem, "node", fmt.Sprintf("node%d", node), "cpulist"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cpus of numa node %d: %w", node, err)
+	}
+	return ParseCPUList(s)
+}
+
+// IRQCPUs returns the cpus that serve the MSI interrupts of dev.
+func IRQCPUs(dev string) ([]int, error) {
+	ents, err := os.ReadDir(filepath.Join(SysClassNet, dev, "device", "msi_irqs"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list irqs of %s: %w", dev, err)
+	}
+	seen := map[int]bool{}
+	for _, e := range ents {
+		dir := filepath.Join(ProcIRQ, e.Name())
+		s, err := readTrimmed(filepath.Join(dir, "effective_affinity_list"))
+		if err != nil {
+			if s, err = readTrimmed(filepath.Join(dir, "smp_affinity_list")); err != nil {
+				continue // irq without an action
+			}
+		}
+		cpus, err := ParseCPUList(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cpus {
+			seen[c] = true
+		}
+	}
+	cpus := make([]int, 0, len(seen))
+	for c := range seen {
+		cpus = append(cpus, c)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
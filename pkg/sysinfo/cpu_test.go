@@ -0,0 +1,48 @@
+package sysinfo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "", want: []int{}},
+		{in: "0", want: []int{0}},
+		{in: "8-11,24", want: []int{8, 9, 10, 11, 24}},
+		{in: " 3, 1-2 ,0\n", want: []int{0, 1, 2, 3}},
+		{in: "2,2,1-3", want: []int{1, 2, 3}},
+		{in: "5-5", want: []int{5}},
+		{in: "0,,1", want: []int{0, 1}},
+		{in: "a", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "3-1", wantErr: true},
+		{in: "1-x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseCPUList(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCPUList(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCPUList(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseListItem(t *testing.T) {
+	_, err := ParseList("0,x", "queue")
+	if err == nil || err.Error() != `invalid queue "x" in list "0,x"` {
+		t.Errorf("ParseList error = %v, want it to name the queue", err)
+	}
+	_, err = ParseList("3-1", "queue")
+	if err == nil || err.Error() != `invalid queue range "3-1" in list "3-1"` {
+		t.Errorf("ParseList error = %v, want it to name the queue range", err)
+	}
+}
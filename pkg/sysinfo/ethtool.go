@@ -0,0 +1,88 @@
+package sysinfo
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Channels is struct ethtool_channels.
+type Channels struct {
+	Cmd           uint32
+	MaxRx         uint32
+	MaxTx         uint32
+	MaxOther      uint32
+	MaxCombined   uint32
+	RxCount       uint32
+	TxCount       uint32
+	OtherCount    uint32
+	CombinedCount uint32
+}
+
+// Rings is struct ethtool_ringparam.
+type Rings struct {
+	Cmd               uint32
+	RxMaxPending      uint32
+	RxMiniMaxPending  uint32
+	RxJumboMaxPending uint32
+	TxMaxPending      uint32
+	RxPending         uint32
+	RxMiniPending     uint32
+	RxJumboPending    uint32
+	TxPending         uint32
+}
+
+// ifreqData is struct ifreq with ifr_data.
+type ifreqData struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte
+}
+
+func ethtool(dev string, data unsafe.Pointer) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	var ifr ifreqData
+	copy(ifr.name[:unix.IFNAMSIZ-1], dev)
+	ifr.data = data
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Driver returns the driver name and firmware version of dev.
+func Driver(dev string) (driver, firmware string, err error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return "", "", err
+	}
+	defer unix.Close(fd)
+	info, err := unix.IoctlGetEthtoolDrvinfo(fd, dev)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get driver of %s: %w", dev, err)
+	}
+	return unix.ByteSliceToString(info.Driver[:]), unix.ByteSliceToString(info.Fw_version[:]), nil
+}
+
+// DeviceChannels returns the queue counts of dev (ethtool -l).
+func DeviceChannels(dev string) (*Channels, error) {
+	ch := &Channels{Cmd: unix.ETHTOOL_GCHANNELS}
+	if err := ethtool(dev, unsafe.Pointer(ch)); err != nil {
+		return nil, fmt.Errorf("failed to get channels of %s: %w", dev, err)
+	}
+	return ch, nil
+}
+
+// DeviceRings returns the ring sizes of dev (ethtool -g).
+func DeviceRings(dev string) (*Rings, error) {
+	r := &Rings{Cmd: unix.ETHTOOL_GRINGPARAM}
+	if err := ethtool(dev, unsafe.Pointer(r)); err != nil {
+		return nil, fmt.Errorf("failed to get rings of %s: %w", dev, err)
+	}
+	return r, nil
+}
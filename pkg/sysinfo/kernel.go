@@ -0,0 +1,107 @@
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// KernelVersion is a kernel release as major.minor.patch.
+type KernelVersion struct {
+	Major, Minor, Patch int
+	Release             string // uname -r
+}
+
+// AtLeast reports whether v is major.minor or newer.
+func (v KernelVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// Kernel returns the running kernel version.
+func Kernel() (KernelVersion, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return KernelVersion{}, fmt.Errorf("failed to get kernel version: %w", err)
+	}
+	rel := unix.ByteSliceToString(uts.Release[:])
+	v := KernelVersion{Release: rel}
+	nums := strings.FieldsFunc(rel, func(r rune) bool { return r < '0' || r > '9' })
+	for i, p := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		if i < len(nums) {
+			*p, _ = strconv.Atoi(nums[i])
+		}
+	}
+	if v.Major == 0 {
+		return v, fmt.Errorf("unknown kernel release %q", rel)
+	}
+	return v, nil
+}
+
+// capabilities used by xdperf, see capability.h
+const (
+	CapNetAdmin = 12
+	CapSysAdmin = 21
+	CapPerfmon  = 38
+	CapBPF      = 39
+)
+
+// EffectiveCaps returns the effective capability set of the process.
+func EffectiveCaps() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read capabilities: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "CapEff:"); ok {
+			return strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		}
+	}
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
+
+// HasBTF reports whether the kernel exposes its BTF.
+func HasBTF() bool {
+	_, err := os.Stat("/sys/kernel/btf/vmlinux")
+	return err == nil
+}
+
+// IsolatedCPUs returns the cpus isolated from the scheduler (isolcpus=) and
+// the tickless ones (nohz_full=).
+func IsolatedCPUs() (isolated, nohz []int, err error) {
+	dir := filepath.Join(SysDevicesSystem, "cpu")
+	s, err := readTrimmed(filepath.Join(dir, "isolated"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read isolated cpus: %w", err)
+	}
+	if isolated, err = ParseCPUList(s); err != nil {
+		return nil, nil, err
+	}
+	if s, err = readTrimmed(filepath.Join(dir, "nohz_full")); err == nil && s != "(null)" {
+		nohz, _ = ParseCPUList(s)
+	}
+	return isolated, nohz, nil
+}
+
+// ProcessRunning reports whether a process named comm is running.
+func ProcessRunning(comm string) bool {
+	ents, err := os.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+	for _, e := range ents {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		if s, err := readTrimmed(filepath.Join("/proc", e.Name(), "comm")); err == nil && s == comm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package sysinfo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SysClassNet is the sysfs directory of network devices.
+var SysClassNet = "/sys/class/net"
+
+func readTrimmed(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// LinkSpeed returns the negotiated link speed of dev in Mbps.
+func LinkSpeed(dev string) (int, error) {
+	s, err := readTrimmed(filepath.Join(SysClassNet, dev, "speed"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read link speed of %s: %w", dev, err)
+	}
+	speed, err := strconv.Atoi(s)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("link speed of %s is unknown", dev)
+	}
+	return speed, nil
+}
+
+// RxQueues returns the number of rx queues of dev (real_num_rx_queues).
+func RxQueues(dev string) (int, error) {
+	ents, err := os.ReadDir(filepath.Join(SysClassNet, dev, "queues"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list queues of %s: %w", dev, err)
+	}
+	n := 0
+	for _, e := range ents {
+		if strings.HasPrefix(e.Name(), "rx-") {
+			n++
+		}
+	}
+	return n, nil
+}
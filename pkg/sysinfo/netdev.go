@@ -0,0 +1,137 @@
+package sysinfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// XDP features of a device, see enum netdev_xdp_act in linux/netdev.h
+const (
+	XDPBasic       uint64 = 1 << 0 // XDP_PASS/DROP/ABORTED/TX
+	XDPRedirect    uint64 = 1 << 1 // XDP_REDIRECT
+	XDPNdoXmit     uint64 = 1 << 2 // target of XDP_REDIRECT, needed by live frames
+	XDPXSKZeroCopy uint64 = 1 << 3 // AF_XDP zero-copy
+	XDPHWOffload   uint64 = 1 << 4
+	XDPRxSG        uint64 = 1 << 5 // multi-buffer receive
+	XDPNdoXmitSG   uint64 = 1 << 6 // multi-buffer redirect target
+)
+
+// ErrNoXDPFeatures is returned by kernels without the netdev netlink family
+// (before 6.3).
+var ErrNoXDPFeatures = errors.New("kernel does not report xdp features")
+
+// netdev generic netlink family, see linux/netdev.h
+const (
+	netdevCmdDevGet       = 1
+	netdevAttrIfindex     = 1
+	netdevAttrXDPFeatures = 3
+
+	sizeofGenlmsghdr = 4 // cmd, version, reserved
+)
+
+// XDPFeatures returns the NETDEV_XDP_ACT_* bits of a device.
+func XDPFeatures(ifindex int) (uint64, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open generic netlink: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, err
+	}
+
+	attrs, err := genlRequest(fd, unix.GENL_ID_CTRL, unix.CTRL_CMD_GETFAMILY,
+		nlAttr(unix.CTRL_ATTR_FAMILY_NAME, append([]byte("netdev"), 0)))
+	if errors.Is(err, unix.ENOENT) {
+		return 0, ErrNoXDPFeatures
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve the netdev family: %w", err)
+	}
+	id, ok := attrs[unix.CTRL_ATTR_FAMILY_ID]
+	if !ok || len(id) < 2 {
+		return 0, ErrNoXDPFeatures
+	}
+
+	idx := make([]byte, 4)
+	binary.NativeEndian.PutUint32(idx, uint32(ifindex))
+	attrs, err = genlRequest(fd, binary.NativeEndian.Uint16(id), netdevCmdDevGet, nlAttr(netdevAttrIfindex, idx))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get xdp features: %w", err)
+	}
+	feat, ok := attrs[netdevAttrXDPFeatures]
+	if !ok || len(feat) < 8 {
+		return 0, ErrNoXDPFeatures
+	}
+	return binary.NativeEndian.Uint64(feat), nil
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+	l := unix.SizeofNlAttr + len(data)
+	b := make([]byte, (l+unix.NLA_ALIGNTO-1)&^(unix.NLA_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[unix.SizeofNlAttr:], data)
+	return b
+}
+
+// genlRequest sends one generic netlink request and returns the top level
+// attributes of the reply.
+func genlRequest(fd int, family uint16, cmd uint8, attrs ...[]byte) (map[uint16][]byte, error) {
+	msg := make([]byte, unix.SizeofNlMsghdr+sizeofGenlmsghdr)
+	for _, a := range attrs {
+		msg = append(msg, a...)
+	}
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], family)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(msg[8:12], 1)
+	msg[unix.SizeofNlMsghdr] = cmd
+	msg[unix.SizeofNlMsghdr+1] = 1 // version
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1<<16)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+	if len(buf) < unix.SizeofNlMsghdr {
+		return nil, fmt.Errorf("short netlink reply")
+	}
+	l := int(binary.NativeEndian.Uint32(buf[0:4]))
+	typ := binary.NativeEndian.Uint16(buf[4:6])
+	if l > len(buf) || l < unix.SizeofNlMsghdr {
+		return nil, fmt.Errorf("malformed netlink reply")
+	}
+	if typ == unix.NLMSG_ERROR {
+		if l < unix.SizeofNlMsghdr+4 {
+			return nil, fmt.Errorf("malformed netlink error")
+		}
+		if code := int32(binary.NativeEndian.Uint32(buf[unix.SizeofNlMsghdr:])); code != 0 {
+			return nil, unix.Errno(-code)
+		}
+		return nil, fmt.Errorf("unexpected netlink ack")
+	}
+
+	out := map[uint16][]byte{}
+	b := buf[unix.SizeofNlMsghdr+sizeofGenlmsghdr : l]
+	for len(b) >= unix.SizeofNlAttr {
+		al := int(binary.NativeEndian.Uint16(b[0:2]))
+		if al < unix.SizeofNlAttr || al > len(b) {
+			break
+		}
+		out[binary.NativeEndian.Uint16(b[2:4])&^unix.NLA_F_NESTED] = b[unix.SizeofNlAttr:al]
+		al = (al + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if al > len(b) {
+			break
+		}
+		b = b[al:]
+	}
+	return out, nil
+}
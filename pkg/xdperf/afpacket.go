@@ -0,0 +1,230 @@
+package xdperf
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// one template per frame, the frame starts with struct tpacket3_hdr.
+	// Frames are 4096 bytes, or the next power of 2 for jumbo templates,
+	// in a ring of pktRingSize bytes.
+	pktFrameSize   = 4096
+	pktRingSize    = 2048 * pktFrameSize
+	pktBlockFrames = 16
+	pktDataOffset  = (unix.SizeofTpacket3Hdr + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+)
+
+// afpacketEngines opens a PACKET_TX_RING socket on the device for every
+// worker. The kernel builds an skb per frame, so this is far slower than the
+// XDP engines but needs neither XDP nor live frames.
+func (x *Xdperf) afpacketEngines(workers []*txWorker) error {
+	order, err := x.checkStaticTemplates(engineAFPacket)
+	if err != nil {
+		return err
+	}
+
+	socks := make([]*packetSocket, 0, len(workers))
+	closeAll := func() {
+		for _, s := range socks {
+			s.Close()
+		}
+	}
+	for _, w := range workers {
+		set := x.txSets[w.idx%len(x.txSets)]
+		s, err := newPacketSocket(x.Device.Index, set, x.cfg.QdiscBypass)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("failed to open AF_PACKET socket: %w", err)
+		}
+		s.cpu = w.cpu
+		s.templatePicker = x.newTemplatePicker(w.idx, len(set), order)
+		socks = append(socks, s)
+	}
+	x.Logger.Info("afpacket sockets opened", zap.Int("sockets", len(socks)), zap.Bool("qdisc_bypass", x.cfg.QdiscBypass))
+
+	counters := make([]*txCounters, len(socks))
+	for i, s := range socks {
+		counters[i] = &s.txCounters
+	}
+	if err := x.startTxStats(counters); err != nil {
+		closeAll()
+		return err
+	}
+	for i, w := range workers {
+		w.tx = socks[i]
+	}
+	return nil
+}
+
+// packetSocket is a TPACKET_V3 TX ring transmitting the templates of one
+// worker. Frames are filled at head and handed back by the kernel in order
+// from tail.
+type packetSocket struct {
+	fd        int
+	ring      []byte
+	frameSize uint32
+	frameNr   uint32
+	data      [][]byte // templates
+	tpl       []int32  // template held by every frame, -1 = none
+
+	head    uint32
+	tail    uint32
+	pending uint32
+	dropped uint64 // frames the kernel rejected
+
+	templatePicker
+	txCounters
+}
+
+func newPacketSocket(ifindex int, set []*TxOverrideEntry, qdiscBypass bool) (*packetSocket, error) {
+	// protocol 0: transmit only, nothing is delivered to the socket
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %w", err)
+	}
+	s := &packetSocket{fd: fd, frameSize: pktFrameSize}
+	ok := false
+	defer func() {
+		if !ok {
+			s.release()
+		}
+	}()
+	for i, e := range set {
+		if int(e.Length) > maxFrameSize {
+			return nil, fmt.Errorf("template %d of %d bytes exceeds the max frame size %d", i, e.Length, maxFrameSize)
+		}
+		for pktDataOffset+uint32(e.Length) > s.frameSize {
+			s.frameSize *= 2
+		}
+		s.data = append(s.data, e.Data[:e.Length])
+	}
+	s.frameNr = pktRingSize / s.frameSize
+	s.tpl = make([]int32, s.frameNr)
+	for i := range s.tpl {
+		s.tpl[i] = -1
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return nil, fmt.Errorf("failed to select TPACKET_V3: %w", err)
+	}
+	if qdiscBypass {
+		if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_QDISC_BYPASS, 1); err != nil {
+			return nil, fmt.Errorf("failed to bypass the qdisc: %w", err)
+		}
+	}
+	req := unix.TpacketReq3{
+		Block_size: pktBlockFrames * s.frameSize,
+		Block_nr:   s.frameNr / pktBlockFrames,
+		Frame_size: s.frameSize,
+		Frame_nr:   s.frameNr,
+	}
+	if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_TX_RING, &req); err != nil {
+		return nil, fmt.Errorf("failed to set up the tx ring: %w", err)
+	}
+	if s.ring, err = unix.Mmap(fd, 0, pktRingSize, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return nil, fmt.Errorf("failed to mmap the tx ring: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Ifindex: ifindex}); err != nil {
+		return nil, fmt.Errorf("failed to bind: %w", err)
+	}
+	ok = true
+	return s, nil
+}
+
+func (s *packetSocket) frame(i uint32) *unix.Tpacket3Hdr {
+	return (*unix.Tpacket3Hdr)(unsafe.Pointer(&s.ring[(i%s.frameNr)*s.frameSize]))
+}
+
+func (s *packetSocket) send(n uint64) (uint64, error) {
+	s.complete()
+	if s.dropped > 0 {
+		return 0, fmt.Errorf("kernel rejected %d frames as malformed", s.dropped)
+	}
+
+	cnt := uint32(min(n, uint64(s.frameNr-s.pending)))
+	for range cnt {
+		i := s.head % s.frameNr
+		t := s.pick()
+		hdr := s.frame(i)
+		// a frame keeps its template, sequential order rarely copies
+		if s.tpl[i] != int32(t) {
+			off := int(i*s.frameSize) + pktDataOffset
+			copy(s.ring[off:], s.data[t])
+			s.tpl[i] = int32(t)
+		}
+		hdr.Len = uint32(len(s.data[t]))
+		hdr.Next_offset = 0
+		atomic.StoreUint32(&hdr.Status, unix.TP_STATUS_SEND_REQUEST)
+		s.head++
+	}
+	s.pending += cnt
+	return uint64(cnt), s.kick()
+}
+
+// kick hands the requested frames to the kernel without waiting for them.
+func (s *packetSocket) kick() error {
+	err := unix.Sendto(s.fd, nil, unix.MSG_DONTWAIT, nil)
+	switch {
+	case err == nil, errors.Is(err, unix.EAGAIN), errors.Is(err, unix.ENOBUFS):
+		return nil
+	default:
+		return fmt.Errorf("failed to flush tx ring: %w", err)
+	}
+}
+
+// complete counts the frames the kernel is done with.
+func (s *packetSocket) complete() {
+	var packets, bytes uint64
+	for s.pending > 0 {
+		hdr := s.frame(s.tail)
+		st := atomic.LoadUint32(&hdr.Status)
+		if st&(unix.TP_STATUS_SEND_REQUEST|unix.TP_STATUS_SENDING) != 0 {
+			break
+		}
+		if st&unix.TP_STATUS_WRONG_FORMAT != 0 {
+			s.dropped++
+			atomic.StoreUint32(&hdr.Status, unix.TP_STATUS_AVAILABLE)
+		} else {
+			packets++
+			bytes += uint64(hdr.Len)
+		}
+		s.tail++
+		s.pending--
+	}
+	if packets > 0 {
+		s.add(packets, bytes)
+	}
+}
+
+func (s *packetSocket) Close() error {
+	// let the queued frames go out so they are counted
+	deadline := time.Now().Add(drainTimeout)
+	for s.pending > 0 && time.Now().Before(deadline) {
+		if err := s.kick(); err != nil {
+			break
+		}
+		s.complete()
+	}
+	s.release()
+	s.txCounters.close()
+	return nil
+}
+
+func (s *packetSocket) release() {
+	if s.ring != nil {
+		unix.Munmap(s.ring)
+		s.ring = nil
+	}
+	if s.fd >= 0 {
+		unix.Close(s.fd)
+		s.fd = -1
+	}
+}
@@ -0,0 +1,312 @@
+package xdperf
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// every template gets one UMEM frame, jumbo templates consecutive
+	// frames sent as one multi-buffer packet. The frames are never written
+	// after setup so in-flight descriptors can share them
+	xskFrameSize = 4096
+	xskRingSize  = 2048
+)
+
+// afxdpEngines binds an AF_XDP socket to the queue of every worker on the
+// device, with the templates of the worker's set in its UMEM.
+func (x *Xdperf) afxdpEngines(workers []*txWorker) error {
+	order, err := x.checkStaticTemplates(engineAFXDP)
+	if err != nil {
+		return err
+	}
+
+	socks := make([]*xskSocket, 0, len(workers))
+	closeAll := func() {
+		for _, s := range socks {
+			s.Close()
+		}
+	}
+	for _, w := range workers {
+		set := x.txSets[w.idx%len(x.txSets)]
+		queue := x.txQueues[w.idx]
+		s, err := newXSKSocket(x.Device.Index, queue, set)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("failed to open AF_XDP socket on queue %d: %w", queue, err)
+		}
+		s.cpu = w.cpu
+		s.templatePicker = x.newTemplatePicker(w.idx, len(set), order)
+		x.Logger.Info("afxdp socket bound", zap.Int("queue", queue), zap.Int("cpu", w.cpu), zap.Bool("zerocopy", s.zeroCopy))
+		socks = append(socks, s)
+	}
+
+	counters := make([]*txCounters, len(socks))
+	for i, s := range socks {
+		counters[i] = &s.txCounters
+	}
+	if err := x.startTxStats(counters); err != nil {
+		closeAll()
+		return err
+	}
+	for i, w := range workers {
+		w.tx = socks[i]
+	}
+	return nil
+}
+
+// xskRing is a TX or completion ring shared with the kernel.
+type xskRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	flags    *uint32
+	descs    unsafe.Pointer
+	mask     uint32
+	size     uint32
+}
+
+func mapXSKRing(fd int, pgoff int64, off unix.XDPRingOffset, size uint32, descSize uintptr) (xskRing, error) {
+	mem, err := unix.Mmap(fd, pgoff, int(off.Desc)+int(size)*int(descSize),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return xskRing{}, fmt.Errorf("failed to mmap ring: %w", err)
+	}
+	base := unsafe.Pointer(&mem[0])
+	return xskRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Add(base, off.Producer)),
+		consumer: (*uint32)(unsafe.Add(base, off.Consumer)),
+		flags:    (*uint32)(unsafe.Add(base, off.Flags)),
+		descs:    unsafe.Add(base, off.Desc),
+		mask:     size - 1,
+		size:     size,
+	}, nil
+}
+
+func (r *xskRing) unmap() {
+	if r.mem != nil {
+		unix.Munmap(r.mem)
+		r.mem = nil
+	}
+}
+
+// xskSocket is an AF_XDP socket transmitting the templates of one worker.
+type xskSocket struct {
+	fd       int
+	zeroCopy bool
+
+	umem      []byte
+	first     []uint32 // first frame of every template
+	frameLen  []uint32 // bytes in every frame
+	frameLast []bool   // frame ends a packet
+	maxFrags  uint32
+	tx        xskRing
+	cq        xskRing
+
+	txProd      uint32
+	cqCons      uint32
+	outstanding uint32
+
+	templatePicker
+	txCounters
+}
+
+func newXSKSocket(ifindex, queue int, set []*TxOverrideEntry) (*xskSocket, error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %w", err)
+	}
+	s := &xskSocket{fd: fd, first: make([]uint32, len(set)), maxFrags: 1}
+	ok := false
+	defer func() {
+		if !ok {
+			s.release()
+		}
+	}()
+
+	frames := 0
+	for i, e := range set {
+		if int(e.Length) > maxFrameSize {
+			return nil, fmt.Errorf("template %d of %d bytes exceeds the max frame size %d", i, e.Length, maxFrameSize)
+		}
+		frames += (int(e.Length) + xskFrameSize - 1) / xskFrameSize
+	}
+	umemLen := frames * xskFrameSize
+	s.umem, err = unix.Mmap(-1, 0, umemLen, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate umem: %w", err)
+	}
+	s.frameLen = make([]uint32, frames)
+	s.frameLast = make([]bool, frames)
+	f := 0
+	for i, e := range set {
+		s.first[i] = uint32(f)
+		data := e.Data[:e.Length]
+		for len(data) > 0 {
+			n := copy(s.umem[f*xskFrameSize:(f+1)*xskFrameSize], data)
+			data = data[n:]
+			s.frameLen[f] = uint32(n)
+			f++
+		}
+		s.frameLast[f-1] = true
+		s.maxFrags = max(s.maxFrags, uint32(f)-s.first[i])
+	}
+
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		Len:  uint64(umemLen),
+		Size: xskFrameSize,
+	}
+	if err := setsockopt(fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return nil, fmt.Errorf("failed to register umem: %w", err)
+	}
+	// the kernel wants a fill ring even though nothing is received
+	for _, opt := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_TX_RING} {
+		if err := unix.SetsockoptInt(fd, unix.SOL_XDP, opt, xskRingSize); err != nil {
+			return nil, fmt.Errorf("failed to size ring %d: %w", opt, err)
+		}
+	}
+
+	var off unix.XDPMmapOffsets
+	offLen := uint32(unsafe.Sizeof(off))
+	if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS,
+		uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&offLen)), 0); errno != 0 {
+		return nil, fmt.Errorf("failed to get ring offsets: %w", errno)
+	}
+	if s.tx, err = mapXSKRing(fd, unix.XDP_PGOFF_TX_RING, off.Tx, xskRingSize, unsafe.Sizeof(unix.XDPDesc{})); err != nil {
+		return nil, err
+	}
+	if s.cq, err = mapXSKRing(fd, unix.XDP_UMEM_PGOFF_COMPLETION_RING, off.Cr, xskRingSize, unsafe.Sizeof(uint64(0))); err != nil {
+		return nil, err
+	}
+
+	// zero-copy when the driver supports it, copy mode otherwise
+	var sg uint16
+	if s.maxFrags > 1 {
+		sg = unix.XDP_USE_SG
+	}
+	sa := &unix.SockaddrXDP{
+		Flags:   unix.XDP_ZEROCOPY | unix.XDP_USE_NEED_WAKEUP | sg,
+		Ifindex: uint32(ifindex),
+		QueueID: uint32(queue),
+	}
+	if err := unix.Bind(fd, sa); err == nil {
+		s.zeroCopy = true
+	} else {
+		sa.Flags = unix.XDP_COPY | unix.XDP_USE_NEED_WAKEUP | sg
+		if err := unix.Bind(fd, sa); err != nil {
+			if sg != 0 {
+				return nil, fmt.Errorf("failed to bind with multi-buffer (XDP_USE_SG, kernel 6.6+): %w", err)
+			}
+			return nil, fmt.Errorf("failed to bind: %w", err)
+		}
+	}
+	ok = true
+	return s, nil
+}
+
+func setsockopt(fd int, opt int, val unsafe.Pointer, size uintptr) error {
+	if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt),
+		uintptr(val), size, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (s *xskSocket) send(n uint64) (uint64, error) {
+	s.complete()
+
+	free := s.tx.size - (s.txProd - atomic.LoadUint32(s.tx.consumer))
+	cnt := uint32(min(n, uint64(free/s.maxFrags)))
+	descs := unsafe.Slice((*unix.XDPDesc)(s.tx.descs), s.tx.size)
+	prod := s.txProd
+	for range cnt {
+		// one descriptor per frame, XDP_PKT_CONTD on all but the last
+		for f := s.first[s.pick()]; ; f++ {
+			d := &descs[prod&s.tx.mask]
+			d.Addr = uint64(f) * xskFrameSize
+			d.Len = s.frameLen[f]
+			d.Options = 0
+			prod++
+			if s.frameLast[f] {
+				break
+			}
+			d.Options = unix.XDP_PKT_CONTD
+		}
+	}
+	s.outstanding += prod - s.txProd
+	s.txProd = prod
+	atomic.StoreUint32(s.tx.producer, s.txProd)
+	return uint64(cnt), s.kick()
+}
+
+// kick asks the kernel to process the TX ring when it waits for a wakeup.
+func (s *xskSocket) kick() error {
+	if s.zeroCopy && atomic.LoadUint32(s.tx.flags)&unix.XDP_RING_NEED_WAKEUP == 0 {
+		return nil
+	}
+	err := unix.Sendto(s.fd, nil, unix.MSG_DONTWAIT, nil)
+	switch {
+	case err == nil, errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EBUSY), errors.Is(err, unix.ENOBUFS):
+		return nil
+	default:
+		return fmt.Errorf("failed to kick tx ring: %w", err)
+	}
+}
+
+// complete reaps the completion ring and counts what was sent.
+func (s *xskSocket) complete() {
+	prod := atomic.LoadUint32(s.cq.producer)
+	if prod == s.cqCons {
+		return
+	}
+	addrs := unsafe.Slice((*uint64)(s.cq.descs), s.cq.size)
+	var packets, bytes uint64
+	for i := s.cqCons; i != prod; i++ {
+		f := addrs[i&s.cq.mask] / xskFrameSize
+		bytes += uint64(s.frameLen[f])
+		if s.frameLast[f] {
+			packets++
+		}
+	}
+	done := prod - s.cqCons
+	s.cqCons = prod
+	atomic.StoreUint32(s.cq.consumer, prod)
+	s.outstanding -= done
+	s.add(packets, bytes)
+}
+
+func (s *xskSocket) Close() error {
+	// let the queued packets go out so they are counted
+	deadline := time.Now().Add(drainTimeout)
+	for s.outstanding > 0 && time.Now().Before(deadline) {
+		if err := s.kick(); err != nil {
+			break
+		}
+		s.complete()
+	}
+	s.release()
+	s.txCounters.close()
+	return nil
+}
+
+func (s *xskSocket) release() {
+	s.tx.unmap()
+	s.cq.unmap()
+	if s.umem != nil {
+		unix.Munmap(s.umem)
+		s.umem = nil
+	}
+	if s.fd >= 0 {
+		unix.Close(s.fd)
+		s.fd = -1
+	}
+}
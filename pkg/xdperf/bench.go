@@ -0,0 +1,164 @@
+package xdperf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/takehaya/xdperf/pkg/rfc2544"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// BenchConfig selects what Bench measures.
+type BenchConfig struct {
+	FrameSizes []int  // ethernet frame sizes including FCS
+	Packets    uint32 // packets per frame size
+	Live       bool   // send live frames on the device instead of a dry run
+	Baseline   bool   // also dry run xdp_tx_byteloop, the per-byte template copy
+}
+
+// BenchResult is the cost of the TX program on one core for a frame size.
+type BenchResult struct {
+	FrameSize   int     `json:"frame_size"`
+	Program     string  `json:"program"`
+	Live        bool    `json:"live"`
+	Packets     uint64  `json:"packets"`
+	NsPerPacket float64 `json:"ns_per_packet"`
+	PPSPerCore  float64 `json:"pps_per_core"`
+}
+
+// Bench measures packets per second per core of the TX program with the
+// plugin's templates sized to every frame size. The dry run executes the
+// program with BPF_PROG_RUN without transmitting, so it isolates the cost
+// of the template rewrite from the driver; the live run sends on the
+// device with one worker. The baseline adds a dry run of the program with
+// the per-byte template copy for the frame sizes it supports.
+func (x *Xdperf) Bench(ctx context.Context, cfg BenchConfig) ([]BenchResult, error) {
+	if x.trialTemplates == nil {
+		x.trialTemplates = make(map[string][]*TxOverrideEntry)
+	}
+	// one pinned thread, the config of the run is left as it is
+	base := x.cfg
+	defer func() { x.cfg = base }()
+	x.cfg.Parallelism = 1
+	if err := x.placeWorkers(); err != nil {
+		return nil, err
+	}
+
+	var results []BenchResult
+	for _, size := range cfg.FrameSizes {
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		entries, err := x.sizedTemplates(ctx, "bench", size-rfc2544.FCSLen, nil)
+		if err != nil {
+			return results, fmt.Errorf("frame size %d: %w", size, err)
+		}
+		if err := x.initEbpfMap(entries); err != nil {
+			return results, err
+		}
+		prog := x.choiceTXBPFProgram()
+		info, err := prog.Info()
+		if err != nil {
+			return results, fmt.Errorf("failed to get program info: %w", err)
+		}
+
+		r := BenchResult{FrameSize: size, Program: info.Name, Live: cfg.Live, Packets: uint64(cfg.Packets)}
+		var elapsed time.Duration
+		if cfg.Live {
+			elapsed, err = x.benchLive(ctx, cfg.Packets)
+		} else {
+			elapsed, err = x.benchDry(prog, cfg.Packets)
+		}
+		if err != nil {
+			return results, fmt.Errorf("frame size %d: %w", size, err)
+		}
+		results = append(results, x.benchResult(r, elapsed))
+
+		if !cfg.Baseline || x.maxTxLen() > maxTemplateSize {
+			continue
+		}
+		r = BenchResult{FrameSize: size, Program: "xdp_tx_byteloop", Packets: uint64(cfg.Packets)}
+		if elapsed, err = x.benchDry(x.bpfobjs.XdpTxByteloop, cfg.Packets); err != nil {
+			return results, fmt.Errorf("frame size %d baseline: %w", size, err)
+		}
+		results = append(results, x.benchResult(r, elapsed))
+	}
+	return results, nil
+}
+
+// benchResult fills in the per-packet cost of r from the run time of its
+// packets.
+func (x *Xdperf) benchResult(r BenchResult, elapsed time.Duration) BenchResult {
+	r.NsPerPacket = float64(elapsed.Nanoseconds()) / float64(r.Packets)
+	if r.NsPerPacket > 0 {
+		r.PPSPerCore = 1e9 / r.NsPerPacket
+	}
+	x.Logger.Info("bench", zap.Int("frame_size", r.FrameSize), zap.String("program", r.Program),
+		zap.Float64("ns_per_packet", r.NsPerPacket))
+	return r
+}
+
+// benchDry runs the program packets times on the worker cpu and returns
+// the total run time measured by the kernel.
+func (x *Xdperf) benchDry(prog *ebpf.Program, packets uint32) (time.Duration, error) {
+	in, err := x.txFrame(prog, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to build sample packet: %w", err)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := pinThread(x.txCPUs[0]); err != nil {
+		return 0, err
+	}
+	ret, per, err := prog.Benchmark(in, int(packets), nil)
+	if err != nil {
+		return 0, fmt.Errorf("bpf_prog_run failed: %w", err)
+	}
+	if ret != xdpTX {
+		return 0, fmt.Errorf("tx program returned %d instead of XDP_TX", ret)
+	}
+	return per * time.Duration(packets), nil
+}
+
+// pinThread binds the locked OS thread of the caller to cpu.
+func pinThread(cpu int) error {
+	var cpuset unix.CPUSet
+	cpuset.Set(cpu)
+	if err := unix.SchedSetaffinity(unix.Gettid(), &cpuset); err != nil {
+		return fmt.Errorf("failed to set CPU affinity: %v", err)
+	}
+	return nil
+}
+
+// benchLive sends packets live frames from one worker and returns the
+// wall-clock time.
+func (x *Xdperf) benchLive(ctx context.Context, packets uint32) (time.Duration, error) {
+	w := &txWorker{idx: 0, cpu: x.txCPUs[0], count: uint64(packets)}
+	start := time.Now()
+	if err := x.runWorkers(ctx, []*txWorker{w}, 0); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// xdpTX is XDP_TX, the verdict of the TX program
+const xdpTX = 3
+
+// WriteBenchText prints bench results as a table.
+func WriteBenchText(w io.Writer, results []BenchResult) error {
+	if _, err := fmt.Fprintf(w, "%-10s %-16s %-5s %12s %14s\n", "frame", "program", "live", "ns/packet", "pps/core"); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if _, err := fmt.Fprintf(w, "%-10d %-16s %-5t %12.1f %14.0f\n",
+			r.FrameSize, r.Program, r.Live, r.NsPerPacket, r.PPSPerCore); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package xdperf
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"github.com/takehaya/xdperf/pkg/rfc2544"
+	"go.uber.org/zap"
+)
+
+// BenchmarkTXTemplateCopy dry runs the TX program and xdp_tx_byteloop, the
+// per-byte template copy it replaced, on one cpu for every RFC 2544 frame
+// size. Loading the objects needs CAP_BPF, the benchmark is skipped without.
+func BenchmarkTXTemplateCopy(b *testing.B) {
+	obj, err := coreelf.ReadCollection()
+	if err != nil {
+		b.Skipf("failed to load eBPF objects: %v", err)
+	}
+	defer obj.Close()
+	x := &Xdperf{
+		Logger:   zap.NewNop(),
+		bpfobjs:  obj,
+		Device:   &net.Interface{Name: "bench", HardwareAddr: testSrcMAC},
+		cfg:      Config{Parallelism: 1},
+		txCPUs:   []int{0},
+		txQueues: []int{0},
+	}
+	for _, size := range rfc2544.DefaultFrameSizes {
+		data, err := resizeTemplate(testFrame(b, false, false, nil), size-rfc2544.FCSLen)
+		if err != nil {
+			b.Fatal(err)
+		}
+		entry := &TxOverrideEntry{Data: data, Length: uint16(len(data))}
+		if err := x.initEbpfMap([]*TxOverrideEntry{entry}); err != nil {
+			b.Fatal(err)
+		}
+		// loading the templates sizes the maps and reloads the programs
+		progs := []struct {
+			name string
+			prog *ebpf.Program
+		}{
+			{"store_bytes", obj.XdpTx},
+			{"byteloop", obj.XdpTxByteloop},
+		}
+		for _, p := range progs {
+			b.Run(fmt.Sprintf("%s/%d", p.name, size), func(b *testing.B) {
+				if _, err := x.benchDry(p.prog, uint32(b.N)); err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package xdperf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BenchProgConfig selects the XDP program bench-prog measures.
+type BenchProgConfig struct {
+	Path    string // BPF object
+	Section string // section or name of the program, "" = its only XDP program
+	Packets uint64 // packets over all templates, split by their share of the slots
+	Batch   uint32 // repetitions per BPF_PROG_RUN call
+}
+
+// BenchProgTemplate is the cost of the program for one template.
+type BenchProgTemplate struct {
+	Index       int               `json:"index"`
+	Length      int               `json:"length"`
+	Packets     uint64            `json:"packets"`
+	NsPerPacket float64           `json:"ns_per_packet"`
+	Verdicts    map[string]uint64 `json:"verdicts"`
+}
+
+// BenchProgResult is the cost of the program on one core over the mix of
+// templates.
+type BenchProgResult struct {
+	Program     string              `json:"program"`
+	Packets     uint64              `json:"packets"`
+	NsPerPacket float64             `json:"ns_per_packet"`
+	PPSPerCore  float64             `json:"pps_per_core"`
+	GbpsPerCore float64             `json:"gbps_per_core"`
+	Verdicts    map[string]uint64   `json:"verdicts"`
+	Templates   []BenchProgTemplate `json:"templates"`
+}
+
+// xdpVerdicts names the XDP return codes.
+var xdpVerdicts = []string{"XDP_ABORTED", "XDP_DROP", "XDP_PASS", "XDP_TX", "XDP_REDIRECT"}
+
+func xdpVerdict(ret uint32) string {
+	if int(ret) < len(xdpVerdicts) {
+		return xdpVerdicts[ret]
+	}
+	return fmt.Sprintf("%d", ret)
+}
+
+// BenchProg runs the plugin's templates through a user XDP program with
+// BPF_PROG_RUN on one pinned cpu, without live frames, so no NIC is
+// involved. Templates are sent as generated: field modifiers and stamps,
+// which the TX program applies, are not. The kernel reports the verdict of
+// the last repetition of a call, so a verdict counts for the whole batch.
+func (x *Xdperf) BenchProg(ctx context.Context, cfg BenchProgConfig) (*BenchProgResult, error) {
+	spec, name, err := xdpProgSpec(cfg.Path, cfg.Section)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := loadXDPProg(spec, name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", cfg.Path, err)
+	}
+	defer prog.Close()
+
+	entries, err := x.prepareTemplates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("the plugin returned no templates")
+	}
+	// slots of every distinct template, IMIX repeats them
+	var distinct []*TxOverrideEntry
+	slots := make(map[*TxOverrideEntry]uint64)
+	for _, e := range entries {
+		if slots[e] == 0 {
+			distinct = append(distinct, e)
+		}
+		slots[e]++
+	}
+
+	// one pinned thread, the config of the run is left as it is
+	base := x.cfg
+	defer func() { x.cfg = base }()
+	x.cfg.Parallelism = 1
+	if err := x.placeWorkers(); err != nil {
+		return nil, err
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := pinThread(x.txCPUs[0]); err != nil {
+		return nil, err
+	}
+
+	res := &BenchProgResult{Program: name, Verdicts: make(map[string]uint64)}
+	var total time.Duration
+	var bytes uint64
+	for i, e := range distinct {
+		t := BenchProgTemplate{
+			Index:    i,
+			Length:   int(e.Length),
+			Packets:  max(1, cfg.Packets*slots[e]/uint64(len(entries))),
+			Verdicts: make(map[string]uint64),
+		}
+		var elapsed time.Duration
+		for done := uint64(0); done < t.Packets; {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			n := min(uint64(cfg.Batch), t.Packets-done)
+			ret, per, err := prog.Benchmark(e.Data[:e.Length], int(n), nil)
+			if err != nil {
+				return nil, fmt.Errorf("bpf_prog_run failed on template %d (%d bytes): %w", i, e.Length, err)
+			}
+			elapsed += per * time.Duration(n)
+			t.Verdicts[xdpVerdict(ret)] += n
+			res.Verdicts[xdpVerdict(ret)] += n
+			done += n
+		}
+		t.NsPerPacket = float64(elapsed.Nanoseconds()) / float64(t.Packets)
+		x.Logger.Info("bench-prog", zap.Int("template", i), zap.Float64("ns_per_packet", t.NsPerPacket))
+		res.Templates = append(res.Templates, t)
+		res.Packets += t.Packets
+		total += elapsed
+		bytes += t.Packets * uint64(e.Length)
+	}
+
+	res.NsPerPacket = float64(total.Nanoseconds()) / float64(res.Packets)
+	if total > 0 {
+		res.PPSPerCore = float64(res.Packets) / total.Seconds()
+		res.GbpsPerCore = float64(bytes*8) / total.Seconds() / 1e9
+	}
+	return res, nil
+}
+
+// WriteBenchProgText prints a bench-prog result as a table per template
+// followed by the totals.
+func WriteBenchProgText(w io.Writer, r *BenchProgResult) error {
+	if _, err := fmt.Fprintf(w, "%-8s %-8s %12s %12s  %s\n", "template", "length", "packets", "ns/packet", "verdicts"); err != nil {
+		return err
+	}
+	for _, t := range r.Templates {
+		if _, err := fmt.Fprintf(w, "%-8d %-8d %12d %12.1f  %s\n",
+			t.Index, t.Length, t.Packets, t.NsPerPacket, formatVerdicts(t.Verdicts, t.Packets)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "\nprogram %s: %.1f ns/packet, %.0f pps/core, %.2f Gbps/core\nverdicts: %s\n",
+		r.Program, r.NsPerPacket, r.PPSPerCore, r.GbpsPerCore, formatVerdicts(r.Verdicts, r.Packets))
+	return err
+}
+
+// formatVerdicts lists the verdicts with their share of packets.
+func formatVerdicts(v map[string]uint64, packets uint64) string {
+	names := make([]string, 0, len(v))
+	for n := range v {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	s := ""
+	for i, n := range names {
+		if i > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%s=%.1f%%", n, float64(v[n])*100/float64(packets))
+	}
+	return s
+}
@@ -11,67 +11,321 @@ import (
 type TxOverrideEntry struct {
 	Data   []byte
 	Length uint16
+
+	// rewrite metadata, 0 means unused
+	StampOff  uint16
+	L4CsumOff uint16
+	L4Proto   uint8
+	IPCsumOff uint16
+
+	// per-packet field rewrites, see modifier.go
+	Mods []txModifier
+	// checksums not updated after a rewrite, MOD_F_* bits
+	CsumSkip uint8
+	// plugin TX cpu hint, nil = none
+	CPU *uint32
+}
+
+// keep in sync with MAX_TEMPLATE_SIZE, MAX_FRAME_SIZE and TX_ORDER_* in
+// src/xdp_prog.h
+const (
+	maxTemplateSize = 2048 // single buffer frames, xdp_tx
+	maxFrameSize    = 9216 // jumbo frames, xdp_tx_frags
+
+	txOrderSeq    uint32 = 0
+	txOrderRandom uint32 = 1
+)
+
+var txOrders = map[string]uint32{
+	"":           txOrderSeq,
+	"sequential": txOrderSeq,
+	"random":     txOrderRandom,
 }
 
-// percpu ごとに TX Override Map を初期化
-// 分散してパケットを入れるようにする
-func (x *Xdperf) initTxOverrideMap(entry []*TxOverrideEntry) error {
-	if len(entry) == 0 {
+// TX Override Map を初期化
+// 同じテンプレートは cpu や slot をまたいで一度だけ格納し、worker w の cpu は
+// sets[w % len(sets)] のテンプレート id を tx_index_map の slot 0 から順に持つ
+func (x *Xdperf) initTxOverrideMap(sets [][]*TxOverrideEntry) error {
+	if len(sets) == 0 {
 		return fmt.Errorf("no entry")
 	}
-	key := uint32(0)
 	numCpus, err := ebpf.PossibleCPU()
 	if err != nil {
 		return fmt.Errorf("failed get possible CPU: %w", err)
 	}
-	entrycount := len(entry)
-	entrylist := make([]coreelf.BpfPktTemplate, numCpus)
-	for cpu := 0; cpu < numCpus; cpu++ {
-		idx := cpu % entrycount
-		e := *entry[idx]
-		ld := int(e.Length)
-		if ld <= 0 {
-			return fmt.Errorf("invalid entry length: %d", e.Length)
+
+	// template ids, an entry repeated in a set (IMIX) or shared by sets is
+	// stored once
+	ids := make(map[*TxOverrideEntry]uint32)
+	var templates []*TxOverrideEntry
+	var sizes coreelf.TxSizes
+	for _, set := range sets {
+		if len(set) == 0 {
+			return fmt.Errorf("no entry")
 		}
-		if ld > len(e.Data) {
-			return fmt.Errorf("length %d exceeds data size %d", e.Length, len(e.Data))
+		sizes.Slots = max(sizes.Slots, uint32(len(set)))
+		for _, e := range set {
+			if _, ok := ids[e]; ok {
+				continue
+			}
+			if err := checkTemplate(e); err != nil {
+				return err
+			}
+			ids[e] = uint32(len(templates))
+			templates = append(templates, e)
+			if int(e.Length) > maxTemplateSize {
+				sizes.Tails++
+			}
 		}
+	}
+	sizes.Templates = uint32(len(templates))
+	if err := x.loadTxMaps(sizes); err != nil {
+		return err
+	}
+
+	var tail uint32
+	for id, e := range templates {
+		key := uint32(id)
+		pt := newPktTemplate(e)
+		if ld := int(e.Length); ld > maxTemplateSize {
+			// bytes past maxTemplateSize
+			var t coreelf.BpfPktTail
+			copy(t.Data[:], e.Data[maxTemplateSize:ld])
+			if err := x.bpfobjs.BpfMaps.TxTailMap.Put(&tail, &t); err != nil {
+				return fmt.Errorf("failed put tx tail map: %w", err)
+			}
+			pt.Tail = tail
+			tail++
+		}
+		if err := x.bpfobjs.BpfMaps.TxOverrideMap.Put(&key, pt); err != nil {
+			return fmt.Errorf("failed put tx override map: %w", err)
+		}
+	}
 
-		entrylist[cpu] = coreelf.BpfPktTemplate{
-			Len: uint32(e.Length),
+	workers := x.cpuWorkers(numCpus)
+	idlist := make([]uint32, numCpus)
+	for slot := uint32(0); slot < sizes.Slots; slot++ {
+		for cpu := range idlist {
+			set := sets[workers[cpu]%len(sets)]
+			// slots past the count of a cpu are never read
+			idlist[cpu] = 0
+			if int(slot) < len(set) {
+				idlist[cpu] = ids[set[slot]]
+			}
 		}
-		copy(entrylist[cpu].Data[:], e.Data)
+		if err := x.bpfobjs.BpfMaps.TxIndexMap.Put(&slot, idlist); err != nil {
+			return fmt.Errorf("failed put tx index map: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadTxMaps loads the TX programs again when the template maps need other
+// sizes than the loaded ones.
+func (x *Xdperf) loadTxMaps(sizes coreelf.TxSizes) error {
+	if sizes == x.txSizes {
+		return nil
+	}
+	if err := coreelf.LoadTx(x.bpfobjs, sizes); err != nil {
+		return fmt.Errorf("failed to size tx maps: %w", err)
+	}
+	x.closeTxProg()
+	x.txSizes = sizes
+	x.Logger.Info("tx maps sized",
+		zap.Uint32("templates", sizes.Templates),
+		zap.Uint32("tails", sizes.Tails),
+		zap.Uint32("slots", sizes.Slots))
+	return nil
+}
+
+// checkTemplate validates a template before it is loaded.
+func checkTemplate(e *TxOverrideEntry) error {
+	ld := int(e.Length)
+	if ld <= 0 {
+		return fmt.Errorf("invalid entry length: %d", e.Length)
+	}
+	if ld > len(e.Data) {
+		return fmt.Errorf("length %d exceeds data size %d", e.Length, len(e.Data))
+	}
+	if len(e.Mods) > len(coreelf.BpfPktTemplate{}.Mods) {
+		return fmt.Errorf("%d modifiers exceed the maximum of %d", len(e.Mods), len(coreelf.BpfPktTemplate{}.Mods))
+	}
+	if ld > maxFrameSize {
+		return fmt.Errorf("length %d exceeds max frame size %d", e.Length, maxFrameSize)
+	}
+	return checkLinearRewrites(e)
+}
+
+// newPktTemplate converts e to the tx_override_map value, without the tail.
+func newPktTemplate(e *TxOverrideEntry) *coreelf.BpfPktTemplate {
+	pt := &coreelf.BpfPktTemplate{
+		Len:       uint32(e.Length),
+		StampOff:  e.StampOff,
+		L4CsumOff: e.L4CsumOff,
+		L4Proto:   e.L4Proto,
+		IpCsumOff: e.IPCsumOff,
+		NrMods:    uint8(len(e.Mods)),
+	}
+	if e.CsumSkip&modFlagIPCsum != 0 {
+		pt.IpCsumOff = 0
+	}
+	if e.CsumSkip&modFlagL4Csum != 0 {
+		pt.L4CsumOff = 0
+	}
+	for i, m := range e.Mods {
+		mod := &pt.Mods[i]
+		mod.Offset = m.Offset
+		mod.Len = m.Len
+		mod.Op = m.Op
+		mod.Flags = m.Flags
+		mod.Min = m.Min
+		mod.Span = m.Span
+		mod.Step = m.Step
+	}
+	copy(pt.Data[:], e.Data[:min(int(e.Length), maxTemplateSize)])
+	return pt
+}
+
+// checkLinearRewrites fails when a stamp or modifier lies past the first
+// maxTemplateSize bytes, which are the only ones the TX program rewrites.
+func checkLinearRewrites(e *TxOverrideEntry) error {
+	if e.StampOff != 0 && int(e.StampOff)+stampSize > maxTemplateSize {
+		return fmt.Errorf("sequence stamp at offset %d is past the first %d bytes", e.StampOff, maxTemplateSize)
 	}
-	if err := x.bpfobjs.BpfMaps.TxOverrideMap.Put(&key, entrylist); err != nil {
-		return fmt.Errorf("failed put tx override map: %w", err)
+	for _, m := range e.Mods {
+		if int(m.Offset&^1)+4 > maxTemplateSize {
+			return fmt.Errorf("modifier at offset %d is past the first %d bytes", m.Offset, maxTemplateSize)
+		}
 	}
 	return nil
 }
 
-func (x *Xdperf) initSeqStateMap() error {
+// maxTxLen returns the length of the largest template loaded for the
+// workers.
+func (x *Xdperf) maxTxLen() int {
+	n := 0
+	for _, set := range x.txSets {
+		for _, e := range set {
+			n = max(n, int(e.Length))
+		}
+	}
+	return n
+}
+
+// initSeqStateMap sets the template count and order of every cpu. Workers
+// sharing a set start at different templates.
+func (x *Xdperf) initSeqStateMap(sets [][]*TxOverrideEntry) error {
 	key := uint32(0)
 	numCpus, err := ebpf.PossibleCPU()
 	if err != nil {
 		return fmt.Errorf("failed get possible CPU: %w", err)
 	}
-	entrylist := make([]uint32, numCpus)
+	order, ok := txOrders[x.cfg.TxOrder]
+	if !ok {
+		return fmt.Errorf("unknown tx order: %s", x.cfg.TxOrder)
+	}
+	workers := x.cpuWorkers(numCpus)
+	entrylist := make([]coreelf.BpfTxState, numCpus)
+	for cpu := range entrylist {
+		w := workers[cpu]
+		count := uint32(len(sets[w%len(sets)]))
+		entrylist[cpu] = coreelf.BpfTxState{
+			Idx:   uint32(w/len(sets)) % count,
+			Count: count,
+			Order: order,
+		}
+	}
 	if err := x.bpfobjs.BpfMaps.SeqStateMap.Put(&key, entrylist); err != nil {
 		return fmt.Errorf("failed put seq state map: %w", err)
 	}
+	// sequence stamps start from 0 on every run
+	seqlist := make([]uint64, numCpus)
+	if err := x.bpfobjs.BpfMaps.TxSeqMap.Put(&key, seqlist); err != nil {
+		return fmt.Errorf("failed put tx seq map: %w", err)
+	}
+	// modifier counters restart with the templates
+	if err := zeroPerCPU[uint64](x.bpfobjs.BpfMaps.ModStateMap, x.txSizes.Slots); err != nil {
+		return fmt.Errorf("failed to reset mod state map: %w", err)
+	}
 	return nil
 }
 
+// keep in sync with TX_F_* in src/xdp_prog.h
+const (
+	txFlagStampSeq uint32 = 1 << 0
+	txFlagStampTS  uint32 = 1 << 1
+)
+
+// initTxConfigMap writes the TX config of every cpu. The stream group is
+// --stream-id unless txStreamGroups assigns one to the worker of the cpu.
+func (x *Xdperf) initTxConfigMap() error {
+	key := uint32(0)
+	cfg := coreelf.BpfTxConfig{
+		StreamGroup: uint32(x.cfg.StreamGroup),
+	}
+	if x.cfg.Seq {
+		cfg.Flags |= txFlagStampSeq
+	}
+	if x.cfg.Latency {
+		offset, err := clockOffset(x.cfg.LatencyClock)
+		if err != nil {
+			return err
+		}
+		cfg.Flags |= txFlagStampTS
+		cfg.ClockOffset = offset
+	}
+	cfgs := make([]coreelf.BpfTxConfig, ebpf.MustPossibleCPU())
+	workers := x.cpuWorkers(len(cfgs))
+	for cpu := range cfgs {
+		w := workers[cpu]
+		cfgs[cpu] = cfg
+		// the workers share the increments of every modifier
+		cfgs[cpu].ModStride = uint32(x.cfg.Parallelism)
+		cfgs[cpu].ModOffset = uint32(w % x.cfg.Parallelism)
+		if w < len(x.txStreamGroups) {
+			cfgs[cpu].StreamGroup = x.txStreamGroups[w]
+		}
+	}
+	if err := x.bpfobjs.TxConfigMap.Put(&key, cfgs); err != nil {
+		return fmt.Errorf("failed put tx config map: %w", err)
+	}
+	return nil
+}
+
+// initEbpfMap loads the same templates on every cpu.
 func (x *Xdperf) initEbpfMap(entries []*TxOverrideEntry) error {
-	if err := x.initSeqStateMap(); err != nil {
-		x.Logger.Error("failed to init seq state map", zap.Error(err))
-		return fmt.Errorf("failed to init seq state map: %w", err)
+	return x.initEbpfMapSets([][]*TxOverrideEntry{entries})
+}
+
+// initEbpfMapSets loads sets[w % len(sets)] on the cpu of every worker w.
+func (x *Xdperf) initEbpfMapSets(sets [][]*TxOverrideEntry) error {
+	if err := x.placeWorkers(); err != nil {
+		return fmt.Errorf("failed to place tx workers: %w", err)
 	}
-	x.Logger.Info("seq state map initialized")
+	x.txSets = sets
+	if err := x.initTxConfigMap(); err != nil {
+		x.Logger.Error("failed to init tx config map", zap.Error(err))
+		return fmt.Errorf("failed to init tx config map: %w", err)
+	}
+	x.Logger.Info("tx config map initialized")
 
-	if err := x.initTxOverrideMap(entries); err != nil {
+	if err := x.initTxOverrideMap(sets); err != nil {
 		x.Logger.Error("failed to init tx override map", zap.Error(err))
 		return fmt.Errorf("failed to init tx override map: %w", err)
 	}
 	x.Logger.Info("tx override map initialized")
+
+	if err := x.initSeqStateMap(sets); err != nil {
+		x.Logger.Error("failed to init seq state map", zap.Error(err))
+		return fmt.Errorf("failed to init seq state map: %w", err)
+	}
+	x.Logger.Info("seq state map initialized")
+
+	if x.cfg.TxProg != "" && x.txProg == nil {
+		if err := x.loadTxProg(); err != nil {
+			x.Logger.Error("failed to load tx program", zap.Error(err))
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,49 @@
+package xdperf
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"github.com/takehaya/xdperf/pkg/plugin"
+)
+
+// checksumSkip returns the checksums of a template the TX program must leave
+// as they are after rewriting the frame, as MOD_F_* bits. Without defs every
+// checksum is kept up to date; with defs only the layers listed with
+// auto_update are, so a template can carry a deliberately bad checksum.
+func checksumSkip(data []byte, defs []plugin.ChecksumDef) (uint8, error) {
+	if len(defs) == 0 {
+		return 0, nil
+	}
+	lay, err := parseTemplateLayout(data)
+	if err != nil {
+		return 0, err
+	}
+	skip := modFlagIPCsum | modFlagL4Csum
+	for _, d := range defs {
+		switch d.Algorithm {
+		case "", "internet", "incremental":
+		default:
+			return 0, fmt.Errorf("checksum %s: unsupported algorithm %q", d.Layer, d.Algorithm)
+		}
+		var flag uint8
+		switch d.Layer {
+		case "ipv4":
+			if !lay.IPv4 {
+				return 0, fmt.Errorf("checksum ipv4: template has no IPv4 header")
+			}
+			flag = modFlagIPCsum
+		case "udp", "tcp":
+			if lay.L4Offset == 0 || (d.Layer == "udp") != (lay.L4Proto == layers.IPProtocolUDP) {
+				return 0, fmt.Errorf("checksum %s: template has no %s header", d.Layer, d.Layer)
+			}
+			flag = modFlagL4Csum
+		default:
+			return 0, fmt.Errorf("checksum %s: unknown layer", d.Layer)
+		}
+		if d.AutoUpdate {
+			skip &^= flag
+		}
+	}
+	return skip, nil
+}
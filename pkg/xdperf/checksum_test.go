@@ -0,0 +1,67 @@
+package xdperf
+
+import (
+	"testing"
+
+	"github.com/takehaya/xdperf/pkg/plugin"
+)
+
+func TestChecksumSkip(t *testing.T) {
+	udp4 := func(t *testing.T) []byte { return testFrame(t, false, false, []byte("payload")) }
+	tcp6 := func(t *testing.T) []byte { return testFrame(t, true, true, []byte("payload")) }
+
+	tests := []struct {
+		name    string
+		frame   func(*testing.T) []byte
+		defs    []plugin.ChecksumDef
+		want    uint8
+		wantErr bool
+	}{
+		{name: "no defs", frame: udp4, want: 0},
+		{
+			name:  "all auto",
+			frame: udp4,
+			defs:  []plugin.ChecksumDef{{Layer: "ipv4", AutoUpdate: true}, {Layer: "udp", AutoUpdate: true}},
+			want:  0,
+		},
+		{
+			name:  "ipv4 only",
+			frame: udp4,
+			defs:  []plugin.ChecksumDef{{Layer: "ipv4", AutoUpdate: true}},
+			want:  modFlagL4Csum,
+		},
+		{
+			name:  "udp kept bad",
+			frame: udp4,
+			defs:  []plugin.ChecksumDef{{Layer: "ipv4", AutoUpdate: true}, {Layer: "udp"}},
+			want:  modFlagL4Csum,
+		},
+		{
+			name:  "algorithms",
+			frame: udp4,
+			defs:  []plugin.ChecksumDef{{Layer: "ipv4", AutoUpdate: true, Algorithm: "internet"}, {Layer: "udp", AutoUpdate: true, Algorithm: "incremental"}},
+			want:  0,
+		},
+		{
+			name:  "tcp",
+			frame: tcp6,
+			defs:  []plugin.ChecksumDef{{Layer: "tcp", AutoUpdate: true}},
+			want:  modFlagIPCsum,
+		},
+		{name: "ipv4 on ipv6", frame: tcp6, defs: []plugin.ChecksumDef{{Layer: "ipv4"}}, wantErr: true},
+		{name: "udp on tcp", frame: tcp6, defs: []plugin.ChecksumDef{{Layer: "udp"}}, wantErr: true},
+		{name: "unknown layer", frame: udp4, defs: []plugin.ChecksumDef{{Layer: "sctp"}}, wantErr: true},
+		{name: "unknown algorithm", frame: udp4, defs: []plugin.ChecksumDef{{Layer: "udp", Algorithm: "crc32c"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checksumSkip(tt.frame(t), tt.defs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checksumSkip error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("checksumSkip = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package xdperf
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/takehaya/xdperf/pkg/logger"
+	"github.com/takehaya/xdperf/pkg/sysinfo"
 )
 
 type Config struct {
@@ -17,7 +19,51 @@ type Config struct {
 	ServerFlag         bool
 	Device             string
 	Parallelism        int
-	Count              int
+	CPUs               string        // TX worker cpus, e.g. "8-15,24", "" = NUMA node of the device
+	Queues             string        // device queue of every TX worker, e.g. "0-7", "" = worker index
+	Count              int           // total packets, 0 = unlimited
+	Duration           time.Duration // 0 = until count is reached
+	XDPMode            string        // "", "native", "generic", "offload"
+	Engine             string        // "xdp" (BPF_PROG_RUN live frames), "afxdp" or "afpacket"
+	QdiscBypass        bool          // afpacket: skip the qdisc layer
+	TxProg             string        // user TX program object replacing the built-in ones
+	TxSection          string        // section or name of the program in TxProg, "" = its only XDP program
+	Rate               string        // target TX rate, e.g. "10Mpps" or "40Gbps"
+	TxOrder            string        // "sequential" or "random" template order per cpu
+	IMIX               string        // IMIX profile or size:weight list
+	Distribution       string        // how templates are spread over the TX cpus, "" = plugin default
+
+	// sequence stamping (both sides)
+	Seq         bool
+	StampOffset int // offset of the stamp from the L4 payload
+	StreamGroup int
+
+	// latency measurement
+	Latency      bool
+	LatencyClock string // "mono" or "realtime"
+	RTT          bool   // client receives its packets back from a reflecting server, sets Latency
+
+	// server mode
+	RxAction       string // "drop", "pass", "redirect", "reflect"
+	RedirectDevice string
+
+	// control channel
+	Peer        string // client: server address, host[:port]
+	ControlPort int    // server: listen port, 0 disables
+	Token       string // pre-shared token
+	NoToken     bool   // server: accept clients without a token
+	TLS         bool   // client: use TLS
+	TLSCA       string // client: CA bundle to verify the server
+	TLSInsecure bool   // client: skip server certificate verification
+	TLSCert     string // server: certificate, enables TLS
+	TLSKey      string // server: private key
+
+	// trials (rfc2544): local device receiving the DUT output when no peer is used
+	RxDevice string
+
+	// test direction (client)
+	Reverse bool // server transmits, client receives
+	Bidir   bool // both sides transmit
 }
 
 func (c *Config) Validate() error {
@@ -30,16 +76,103 @@ func (c *Config) Validate() error {
 	if c.Parallelism <= 0 {
 		return fmt.Errorf("parallelism must be positive")
 	}
-	if c.Count <= 0 {
-		return fmt.Errorf("count must be positive")
+	if c.CPUs != "" {
+		cpus, err := sysinfo.ParseCPUList(c.CPUs)
+		if err != nil {
+			return err
+		}
+		if len(cpus) < c.Parallelism {
+			return fmt.Errorf("--cpus lists %d cpus, parallelism is %d", len(cpus), c.Parallelism)
+		}
+	}
+	if c.Queues != "" {
+		queues, err := sysinfo.ParseList(c.Queues, "queue")
+		if err != nil {
+			return fmt.Errorf("invalid --queues: %w", err)
+		}
+		if len(queues) < c.Parallelism {
+			return fmt.Errorf("--queues lists %d queues, parallelism is %d", len(queues), c.Parallelism)
+		}
+	}
+	if c.Count < 0 {
+		return fmt.Errorf("count must not be negative")
+	}
+	if c.Duration < 0 {
+		return fmt.Errorf("duration must not be negative")
 	}
 
-	// parallelism and count check
-	// count は全体の投げるパケットの数
-	// parallelism は並列数
-	// なので、 count >= parallelism である必要があります
-	if c.Count < c.Parallelism {
-		return fmt.Errorf("count must be greater than or equal to parallelism")
+	if _, err := ParseRate(c.Rate); err != nil {
+		return err
+	}
+	if _, err := ParseIMIX(c.IMIX); err != nil {
+		return err
+	}
+	if _, ok := txOrders[c.TxOrder]; !ok {
+		return fmt.Errorf("unknown tx order: %s", c.TxOrder)
+	}
+	if !distributions[c.Distribution] {
+		return fmt.Errorf("unknown distribution: %s", c.Distribution)
+	}
+	if !engines[c.Engine] {
+		return fmt.Errorf("unknown engine: %s", c.Engine)
+	}
+	if c.TxSection != "" && c.TxProg == "" {
+		return fmt.Errorf("--tx-section needs --tx-prog")
+	}
+	if c.TxProg != "" && (c.Engine == engineAFXDP || c.Engine == engineAFPacket) {
+		return fmt.Errorf("--tx-prog needs --engine xdp, the %s engine does not run a TX program", c.Engine)
+	}
+	if _, ok := xdpModes[c.XDPMode]; !ok {
+		return fmt.Errorf("unknown xdp mode: %s", c.XDPMode)
+	}
+	if c.StampOffset < 0 || c.StampOffset%2 != 0 {
+		return fmt.Errorf("stamp offset must be a non-negative even number")
+	}
+	if c.StreamGroup < 0 || c.StreamGroup > 0xffff {
+		return fmt.Errorf("stream group must be between 0 and 65535")
+	}
+	if c.LatencyClock != "" && c.LatencyClock != "mono" && c.LatencyClock != "realtime" {
+		return fmt.Errorf("unknown latency clock: %s", c.LatencyClock)
+	}
+	if c.RTT && c.ServerFlag {
+		return fmt.Errorf("round-trip latency is measured on the client")
+	}
+	if (c.Engine == engineAFXDP || c.Engine == engineAFPacket) && (c.Seq || c.Latency) {
+		return fmt.Errorf("the %s engine does not stamp packets, --seq and --latency need --engine xdp", c.Engine)
+	}
+	if c.Peer != "" && c.ServerFlag {
+		return fmt.Errorf("peer is a client option")
+	}
+	if c.Reverse || c.Bidir {
+		if c.ServerFlag {
+			return fmt.Errorf("reverse and bidir are client options")
+		}
+		if c.Reverse && c.Bidir {
+			return fmt.Errorf("reverse and bidir are mutually exclusive")
+		}
+		if c.Peer == "" {
+			return fmt.Errorf("reverse and bidir need a peer")
+		}
+		if c.RTT {
+			return fmt.Errorf("round-trip latency cannot be combined with reverse or bidir")
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls certificate and key must be given together")
+	}
+	if c.NoToken && (!c.ServerFlag || c.Token != "") {
+		return fmt.Errorf("no-token is a server option and excludes a token")
+	}
+	if c.ServerFlag && c.ControlPort > 0 && c.Token == "" && !c.NoToken {
+		return fmt.Errorf("the control channel needs a token, give --no-token to accept any client or --control-port 0 to disable it")
+	}
+	if c.ServerFlag {
+		if _, ok := rxActions[c.RxAction]; !ok {
+			return fmt.Errorf("unknown rx action: %s", c.RxAction)
+		}
+		if c.RxAction == "redirect" && c.RedirectDevice == "" {
+			return fmt.Errorf("redirect device is required for redirect action")
+		}
 	}
 
 	return nil
@@ -0,0 +1,111 @@
+package xdperf
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+)
+
+// template distribution strategies over the TX cpus
+const (
+	distReplicate = "replicate" // every cpu sends every template
+	distPartition = "partition" // template i is sent by cpu i % n only
+	distFlowHash  = "flow-hash" // a template is sent by the cpu its flow hashes to
+	distCPUHint   = "cpu-hint"  // the plugin's metadata cpu, templates without one go to every cpu
+)
+
+var distributions = map[string]bool{
+	"":            true,
+	distReplicate: true,
+	distPartition: true,
+	distFlowHash:  true,
+	distCPUHint:   true,
+}
+
+// distribution returns the strategy of the run: --distribution, else the
+// one of the plugin response, else replicate.
+func distribution(flag string, resp []*GeneratorResponse) string {
+	if flag != "" {
+		return flag
+	}
+	for _, r := range resp {
+		if r.Metadata.Distribution != "" {
+			return r.Metadata.Distribution
+		}
+	}
+	return distReplicate
+}
+
+// distributeTemplates splits the templates over the workers pinned to cpus,
+// set w is loaded for worker w. Every worker must get at least one template.
+func distributeTemplates(entries []*TxOverrideEntry, cpus []int, strategy string) ([][]*TxOverrideEntry, error) {
+	if strategy == "" || strategy == distReplicate {
+		return [][]*TxOverrideEntry{entries}, nil
+	}
+	n := len(cpus)
+	sets := make([][]*TxOverrideEntry, n)
+	switch strategy {
+	case distPartition:
+		if len(entries) < n {
+			return nil, fmt.Errorf("partition needs at least %d templates, got %d", n, len(entries))
+		}
+		for i, e := range entries {
+			sets[i%n] = append(sets[i%n], e)
+		}
+	case distFlowHash:
+		for i, e := range entries {
+			h, err := flowHash(e.Data[:e.Length])
+			if err != nil {
+				return nil, fmt.Errorf("template %d: %w", i, err)
+			}
+			w := h % uint32(n)
+			sets[w] = append(sets[w], e)
+		}
+	case distCPUHint:
+		var shared []*TxOverrideEntry
+		for i, e := range entries {
+			if e.CPU == nil {
+				shared = append(shared, e)
+				continue
+			}
+			w := slices.Index(cpus, int(*e.CPU))
+			if w < 0 {
+				return nil, fmt.Errorf("template %d: no tx worker runs on cpu %d, workers are on %v", i, *e.CPU, cpus)
+			}
+			sets[w] = append(sets[w], e)
+		}
+		for w := range sets {
+			sets[w] = append(sets[w], shared...)
+		}
+	default:
+		return nil, fmt.Errorf("unknown distribution: %s", strategy)
+	}
+	for w, set := range sets {
+		if len(set) == 0 {
+			return nil, fmt.Errorf("%s leaves cpu %d without templates, lower --parallelism", strategy, cpus[w])
+		}
+	}
+	return sets, nil
+}
+
+// flowHash hashes the addresses, protocol and ports of a template.
+func flowHash(data []byte) (uint32, error) {
+	lay, err := parseTemplateLayout(data)
+	if err != nil {
+		return 0, err
+	}
+	if lay.L3Offset == 0 {
+		return 0, fmt.Errorf("template has no IP header")
+	}
+	h := fnv.New32a()
+	if lay.IPv4 {
+		h.Write(data[lay.L3Offset+12 : lay.L3Offset+20])
+	} else {
+		h.Write(data[lay.L3Offset+8 : lay.L3Offset+40])
+	}
+	if lay.L4Offset != 0 {
+		h.Write([]byte{byte(lay.L4Proto)})
+		h.Write(data[lay.L4Offset : lay.L4Offset+4])
+	}
+	return h.Sum32(), nil
+}
@@ -0,0 +1,111 @@
+package xdperf
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDistributeTemplates(t *testing.T) {
+	// flow returns a template of the UDP flow from source port sport
+	flow := func(sport uint16) *TxOverrideEntry {
+		data := testFrame(t, false, false, []byte("payload"))
+		lay, err := parseTemplateLayout(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint16(data[lay.L4Offset:], sport)
+		return &TxOverrideEntry{Data: data, Length: uint16(len(data))}
+	}
+	hinted := func(sport uint16, cpu uint32) *TxOverrideEntry {
+		e := flow(sport)
+		e.CPU = &cpu
+		return e
+	}
+	a, b, c, d := flow(1), flow(2), flow(3), flow(4)
+	ha, hb := hinted(5, 8), hinted(6, 9)
+
+	tests := []struct {
+		name     string
+		entries  []*TxOverrideEntry
+		cpus     []int
+		strategy string
+		want     [][]*TxOverrideEntry
+		wantErr  bool
+	}{
+		{name: "default", entries: []*TxOverrideEntry{a, b}, cpus: []int{0, 1, 2, 3}, want: [][]*TxOverrideEntry{{a, b}}},
+		{name: "replicate", entries: []*TxOverrideEntry{a, b}, cpus: []int{0, 1, 2, 3}, strategy: distReplicate, want: [][]*TxOverrideEntry{{a, b}}},
+		{name: "partition", entries: []*TxOverrideEntry{a, b, c, d}, cpus: []int{0, 1, 2}, strategy: distPartition, want: [][]*TxOverrideEntry{{a, d}, {b}, {c}}},
+		{name: "partition too few", entries: []*TxOverrideEntry{a}, cpus: []int{0, 1}, strategy: distPartition, wantErr: true},
+		{name: "cpu hint", entries: []*TxOverrideEntry{ha, a, hb}, cpus: []int{8, 9}, strategy: distCPUHint, want: [][]*TxOverrideEntry{{ha, a}, {hb, a}}},
+		{name: "cpu hint maps to the worker on the cpu", entries: []*TxOverrideEntry{hb, ha}, cpus: []int{9, 8}, strategy: distCPUHint, want: [][]*TxOverrideEntry{{hb}, {ha}}},
+		{name: "cpu hint without a worker", entries: []*TxOverrideEntry{ha, hinted(7, 1)}, cpus: []int{8, 9}, strategy: distCPUHint, wantErr: true},
+		{name: "cpu hint as a worker index", entries: []*TxOverrideEntry{hinted(7, 0)}, cpus: []int{8}, strategy: distCPUHint, wantErr: true},
+		{name: "cpu hint leaves a cpu empty", entries: []*TxOverrideEntry{ha}, cpus: []int{8, 9}, strategy: distCPUHint, wantErr: true},
+		{name: "flow hash leaves a cpu empty", entries: []*TxOverrideEntry{a}, cpus: []int{0, 1}, strategy: distFlowHash, wantErr: true},
+		{name: "unknown", entries: []*TxOverrideEntry{a}, cpus: []int{0}, strategy: "round-robin", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := distributeTemplates(tt.entries, tt.cpus, tt.strategy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("distributeTemplates error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d sets, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if len(got[i]) != len(tt.want[i]) {
+					t.Fatalf("set %d has %d templates, want %d", i, len(got[i]), len(tt.want[i]))
+				}
+				for j := range got[i] {
+					if got[i][j] != tt.want[i][j] {
+						t.Errorf("set %d template %d differs", i, j)
+					}
+				}
+			}
+		})
+	}
+}
+
+// flow-hash keeps every template on exactly one cpu, the same for a flow.
+func TestDistributeTemplatesFlowHash(t *testing.T) {
+	var entries []*TxOverrideEntry
+	for sport := range uint16(64) {
+		data := testFrame(t, sport%2 == 0, false, []byte("payload"))
+		lay, err := parseTemplateLayout(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint16(data[lay.L4Offset:], 1000+sport)
+		entries = append(entries, &TxOverrideEntry{Data: data, Length: uint16(len(data))})
+	}
+	const n = 4
+	sets, err := distributeTemplates(entries, []int{0, 1, 2, 3}, distFlowHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpuOf := make(map[*TxOverrideEntry]int)
+	for cpu, set := range sets {
+		for _, e := range set {
+			if _, ok := cpuOf[e]; ok {
+				t.Fatalf("template on more than one cpu")
+			}
+			cpuOf[e] = cpu
+		}
+	}
+	if len(cpuOf) != len(entries) {
+		t.Fatalf("%d of %d templates distributed", len(cpuOf), len(entries))
+	}
+	for _, e := range entries {
+		h, err := flowHash(e.Data[:e.Length])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cpuOf[e] != int(h%n) {
+			t.Errorf("template on cpu %d, its flow hashes to %d", cpuOf[e], h%n)
+		}
+	}
+}
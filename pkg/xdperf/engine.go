@@ -0,0 +1,513 @@
+package xdperf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// batchInterval is how long an unpaced batch should take, cancellation
+	// and the deadline are checked between batches. The batch size follows
+	// the rate measured on the previous batch, within minBatch and maxBatch.
+	batchInterval = 10 * time.Millisecond
+	minBatch      = 1 << 10
+	maxBatch      = 1 << 18
+	// pacingInterval is the time slice a paced worker sends per batch.
+	pacingInterval = time.Millisecond
+	// statsFlushInterval is how often the counters of the socket engines
+	// are copied into stats_map
+	statsFlushInterval = 100 * time.Millisecond
+	// drainTimeout bounds the wait for queued packets when a socket engine
+	// closes
+	drainTimeout = 100 * time.Millisecond
+)
+
+// txSpec describes how much a transmission sends.
+type txSpec struct {
+	RatePPS  float64       // total offered load, 0 = as fast as possible
+	Duration time.Duration // 0 = until Count is reached
+	Count    uint64        // total packets, 0 = unlimited
+}
+
+// splitCount divides total over n workers, the first total%n workers send
+// one packet more.
+func splitCount(total uint64, n int, i int) uint64 {
+	q, r := total/uint64(n), total%uint64(n)
+	if uint64(i) < r {
+		return q + 1
+	}
+	return q
+}
+
+// transmit runs the TX program on every worker CPU until the spec is
+// fulfilled or ctx is done.
+func (x *Xdperf) transmit(ctx context.Context, spec txSpec) error {
+	if err := x.placeWorkers(); err != nil {
+		return err
+	}
+	n := x.cfg.Parallelism
+	workers := make([]*txWorker, 0, n)
+	for i := range n {
+		w := &txWorker{
+			idx:   i,
+			cpu:   x.txCPUs[i],
+			rate:  spec.RatePPS / float64(n),
+			count: splitCount(spec.Count, n, i),
+		}
+		if spec.Count > 0 && w.count == 0 {
+			continue
+		}
+		workers = append(workers, w)
+	}
+	return x.runWorkers(ctx, workers, spec.Duration)
+}
+
+// runWorkers runs the given workers in parallel, for at most d when d > 0,
+// and returns the errors of all failed workers.
+func (x *Xdperf) runWorkers(ctx context.Context, workers []*txWorker, d time.Duration) error {
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	x.checkFrameMTU()
+	open := x.liveFrameEngines
+	switch x.cfg.Engine {
+	case engineAFXDP:
+		open = x.afxdpEngines
+	case engineAFPacket:
+		open = x.afpacketEngines
+	}
+	if err := open(workers); err != nil {
+		return err
+	}
+
+	// the first failure stops the other workers, every failure is returned
+	g, gctx := errgroup.WithContext(ctx)
+	errs := make([]error, len(workers))
+	for i, w := range workers {
+		g.Go(func() error {
+			defer w.tx.Close()
+			if err := w.run(gctx); err != nil {
+				errs[i] = fmt.Errorf("worker on cpu %d: %w", w.cpu, err)
+			}
+			return errs[i]
+		})
+	}
+	_ = g.Wait()
+	return errors.Join(errs...)
+}
+
+// keep in sync with the --engine flag
+const (
+	engineLiveFrames = "xdp"
+	engineAFXDP      = "afxdp"
+	engineAFPacket   = "afpacket"
+)
+
+var engines = map[string]bool{
+	"":               true,
+	engineLiveFrames: true,
+	engineAFXDP:      true,
+	engineAFPacket:   true,
+}
+
+// txEngine sends the packets of one worker.
+type txEngine interface {
+	// send transmits up to n packets and returns how many were sent.
+	send(n uint64) (uint64, error)
+	Close() error
+}
+
+// xdpMd is struct xdp_md, the context of bpf_prog_run for XDP programs.
+type xdpMd struct {
+	Data           uint32
+	DataEnd        uint32
+	DataMeta       uint32
+	IngressIfindex uint32
+	RxQueueIndex   uint32
+	EgressIfindex  uint32
+}
+
+// liveFrameEngines runs the TX program of every worker with
+// BPF_F_TEST_XDP_LIVE_FRAMES, each on its own clone of the program. The
+// frames are received on the worker's queue of the device, so XDP_TX sends
+// them out of the device; without a context they would leave through the
+// loopback device. The driver picks the TX ring from the cpu running
+// bpf_prog_run, so the ring follows --cpus.
+func (x *Xdperf) liveFrameEngines(workers []*txWorker) error {
+	if l := x.maxTxLen(); l > maxTemplateSize {
+		limit, err := x.liveFrameLimit()
+		if err != nil {
+			return err
+		}
+		if l > limit {
+			return fmt.Errorf("template of %d bytes exceeds the %d bytes the kernel allows in a live frame, "+
+				"use --engine afxdp or --engine afpacket for jumbo frames", l, limit)
+		}
+	}
+	prog := x.choiceTXBPFProgram()
+	ins := make([][]byte, len(workers))
+	ctxs := make([]*xdpMd, len(workers))
+	for i, w := range workers {
+		in, err := x.txFrame(prog, w.idx)
+		if err != nil {
+			return fmt.Errorf("failed to build sample packet: %w", err)
+		}
+		ins[i] = in
+		ctxs[i] = &xdpMd{
+			DataEnd:        uint32(len(in)),
+			IngressIfindex: uint32(x.Device.Index),
+			RxQueueIndex:   uint32(x.txQueues[w.idx]),
+		}
+		if err := checkRxBinding(ctxs[i], len(in)); err != nil {
+			return fmt.Errorf("worker %d: %w", w.idx, err)
+		}
+		x.Logger.Debug("tx worker bound", zap.Int("worker", w.idx), zap.Int("cpu", w.cpu),
+			zap.String("device", x.Device.Name), zap.Uint32("queue", ctxs[i].RxQueueIndex))
+	}
+
+	for i, w := range workers {
+		p, err := prog.Clone()
+		if err != nil {
+			for _, prev := range workers[:i] {
+				prev.tx.Close()
+			}
+			return fmt.Errorf("failed to clone XDP program: %w", err)
+		}
+		w.tx = &liveFrameEngine{prog: p, data: ins[i], ctx: ctxs[i]}
+	}
+	return nil
+}
+
+// checkRxBinding runs a program returning XDP_PASS once with ctx. The kernel
+// fails BPF_PROG_RUN with ENODEV for an unknown ifindex and with EINVAL for
+// a queue beyond the device's rx queues, so a run that succeeds is bound to
+// the requested device and queue.
+func checkRxBinding(ctx *xdpMd, size int) error {
+	probe, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.XDP,
+		License:      "GPL",
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 2), asm.Return()}, // XDP_PASS
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load the binding probe: %w", err)
+	}
+	defer probe.Close()
+	if _, err := probe.Run(&ebpf.RunOptions{
+		Data:    make([]byte, size),
+		Context: ctx,
+	}); err != nil {
+		return fmt.Errorf("kernel rejected ifindex %d queue %d: %w", ctx.IngressIfindex, ctx.RxQueueIndex, err)
+	}
+	return nil
+}
+
+// liveFrameLimit returns the largest frame bpf_prog_run accepts in live
+// frames mode. Kernels up to at least 6.18 keep live frames in one page and
+// reject multi-buffer input, so jumbo templates need a socket engine there.
+func (x *Xdperf) liveFrameLimit() (int, error) {
+	if x.liveFrameMax > 0 {
+		return x.liveFrameMax, nil
+	}
+	probe, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.XDP,
+		License:      "GPL",
+		Flags:        unix.BPF_F_XDP_HAS_FRAGS,
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 1), asm.Return()}, // XDP_DROP
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to load the live frame probe: %w", err)
+	}
+	defer probe.Close()
+	ok := func(size int) bool {
+		_, err := probe.Run(&ebpf.RunOptions{
+			Data:    make([]byte, size),
+			Context: &xdpMd{DataEnd: uint32(size), IngressIfindex: uint32(x.Device.Index)},
+			Flags:   unix.BPF_F_TEST_XDP_LIVE_FRAMES,
+		})
+		return err == nil
+	}
+	lo, hi := 0, maxFrameSize+1 // ok(lo), !ok(hi)
+	if ok(maxFrameSize) {
+		lo = maxFrameSize
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if ok(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return 0, fmt.Errorf("live frames are not supported on %s", x.Device.Name)
+	}
+	x.liveFrameMax = lo
+	x.Logger.Debug("live frame limit", zap.Int("bytes", lo))
+	return lo, nil
+}
+
+// checkFrameMTU warns about templates the device MTU does not admit, most
+// drivers and the kernel drop them.
+func (x *Xdperf) checkFrameMTU() {
+	// Ethernet header and one VLAN tag
+	limit := x.Device.MTU + 18
+	if l := x.maxTxLen(); l > limit {
+		x.Logger.Warn("templates exceed the device mtu and may be dropped",
+			zap.Int("frame", l), zap.Int("mtu", x.Device.MTU),
+			zap.String("fix", fmt.Sprintf("ip link set dev %s mtu %d", x.Device.Name, l-14)))
+	}
+}
+
+type liveFrameEngine struct {
+	prog *ebpf.Program
+	data []byte
+	ctx  *xdpMd
+}
+
+func (e *liveFrameEngine) send(n uint64) (uint64, error) {
+	n = min(n, maxBatch)
+	ret, err := e.prog.Run(&ebpf.RunOptions{
+		Data:    e.data,
+		Context: e.ctx,
+		Repeat:  uint32(n),
+		Flags:   unix.BPF_F_TEST_XDP_LIVE_FRAMES,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("bpf_prog_run failed: %w", err)
+	}
+	if ret != 0 {
+		return 0, fmt.Errorf("bpf_prog_run returned non-zero: %d", ret)
+	}
+	return n, nil
+}
+
+func (e *liveFrameEngine) Close() error {
+	return e.prog.Close()
+}
+
+type txWorker struct {
+	idx   int // worker index, selects the template set and x.txQueues[idx]
+	cpu   int
+	tx    txEngine
+	rate  float64 // packets per second, 0 = unpaced
+	count uint64  // 0 = unlimited
+	sent  uint64
+}
+
+func (w *txWorker) run(ctx context.Context) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var cpuset unix.CPUSet
+	cpuset.Set(w.cpu)
+	if err := unix.SchedSetaffinity(unix.Gettid(), &cpuset); err != nil {
+		return fmt.Errorf("failed to set CPU affinity: %v", err)
+	}
+
+	batch := uint64(minBatch)
+	if w.rate > 0 {
+		batch = max(1, uint64(w.rate*pacingInterval.Seconds()))
+	}
+
+	// reused for pacing, time.After would allocate a timer per batch
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	start := time.Now()
+	for ctx.Err() == nil {
+		n := batch
+		if w.count > 0 {
+			if w.sent >= w.count {
+				return nil
+			}
+			n = min(n, w.count-w.sent)
+		}
+		if w.rate > 0 {
+			// sleep until the packets already sent are due
+			due := start.Add(time.Duration(float64(w.sent) / w.rate * float64(time.Second)))
+			if d := time.Until(due); d > 0 {
+				timer.Reset(d)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+
+		began := time.Now()
+		sent, err := w.tx.send(n)
+		if err != nil {
+			return err
+		}
+		w.sent += sent
+		if w.rate == 0 {
+			batch = nextBatch(sent, time.Since(began))
+		}
+	}
+	return nil
+}
+
+// nextBatch sizes an unpaced batch to last batchInterval at the rate of the
+// previous one, which sent packets in took.
+func nextBatch(sent uint64, took time.Duration) uint64 {
+	if took <= 0 {
+		return maxBatch
+	}
+	n := float64(sent) * batchInterval.Seconds() / took.Seconds()
+	return uint64(min(maxBatch, max(minBatch, n)))
+}
+
+// checkStaticTemplates fails when the run needs the TX program to rewrite
+// packets, which the socket engines cannot do, and returns the tx order.
+func (x *Xdperf) checkStaticTemplates(engine string) (uint32, error) {
+	if x.cfg.Seq || x.cfg.Latency {
+		return 0, fmt.Errorf("the %s engine sends the templates as they are, stamps need --engine xdp", engine)
+	}
+	if len(x.txSets) == 0 {
+		return 0, fmt.Errorf("no templates loaded")
+	}
+	for _, set := range x.txSets {
+		for _, e := range set {
+			if len(e.Mods) > 0 {
+				return 0, fmt.Errorf("field modifiers need --engine xdp, not %s", engine)
+			}
+		}
+	}
+	order, ok := txOrders[x.cfg.TxOrder]
+	if !ok {
+		return 0, fmt.Errorf("unknown tx order: %s", x.cfg.TxOrder)
+	}
+	return order, nil
+}
+
+// templatePicker walks the templates of a worker like the TX program does.
+type templatePicker struct {
+	next   uint32
+	count  uint32
+	random bool
+}
+
+// newTemplatePicker starts worker w at the same template as initSeqStateMap.
+func (x *Xdperf) newTemplatePicker(w int, count int, order uint32) templatePicker {
+	return templatePicker{
+		next:   uint32(w/len(x.txSets)) % uint32(count),
+		count:  uint32(count),
+		random: order == txOrderRandom,
+	}
+}
+
+// pick returns the index of the next template.
+func (p *templatePicker) pick() uint32 {
+	if p.random {
+		return rand.Uint32N(p.count)
+	}
+	t := p.next
+	if p.next++; p.next == p.count {
+		p.next = 0
+	}
+	return t
+}
+
+// txCounters counts what a socket engine sent on the cpu of its worker.
+type txCounters struct {
+	cpu     int
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+	stats   *txStats
+}
+
+func (c *txCounters) add(packets, bytes uint64) {
+	c.packets.Add(packets)
+	c.bytes.Add(bytes)
+}
+
+// close is called when the engine closes, the last one stops the stats.
+func (c *txCounters) close() {
+	if c.stats != nil {
+		c.stats.release()
+	}
+}
+
+// txStats copies the counters of the socket engines into the per-cpu
+// stats_map on top of what it held before, so the stats read the same for
+// every engine.
+type txStats struct {
+	m        *ebpf.Map
+	base     []coreelf.BpfDatarec
+	counters []*txCounters
+	open     atomic.Int32
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startTxStats flushes the counters into stats_map until every engine
+// holding them is closed.
+func (x *Xdperf) startTxStats(counters []*txCounters) error {
+	base := make([]coreelf.BpfDatarec, ebpf.MustPossibleCPU())
+	var key uint32
+	if err := x.bpfobjs.StatsMap.Lookup(&key, &base); err != nil {
+		return fmt.Errorf("failed to read tx stats: %w", err)
+	}
+	st := &txStats{
+		m:        x.bpfobjs.StatsMap,
+		base:     base,
+		counters: counters,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	st.open.Store(int32(len(counters)))
+	for _, c := range counters {
+		c.stats = st
+	}
+	go st.run()
+	return nil
+}
+
+func (st *txStats) run() {
+	defer close(st.done)
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			st.flush()
+		case <-st.stop:
+			st.flush()
+			return
+		}
+	}
+}
+
+func (st *txStats) flush() {
+	recs := append([]coreelf.BpfDatarec(nil), st.base...)
+	for _, c := range st.counters {
+		recs[c.cpu].RxPackets += c.packets.Load()
+		recs[c.cpu].RxBytes += c.bytes.Load()
+	}
+	var key uint32
+	// best effort, the next flush retries
+	_ = st.m.Put(&key, recs)
+}
+
+func (st *txStats) release() {
+	if st.open.Add(-1) == 0 {
+		close(st.stop)
+		<-st.done
+	}
+}
@@ -0,0 +1,59 @@
+package xdperf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitCount(t *testing.T) {
+	tests := []struct {
+		total uint64
+		n     int
+		want  []uint64
+	}{
+		{0, 2, []uint64{0, 0}},
+		{10, 1, []uint64{10}},
+		{10, 2, []uint64{5, 5}},
+		{10, 3, []uint64{4, 3, 3}},
+		{11, 4, []uint64{3, 3, 3, 2}},
+		{2, 4, []uint64{1, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		got := make([]uint64, tt.n)
+		var sum uint64
+		for i := range tt.n {
+			got[i] = splitCount(tt.total, tt.n, i)
+			sum += got[i]
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCount(%d, %d) = %v, want %v", tt.total, tt.n, got, tt.want)
+		}
+		if sum != tt.total {
+			t.Errorf("splitCount(%d, %d) sums to %d", tt.total, tt.n, sum)
+		}
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		sent uint64
+		took time.Duration
+		want uint64
+	}{
+		{"1 mpps", 1000, time.Millisecond, 10000},
+		{"same rate from a larger batch", 100000, 100 * time.Millisecond, 10000},
+		{"slow frames", 1024, 50 * time.Millisecond, minBatch},
+		{"nothing sent", 0, time.Millisecond, minBatch},
+		{"fast", 1 << 18, time.Millisecond, maxBatch},
+		{"no time measured", 1024, 0, maxBatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextBatch(tt.sent, tt.took); got != tt.want {
+				t.Errorf("nextBatch(%d, %v) = %d, want %d", tt.sent, tt.took, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package xdperf
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// GroupInterval is what the streams of a group received during one second.
+type GroupInterval struct {
+	Received uint64 `json:"received"`
+	Lost     uint64 `json:"lost"`
+}
+
+// GroupStats sums the streams of one stream group.
+type GroupStats struct {
+	Group     uint16          `json:"group"`
+	Received  uint64          `json:"received"`
+	Lost      uint64          `json:"lost"`
+	Duplicate uint64          `json:"duplicate"`
+	Reordered uint64          `json:"reordered"`
+	Latency   *LatencySummary `json:"latency,omitempty"`
+	Intervals []GroupInterval `json:"intervals,omitempty"`
+}
+
+// groupSampler records the per-second counters of every stream group.
+type groupSampler struct {
+	mu        sync.Mutex
+	n         int
+	prev      map[uint16]GroupInterval
+	intervals map[uint16][]GroupInterval
+}
+
+func newGroupSampler() *groupSampler {
+	return &groupSampler{
+		prev:      make(map[uint16]GroupInterval),
+		intervals: make(map[uint16][]GroupInterval),
+	}
+}
+
+func sumGroups(streams []StreamStats) map[uint16]GroupInterval {
+	sums := make(map[uint16]GroupInterval)
+	for _, st := range streams {
+		group, _ := StreamID(st.StreamID)
+		s := sums[group]
+		s.Received += st.Received
+		s.Lost += st.Lost
+		sums[group] = s
+	}
+	return sums
+}
+
+func (s *groupSampler) sample(streams []StreamStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for group, cur := range sumGroups(streams) {
+		prev := s.prev[group]
+		// a group seen late has been silent before
+		iv := s.intervals[group]
+		for len(iv) < s.n {
+			iv = append(iv, GroupInterval{})
+		}
+		s.intervals[group] = append(iv, GroupInterval{
+			Received: cur.Received - prev.Received,
+			Lost:     cur.Lost - prev.Lost,
+		})
+		s.prev[group] = cur
+	}
+	s.n++
+	for group, iv := range s.intervals {
+		for len(iv) < s.n {
+			iv = append(iv, GroupInterval{})
+		}
+		s.intervals[group] = iv
+	}
+}
+
+// run samples rx_seq_map every second until ctx is done.
+func (s *groupSampler) run(ctx context.Context, x *Xdperf) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			streams, err := x.readSeqStats(nil)
+			if err != nil {
+				x.Logger.Warn(err.Error())
+				continue
+			}
+			s.sample(streams)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readGroupStats sums the streams per group and adds the latency of the
+// group's class and, with a sampler, the per-second counters.
+func (x *Xdperf) readGroupStats(streams []StreamStats, s *groupSampler) ([]GroupStats, error) {
+	byGroup := make(map[uint16]*GroupStats)
+	for _, st := range streams {
+		group, _ := StreamID(st.StreamID)
+		g, ok := byGroup[group]
+		if !ok {
+			g = &GroupStats{Group: group}
+			byGroup[group] = g
+		}
+		g.Received += st.Received
+		g.Lost += st.Lost
+		g.Duplicate += st.Duplicate
+		g.Reordered += st.Reordered
+	}
+
+	result := make([]GroupStats, 0, len(byGroup))
+	for group, g := range byGroup {
+		if x.cfg.Latency {
+			snap, err := x.readLatencyClass(int(group) % LatencyClasses)
+			if err != nil {
+				return nil, err
+			}
+			if snap.Count > 0 {
+				sum := snap.Summary()
+				g.Latency = &sum
+			}
+		}
+		if s != nil {
+			s.mu.Lock()
+			g.Intervals = append([]GroupInterval(nil), s.intervals[group]...)
+			s.mu.Unlock()
+		}
+		result = append(result, *g)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Group < result[j].Group })
+	return result, nil
+}
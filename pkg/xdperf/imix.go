@@ -0,0 +1,190 @@
+package xdperf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/takehaya/xdperf/pkg/plugin"
+	"go.uber.org/zap"
+)
+
+// imixFCSLen is included in IMIX sizes but not in templates.
+const imixFCSLen = 4
+
+// imixMaxSlots bounds the schedule, every slot is one entry of the per-cpu
+// template lists.
+const imixMaxSlots = 2048
+
+// imixProfiles are the built-in IMIX definitions, sizes include the FCS.
+var imixProfiles = map[string][]plugin.IMIXPattern{
+	// simple IMIX, the classic Internet mix
+	"simple": {
+		{Size: 64, Weight: 7},
+		{Size: 594, Weight: 4},
+		{Size: 1518, Weight: 1},
+	},
+	// Tolly IMIX
+	"tolly": {
+		{Size: 64, Weight: 55},
+		{Size: 78, Weight: 5},
+		{Size: 576, Weight: 17},
+		{Size: 1518, Weight: 23},
+	},
+}
+
+// ParseIMIX parses a profile name or a list of size:weight[:template_id]
+// such as "64:7,594:4,1518:1". An empty spec is no IMIX.
+func ParseIMIX(spec string) ([]plugin.IMIXPattern, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if p, ok := imixProfiles[spec]; ok {
+		return p, nil
+	}
+	var patterns []plugin.IMIXPattern
+	for _, f := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(f), ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid imix entry %q, want size:weight[:template_id]", f)
+		}
+		size, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid imix size %q", parts[0])
+		}
+		weight, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid imix weight %q", parts[1])
+		}
+		p := plugin.IMIXPattern{Size: uint16(size), Weight: uint32(weight)}
+		if len(parts) == 3 {
+			p.TemplateID = parts[2]
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, validateIMIX(patterns)
+}
+
+func validateIMIX(patterns []plugin.IMIXPattern) error {
+	if len(patterns) == 0 {
+		return fmt.Errorf("imix has no patterns")
+	}
+	for _, p := range patterns {
+		if p.Size < 64 || int(p.Size)-imixFCSLen > maxFrameSize {
+			return fmt.Errorf("imix size %d must be between 64 and %d", p.Size, maxFrameSize+imixFCSLen)
+		}
+		if p.Weight == 0 {
+			return fmt.Errorf("imix weight of size %d must be positive", p.Size)
+		}
+	}
+	return nil
+}
+
+func gcd(a, b uint32) uint32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// imixWeights reduces the weights by their gcd and scales them down when
+// their sum exceeds the template slots. The second result reports whether
+// the mix had to be approximated.
+func imixWeights(patterns []plugin.IMIXPattern) ([]uint32, bool) {
+	var g, total uint32
+	for _, p := range patterns {
+		g = gcd(g, p.Weight)
+	}
+	weights := make([]uint32, len(patterns))
+	for i, p := range patterns {
+		weights[i] = p.Weight / g
+		total += weights[i]
+	}
+	if total <= imixMaxSlots {
+		return weights, false
+	}
+	scale := float64(imixMaxSlots-len(patterns)) / float64(total)
+	for i := range weights {
+		weights[i] = max(1, uint32(float64(weights[i])*scale+0.5))
+	}
+	return weights, true
+}
+
+// imixSchedule returns the pattern of every slot, interleaved by smooth
+// weighted round robin so that the sizes are mixed rather than sent in
+// bursts.
+func imixSchedule(weights []uint32) []int {
+	var total int64
+	for _, w := range weights {
+		total += int64(w)
+	}
+	current := make([]int64, len(weights))
+	schedule := make([]int, 0, total)
+	for range total {
+		best := 0
+		for i, w := range weights {
+			current[i] += int64(w)
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// pluginIMIX returns the IMIX suggested by the plugin metadata, if any.
+func pluginIMIX(resp []*GeneratorResponse) []plugin.IMIXPattern {
+	for _, r := range resp {
+		if r.Metadata.IMIX != nil && len(r.Metadata.IMIX.Patterns) > 0 {
+			return r.Metadata.IMIX.Patterns
+		}
+	}
+	return nil
+}
+
+// applyIMIX turns the plugin templates into a weighted schedule. Each
+// pattern uses the template given by its template_id (the index in the
+// plugin response) or the first one, resized to the pattern size.
+func (x *Xdperf) applyIMIX(patterns []plugin.IMIXPattern, entries []*TxOverrideEntry) ([]*TxOverrideEntry, error) {
+	if err := validateIMIX(patterns); err != nil {
+		return nil, err
+	}
+	sized := make([]*TxOverrideEntry, len(patterns))
+	for i, p := range patterns {
+		base := entries[0]
+		if p.TemplateID != "" {
+			idx, err := strconv.Atoi(p.TemplateID)
+			if err != nil || idx < 0 || idx >= len(entries) {
+				return nil, fmt.Errorf("imix template_id %q is not a template index (0-%d)", p.TemplateID, len(entries)-1)
+			}
+			base = entries[idx]
+		}
+		data, err := resizeTemplate(base.Data[:base.Length], int(p.Size)-imixFCSLen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resize template to %d bytes: %w", p.Size, err)
+		}
+		e := &TxOverrideEntry{Data: data, Length: uint16(len(data))}
+		if err := copyModifiers(e, base); err != nil {
+			return nil, fmt.Errorf("imix size %d: %w", p.Size, err)
+		}
+		if x.cfg.Seq || x.cfg.Latency {
+			if err := x.setStampLayout(e); err != nil {
+				return nil, fmt.Errorf("imix size %d: %w", p.Size, err)
+			}
+		}
+		sized[i] = e
+	}
+
+	weights, approx := imixWeights(patterns)
+	if approx {
+		x.Logger.Warn("imix weights exceed the template slots and are approximated", zap.Any("weights", weights))
+	}
+	schedule := imixSchedule(weights)
+	out := make([]*TxOverrideEntry, len(schedule))
+	for i, p := range schedule {
+		out[i] = sized[p]
+	}
+	return out, nil
+}
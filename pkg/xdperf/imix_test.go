@@ -0,0 +1,112 @@
+package xdperf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/takehaya/xdperf/pkg/plugin"
+)
+
+func TestParseIMIX(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []plugin.IMIXPattern
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "simple", want: imixProfiles["simple"]},
+		{spec: "tolly", want: imixProfiles["tolly"]},
+		{
+			spec: "64:7,594:4,1518:1",
+			want: []plugin.IMIXPattern{{Size: 64, Weight: 7}, {Size: 594, Weight: 4}, {Size: 1518, Weight: 1}},
+		},
+		{
+			spec: "64:3:1, 1518:1:0",
+			want: []plugin.IMIXPattern{{Size: 64, Weight: 3, TemplateID: "1"}, {Size: 1518, Weight: 1, TemplateID: "0"}},
+		},
+		{spec: "64", wantErr: true},
+		{spec: "64:1:0:0", wantErr: true},
+		{spec: "abc:1", wantErr: true},
+		{spec: "64:x", wantErr: true},
+		{spec: "63:1", wantErr: true},
+		{spec: "9221:1", wantErr: true},
+		{spec: "64:0", wantErr: true},
+		{spec: "unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseIMIX(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIMIX(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseIMIX(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIMIXWeights(t *testing.T) {
+	patterns := func(weights ...uint32) []plugin.IMIXPattern {
+		ps := make([]plugin.IMIXPattern, len(weights))
+		for i, w := range weights {
+			ps[i] = plugin.IMIXPattern{Size: 64, Weight: w}
+		}
+		return ps
+	}
+
+	tests := []struct {
+		name       string
+		in         []plugin.IMIXPattern
+		want       []uint32
+		wantApprox bool
+	}{
+		{"simple", imixProfiles["simple"], []uint32{7, 4, 1}, false},
+		{"reduced by gcd", patterns(10, 20, 30), []uint32{1, 2, 3}, false},
+		{"fits after gcd", patterns(3000, 1000), []uint32{3, 1}, false},
+		{"exactly the slots", patterns(2047, 1), []uint32{2047, 1}, false},
+		{"scaled", patterns(3001, 1000), []uint32{1535, 511}, true},
+		{"scaled keeps every pattern", patterns(1, 100000), []uint32{1, 2046}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, approx := imixWeights(tt.in)
+			if !reflect.DeepEqual(got, tt.want) || approx != tt.wantApprox {
+				t.Errorf("imixWeights = %v, %v, want %v, %v", got, approx, tt.want, tt.wantApprox)
+			}
+			var total uint32
+			for _, w := range got {
+				total += w
+			}
+			if total > imixMaxSlots {
+				t.Errorf("weights sum to %d, more than %d slots", total, imixMaxSlots)
+			}
+		})
+	}
+}
+
+func TestIMIXSchedule(t *testing.T) {
+	tests := []struct {
+		weights []uint32
+		want    []int
+	}{
+		{[]uint32{1}, []int{0}},
+		{[]uint32{1, 1}, []int{0, 1}},
+		{[]uint32{2, 1}, []int{0, 1, 0}},
+		{[]uint32{5, 1, 1}, []int{0, 0, 1, 0, 2, 0, 0}},
+		{[]uint32{7, 4, 1}, []int{0, 1, 0, 0, 1, 0, 2, 0, 1, 0, 1, 0}},
+	}
+	for _, tt := range tests {
+		got := imixSchedule(tt.weights)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("imixSchedule(%v) = %v, want %v", tt.weights, got, tt.want)
+		}
+		counts := make([]uint32, len(tt.weights))
+		for _, p := range got {
+			counts[p]++
+		}
+		if !reflect.DeepEqual(counts, tt.weights) {
+			t.Errorf("imixSchedule(%v) has %v slots per pattern", tt.weights, counts)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package xdperf
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"golang.org/x/sys/unix"
+)
+
+// keep in sync with LAT_* in src/xdp_prog.h
+const (
+	latSubBits    = 4
+	latSubBuckets = 1 << latSubBits
+	latBuckets    = (64 - latSubBits + 1) * latSubBuckets
+
+	// LatencyClasses is the number of stream groups with a histogram of
+	// their own, higher groups share them modulo LatencyClasses.
+	LatencyClasses = 16
+
+	rxFlagLatency uint32 = 1 << 1
+)
+
+// LatencySnapshot is the cumulative latency histogram summed over all CPUs.
+type LatencySnapshot struct {
+	Count    uint64
+	Sum      uint64
+	Min      uint64
+	Max      uint64
+	Negative uint64
+	Buckets  []uint64
+}
+
+type LatencySummary struct {
+	Count uint64        `json:"count"`
+	Min   time.Duration `json:"min"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P99   time.Duration `json:"p99"`
+	P999  time.Duration `json:"p99_9"`
+	Max   time.Duration `json:"max"`
+}
+
+func (s LatencySummary) String() string {
+	if s.Count == 0 {
+		return "latency: no samples"
+	}
+	return fmt.Sprintf("latency: min %v, mean %v, p50 %v, p99 %v, p99.9 %v, max %v",
+		s.Min, s.Mean, s.P50, s.P99, s.P999, s.Max)
+}
+
+// latBucketBounds returns the inclusive value range of a histogram bucket.
+func latBucketBounds(idx int) (lo uint64, hi uint64) {
+	if idx < latSubBuckets {
+		return uint64(idx), uint64(idx)
+	}
+	group := idx / latSubBuckets
+	sub := uint64(idx % latSubBuckets)
+	shift := uint(group - 1)
+	lo = (latSubBuckets + sub) << shift
+	hi = lo + (uint64(1) << shift) - 1
+	return lo, hi
+}
+
+// clockOffset returns the value added to bpf_ktime_get_ns() (CLOCK_MONOTONIC)
+// so that stamps follow the requested clock.
+func clockOffset(clock string) (int64, error) {
+	switch clock {
+	case "", "mono":
+		return 0, nil
+	case "realtime":
+		var mono unix.Timespec
+		before := time.Now()
+		if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &mono); err != nil {
+			return 0, fmt.Errorf("failed to read monotonic clock: %w", err)
+		}
+		after := time.Now()
+		wall := before.UnixNano() + after.Sub(before).Nanoseconds()/2
+		return wall - mono.Nano(), nil
+	default:
+		return 0, fmt.Errorf("unknown latency clock: %s", clock)
+	}
+}
+
+func (x *Xdperf) readLatency() (*LatencySnapshot, error) {
+	return x.readLatencyClass(-1)
+}
+
+// readLatencyClass reads the histogram of one latency class, or of all
+// classes when class is negative.
+func (x *Xdperf) readLatencyClass(class int) (*LatencySnapshot, error) {
+	snap := &LatencySnapshot{Buckets: make([]uint64, latBuckets)}
+
+	stats := make([]coreelf.BpfLatStats, ebpf.MustPossibleCPU())
+	for c := uint32(0); c < LatencyClasses; c++ {
+		if class >= 0 && int(c) != class {
+			continue
+		}
+		if err := x.bpfobjs.LatStatsMap.Lookup(&c, &stats); err != nil {
+			return nil, fmt.Errorf("failed to lookup lat stats map: %w", err)
+		}
+		for _, st := range stats {
+			if st.Count == 0 {
+				snap.Negative += st.Negative
+				continue
+			}
+			if snap.Count == 0 || st.Min < snap.Min {
+				snap.Min = st.Min
+			}
+			if st.Max > snap.Max {
+				snap.Max = st.Max
+			}
+			snap.Count += st.Count
+			snap.Sum += st.Sum
+			snap.Negative += st.Negative
+		}
+	}
+
+	var key uint32
+	var percpu []uint64
+	iter := x.bpfobjs.LatHistMap.Iterate()
+	for iter.Next(&key, &percpu) {
+		if key >= LatencyClasses*latBuckets {
+			continue
+		}
+		if class >= 0 && int(key/latBuckets) != class {
+			continue
+		}
+		for _, v := range percpu {
+			snap.Buckets[key%latBuckets] += v
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate lat hist map: %w", err)
+	}
+	return snap, nil
+}
+
+// Sub returns the samples recorded since prev. Min and max of the interval
+// are bounded by the histogram buckets.
+func (s *LatencySnapshot) Sub(prev *LatencySnapshot) *LatencySnapshot {
+	d := &LatencySnapshot{
+		Count:    s.Count - prev.Count,
+		Sum:      s.Sum - prev.Sum,
+		Negative: s.Negative - prev.Negative,
+		Buckets:  make([]uint64, len(s.Buckets)),
+	}
+	first, last := -1, -1
+	for i := range s.Buckets {
+		d.Buckets[i] = s.Buckets[i] - prev.Buckets[i]
+		if d.Buckets[i] == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+	if first >= 0 {
+		d.Min, _ = latBucketBounds(first)
+		_, d.Max = latBucketBounds(last)
+		d.Min = max(d.Min, s.Min)
+		d.Max = min(d.Max, s.Max)
+	}
+	return d
+}
+
+// Percentile returns the upper bound of the bucket holding the q quantile
+// (0 < q <= 1), clamped to the observed min and max.
+func (s *LatencySnapshot) Percentile(q float64) uint64 {
+	var total uint64
+	for _, c := range s.Buckets {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, c := range s.Buckets {
+		seen += c
+		if seen >= rank {
+			_, hi := latBucketBounds(i)
+			return min(max(hi, s.Min), s.Max)
+		}
+	}
+	return s.Max
+}
+
+func (s *LatencySnapshot) Summary() LatencySummary {
+	if s.Count == 0 {
+		return LatencySummary{}
+	}
+	return LatencySummary{
+		Count: s.Count,
+		Min:   time.Duration(s.Min),
+		Mean:  time.Duration(s.Sum / s.Count),
+		P50:   time.Duration(s.Percentile(0.50)),
+		P99:   time.Duration(s.Percentile(0.99)),
+		P999:  time.Duration(s.Percentile(0.999)),
+		Max:   time.Duration(s.Max),
+	}
+}
+
+// latencyReporter returns a stats line generator printing the latency of
+// the last interval.
+func (x *Xdperf) latencyReporter() func() string {
+	prev := &LatencySnapshot{Buckets: make([]uint64, latBuckets)}
+	return func() string {
+		if x.rxFlags.Load()&rxFlagLatency == 0 {
+			return ""
+		}
+		cur, err := x.readLatency()
+		if err != nil {
+			return err.Error()
+		}
+		d := cur.Sub(prev)
+		prev = cur
+		line := d.Summary().String()
+		if d.Negative > 0 {
+			line += fmt.Sprintf(" (%d samples before stamp, check clock sync)", d.Negative)
+		}
+		return line
+	}
+}
+
+func (x *Xdperf) printLatency() error {
+	snap, err := x.readLatency()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("total %s\n", snap.Summary())
+	if snap.Negative > 0 {
+		fmt.Printf("  %d samples arrived before their stamp, check clock sync\n", snap.Negative)
+	}
+	return nil
+}
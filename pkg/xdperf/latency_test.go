@@ -0,0 +1,78 @@
+package xdperf
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLatBucketBounds(t *testing.T) {
+	tests := []struct {
+		idx    int
+		lo, hi uint64
+	}{
+		{0, 0, 0},
+		{15, 15, 15},
+		{16, 16, 16},
+		{31, 31, 31},
+		{32, 32, 33},
+		{47, 62, 63},
+		{48, 64, 67},
+		{latBuckets - 1, 31 << 59, math.MaxUint64},
+	}
+	for _, tt := range tests {
+		lo, hi := latBucketBounds(tt.idx)
+		if lo != tt.lo || hi != tt.hi {
+			t.Errorf("latBucketBounds(%d) = %d, %d, want %d, %d", tt.idx, lo, hi, tt.lo, tt.hi)
+		}
+	}
+}
+
+// The buckets cover every value exactly once.
+func TestLatBucketBoundsContiguous(t *testing.T) {
+	var next uint64
+	for i := range latBuckets {
+		lo, hi := latBucketBounds(i)
+		if lo != next || hi < lo {
+			t.Fatalf("bucket %d is [%d, %d], want it to start at %d", i, lo, hi, next)
+		}
+		next = hi + 1
+	}
+	if next != 0 {
+		t.Errorf("the last bucket ends at %d, want %d", next-1, uint64(math.MaxUint64))
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	snapshot := func(min, max uint64, counts map[int]uint64) *LatencySnapshot {
+		s := &LatencySnapshot{Min: min, Max: max, Buckets: make([]uint64, latBuckets)}
+		for i, c := range counts {
+			s.Buckets[i] = c
+			s.Count += c
+		}
+		return s
+	}
+	// nine samples of 5ns and one in [48, 49]
+	mixed := snapshot(5, 49, map[int]uint64{5: 9, 40: 1})
+
+	tests := []struct {
+		name string
+		snap *LatencySnapshot
+		q    float64
+		want uint64
+	}{
+		{"empty", snapshot(0, 0, nil), 0.5, 0},
+		{"p50", mixed, 0.5, 5},
+		{"p90", mixed, 0.9, 5},
+		{"p99", mixed, 0.99, 49},
+		{"p100", mixed, 1, 49},
+		{"clamped to max", snapshot(5, 48, map[int]uint64{5: 9, 40: 1}), 0.99, 48},
+		{"clamped to min", snapshot(40, 40, map[int]uint64{34: 1}), 0.5, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.snap.Percentile(tt.q); got != tt.want {
+				t.Errorf("Percentile(%v) = %d, want %d", tt.q, got, tt.want)
+			}
+		})
+	}
+}
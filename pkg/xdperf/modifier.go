@@ -0,0 +1,278 @@
+package xdperf
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/google/gopacket/layers"
+	"github.com/takehaya/xdperf/pkg/plugin"
+)
+
+// keep in sync with MAX_MODIFIERS, MOD_OP_* and MOD_F_* in src/xdp_prog.h
+const (
+	maxModifiers = 4
+
+	modOpInc    uint8 = 1
+	modOpRandom uint8 = 2
+
+	modFlagIPCsum uint8 = 1 << 0
+	modFlagL4Csum uint8 = 1 << 1
+)
+
+// txModifier is a plugin modifier compiled for the TX program. The field
+// at Offset is rewritten on every packet with a value in [Min, Min+Span).
+type txModifier struct {
+	Offset uint16
+	Len    uint8
+	Op     uint8
+	Flags  uint8
+	Min    uint32
+	Span   uint32 // 0 = 2^32
+	Step   uint32
+}
+
+// modifierParams is ModifierDef.Params. min and max take a number or an
+// IPv4 address, cidr sets both to the first and last address of a prefix.
+type modifierParams struct {
+	Min  json.RawMessage `json:"min"`
+	Max  json.RawMessage `json:"max"`
+	Step *uint32         `json:"step"`
+	CIDR string          `json:"cidr"`
+}
+
+// compileModifiers resolves the modifiers of a template and sets them with
+// the checksum offsets they need on e.
+func compileModifiers(e *TxOverrideEntry, defs []plugin.ModifierDef, pluginLayers []plugin.LayerDefinition) error {
+	if len(defs) == 0 {
+		return nil
+	}
+	if len(defs) > maxModifiers {
+		return fmt.Errorf("%d modifiers exceed the maximum of %d", len(defs), maxModifiers)
+	}
+	lay, err := parseTemplateLayout(e.Data[:e.Length])
+	if err != nil {
+		return err
+	}
+	mods := make([]txModifier, 0, len(defs))
+	for i, d := range defs {
+		m, err := compileModifier(d, lay, pluginLayers, int(e.Length))
+		if err != nil {
+			return fmt.Errorf("modifier %d: %w", i, err)
+		}
+		mods = append(mods, m)
+	}
+	e.Mods = mods
+	if lay.IPCsumOffset != 0 {
+		e.IPCsumOff = uint16(lay.IPCsumOffset)
+	}
+	if lay.L4CsumOffset != 0 {
+		e.L4CsumOff = uint16(lay.L4CsumOffset)
+		e.L4Proto = uint8(lay.L4Proto)
+	}
+	return nil
+}
+
+func compileModifier(d plugin.ModifierDef, lay *templateLayout, pluginLayers []plugin.LayerDefinition, frameLen int) (txModifier, error) {
+	off, n, err := modifierTarget(d.Target, lay, pluginLayers)
+	if err != nil {
+		return txModifier{}, err
+	}
+	switch {
+	case n != 1 && n != 2 && n != 4:
+		return txModifier{}, fmt.Errorf("field length %d is not 1, 2 or 4 bytes", n)
+	case n > 1 && off%2 != 0:
+		return txModifier{}, fmt.Errorf("offset %d of a %d byte field must be even", off, n)
+	case off+n > frameLen:
+		return txModifier{}, fmt.Errorf("field at offset %d (%d bytes) exceeds frame length %d", off, n, frameLen)
+	}
+	for _, c := range []int{lay.IPCsumOffset, lay.L4CsumOffset} {
+		if c != 0 && off < c+2 && c < off+n {
+			return txModifier{}, fmt.Errorf("field at offset %d overlaps the checksum at %d", off, c)
+		}
+	}
+
+	var p modifierParams
+	if len(d.Params) > 0 {
+		if err := json.Unmarshal(d.Params, &p); err != nil {
+			return txModifier{}, fmt.Errorf("invalid params: %w", err)
+		}
+	}
+	fieldMax := uint64(1)<<(8*n) - 1
+	lo, hi := uint64(0), fieldMax
+	if p.CIDR != "" {
+		if lo, hi, err = cidrRange(p.CIDR); err != nil {
+			return txModifier{}, err
+		}
+	}
+	if p.Min != nil {
+		if lo, err = modifierValue(p.Min); err != nil {
+			return txModifier{}, fmt.Errorf("invalid min: %w", err)
+		}
+	}
+	if p.Max != nil {
+		if hi, err = modifierValue(p.Max); err != nil {
+			return txModifier{}, fmt.Errorf("invalid max: %w", err)
+		}
+	}
+	if lo > hi || hi > fieldMax {
+		return txModifier{}, fmt.Errorf("range %d-%d does not fit a %d byte field", lo, hi, n)
+	}
+
+	m := txModifier{
+		Offset: uint16(off),
+		Len:    uint8(n),
+		Min:    uint32(lo),
+		Span:   uint32(hi - lo + 1), // wraps to 0 for the full 32-bit range
+		Step:   1,
+		Flags:  lay.csumFlags(off, n),
+	}
+	if p.Step != nil {
+		m.Step = *p.Step
+	}
+	switch d.Operation.Type {
+	case "increment":
+		m.Op = modOpInc
+	case "range":
+		if p.Max == nil && p.CIDR == "" {
+			return txModifier{}, fmt.Errorf("range needs max or cidr")
+		}
+		m.Op = modOpInc
+	case "random":
+		m.Op = modOpRandom
+	default:
+		return txModifier{}, fmt.Errorf("unknown operation: %q", d.Operation.Type)
+	}
+	return m, nil
+}
+
+// modifierTarget returns the absolute offset and length of a target given
+// as an offset, a field of the plugin's layers or a well-known field.
+func modifierTarget(t plugin.ModifierTarget, lay *templateLayout, pluginLayers []plugin.LayerDefinition) (int, int, error) {
+	if t.Offset != nil {
+		if t.Length == nil {
+			return 0, 0, fmt.Errorf("target offset %d has no length", *t.Offset)
+		}
+		return int(*t.Offset), int(*t.Length), nil
+	}
+	for _, l := range pluginLayers {
+		if l.Type != t.Layer {
+			continue
+		}
+		if f, ok := l.Fields[t.Field]; ok {
+			return int(l.Offset) + int(f.Offset), int(f.Length), nil
+		}
+	}
+
+	switch t.Layer {
+	case "ipv4":
+		if !lay.IPv4 {
+			break
+		}
+		switch t.Field {
+		case "src_ip":
+			return lay.L3Offset + 12, 4, nil
+		case "dst_ip":
+			return lay.L3Offset + 16, 4, nil
+		}
+	case "udp", "tcp":
+		if lay.L4Offset == 0 || (t.Layer == "udp") != (lay.L4Proto == layers.IPProtocolUDP) {
+			break
+		}
+		switch t.Field {
+		case "src_port":
+			return lay.L4Offset, 2, nil
+		case "dst_port":
+			return lay.L4Offset + 2, 2, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("unknown target %s.%s", t.Layer, t.Field)
+}
+
+// csumFlags returns the checksums covering the field at off.
+func (l *templateLayout) csumFlags(off, n int) uint8 {
+	var flags uint8
+	if l.IPv4 && off >= l.L3Offset && off < l.L3Offset+l.L3Len {
+		flags |= modFlagIPCsum
+	}
+	if l.L4CsumOffset == 0 {
+		return flags
+	}
+	// the L4 checksum covers the addresses through the pseudo header
+	addrOff, addrLen := l.L3Offset+12, 8
+	if !l.IPv4 {
+		addrOff, addrLen = l.L3Offset+8, 32
+	}
+	if off >= l.L4Offset || (off+n > addrOff && off < addrOff+addrLen) {
+		flags |= modFlagL4Csum
+	}
+	return flags
+}
+
+// modifierValue parses a JSON number or a string holding a number or an
+// IPv4 address.
+func modifierValue(raw json.RawMessage) (uint64, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		var v uint64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return 0, err
+		}
+		return v, nil
+	}
+	if ip := net.ParseIP(s).To4(); ip != nil {
+		return uint64(binary.BigEndian.Uint32(ip)), nil
+	}
+	return strconv.ParseUint(s, 0, 32)
+}
+
+// cidrRange returns the first and last address of an IPv4 prefix.
+func cidrRange(s string) (uint64, uint64, error) {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cidr: %w", err)
+	}
+	ip := ipnet.IP.To4()
+	if ip == nil {
+		return 0, 0, fmt.Errorf("cidr %s is not IPv4", s)
+	}
+	ones, _ := ipnet.Mask.Size()
+	first := uint64(binary.BigEndian.Uint32(ip))
+	return first, first + (uint64(1) << (32 - ones)) - 1, nil
+}
+
+// checkStampOverlap rejects modifiers rewriting the stamp.
+func checkStampOverlap(e *TxOverrideEntry, stampLen int) error {
+	if e.StampOff == 0 {
+		return nil
+	}
+	s := int(e.StampOff)
+	for _, m := range e.Mods {
+		if int(m.Offset) < s+stampLen && s < int(m.Offset)+int(m.Len) {
+			return fmt.Errorf("modifier at offset %d overlaps the stamp at %d", m.Offset, s)
+		}
+	}
+	return nil
+}
+
+// copyModifiers carries the modifiers and checksum policy of src over to a
+// resized or stamped copy dst, dropping none: a field past the new length is
+// an error.
+func copyModifiers(dst, src *TxOverrideEntry) error {
+	dst.CsumSkip = src.CsumSkip
+	if len(src.Mods) == 0 {
+		return nil
+	}
+	for _, m := range src.Mods {
+		if int(m.Offset)+int(m.Len) > int(dst.Length) {
+			return fmt.Errorf("modifier at offset %d exceeds frame length %d", m.Offset, dst.Length)
+		}
+	}
+	dst.Mods = src.Mods
+	dst.IPCsumOff = src.IPCsumOff
+	dst.L4CsumOff = src.L4CsumOff
+	dst.L4Proto = src.L4Proto
+	return nil
+}
@@ -0,0 +1,467 @@
+package xdperf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/takehaya/xdperf/pkg/control"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"go.uber.org/zap"
+	"golang.org/x/text/message"
+)
+
+// drainTime is how long the server keeps counting after the client is done,
+// so packets still in flight are not reported as lost.
+const drainTime = 500 * time.Millisecond
+
+// helloTimeout is how long the server waits for the hello of a client.
+const helloTimeout = 10 * time.Second
+
+// TestParams is negotiated before traffic starts.
+type TestParams struct {
+	TestID       string        `json:"test_id"`
+	Duration     time.Duration `json:"duration"`
+	Count        int           `json:"count"`
+	Parallelism  int           `json:"parallelism"`
+	RatePPS      float64       `json:"rate_pps,omitempty"`
+	StreamGroup  int           `json:"stream_group"`
+	Seq          bool          `json:"seq"`
+	Latency      bool          `json:"latency"`
+	LatencyClock string        `json:"latency_clock"`
+	StampOffset  int           `json:"stamp_offset"`
+
+	// Reverse asks the server to transmit, Bidir to transmit as well.
+	Reverse bool `json:"reverse,omitempty"`
+	Bidir   bool `json:"bidir,omitempty"`
+	// Templates are the client's frames, the server sends them back with
+	// addresses swapped.
+	Templates [][]byte `json:"templates,omitempty"`
+	// Groups asks for results per stream group, sampled every second.
+	Groups bool `json:"groups,omitempty"`
+}
+
+// TestResults is what the server received during a test.
+type TestResults struct {
+	TestID    string          `json:"test_id"`
+	RxPackets uint64          `json:"rx_packets"`
+	RxBytes   uint64          `json:"rx_bytes"`
+	TxPackets uint64          `json:"tx_packets,omitempty"`
+	TxBytes   uint64          `json:"tx_bytes,omitempty"`
+	Streams   []StreamStats   `json:"streams,omitempty"`
+	Latency   *LatencySummary `json:"latency,omitempty"`
+	Groups    []GroupStats    `json:"groups,omitempty"`
+}
+
+type helloMsg struct {
+	Version int        `json:"version"`
+	Token   string     `json:"token"`
+	Params  TestParams `json:"params"`
+}
+
+type doneMsg struct {
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+}
+
+func newTestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (x *Xdperf) testParams(entries []*TxOverrideEntry) TestParams {
+	p := TestParams{
+		TestID:       newTestID(),
+		Duration:     x.cfg.Duration,
+		Count:        x.cfg.Count,
+		Parallelism:  x.cfg.Parallelism,
+		RatePPS:      x.txRatePPS,
+		StreamGroup:  x.cfg.StreamGroup,
+		Seq:          x.cfg.Seq,
+		Latency:      x.cfg.Latency && !x.cfg.RTT,
+		LatencyClock: x.cfg.LatencyClock,
+		StampOffset:  x.cfg.StampOffset,
+		Reverse:      x.cfg.Reverse,
+		Bidir:        x.cfg.Bidir,
+	}
+	if p.Reverse || p.Bidir {
+		for _, e := range entries {
+			p.Templates = append(p.Templates, e.Data[:e.Length])
+		}
+	}
+	return p
+}
+
+// zeroPerCPU overwrites every key of a per-cpu map with zero values.
+func zeroPerCPU[T any](m *ebpf.Map, keys uint32) error {
+	zero := make([]T, ebpf.MustPossibleCPU())
+	for key := uint32(0); key < keys; key++ {
+		if err := m.Put(&key, zero); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetRxStats clears every receive counter before a new test.
+func (x *Xdperf) resetRxStats() error {
+	if err := zeroPerCPU[coreelf.BpfDatarec](x.bpfobjs.RxStatsMap, 1); err != nil {
+		return fmt.Errorf("failed to reset rx stats map: %w", err)
+	}
+	if err := zeroPerCPU[coreelf.BpfLatStats](x.bpfobjs.LatStatsMap, LatencyClasses); err != nil {
+		return fmt.Errorf("failed to reset lat stats map: %w", err)
+	}
+	if err := zeroPerCPU[uint64](x.bpfobjs.LatHistMap, LatencyClasses*latBuckets); err != nil {
+		return fmt.Errorf("failed to reset lat hist map: %w", err)
+	}
+
+	var (
+		key  uint32
+		val  coreelf.BpfRxStream
+		keys []uint32
+	)
+	iter := x.bpfobjs.RxSeqMap.Iterate()
+	for iter.Next(&key, &val) {
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to iterate rx seq map: %w", err)
+	}
+	for _, k := range keys {
+		if err := x.bpfobjs.RxSeqMap.Delete(&k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to reset rx seq map: %w", err)
+		}
+	}
+	return nil
+}
+
+// collectResults reads the receive counters. With a sampler the streams are
+// summed per group as well.
+func (x *Xdperf) collectResults(testID string, tracker *seqTracker, sampler *groupSampler) (*TestResults, error) {
+	packets, bytes, err := readStats(x.bpfobjs.RxStatsMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rx stats: %w", err)
+	}
+	res := &TestResults{
+		TestID:    testID,
+		RxPackets: packets,
+		RxBytes:   bytes,
+	}
+	if x.cfg.Seq {
+		if res.Streams, err = x.readSeqStats(tracker); err != nil {
+			return nil, err
+		}
+	}
+	if x.cfg.Latency {
+		snap, err := x.readLatency()
+		if err != nil {
+			return nil, err
+		}
+		sum := snap.Summary()
+		res.Latency = &sum
+	}
+	if sampler != nil {
+		if res.Groups, err = x.readGroupStats(res.Streams, sampler); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (x *Xdperf) serverTLSConfig() (*tls.Config, error) {
+	if x.cfg.TLSCert == "" {
+		return nil, nil
+	}
+	return control.ServerTLSConfig(x.cfg.TLSCert, x.cfg.TLSKey)
+}
+
+// serveControl accepts control connections one at a time until ctx is done.
+func (x *Xdperf) serveControl(ctx context.Context, tracker *seqTracker) error {
+	tlsCfg, err := x.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := control.Listen(net.JoinHostPort("", strconv.Itoa(x.cfg.ControlPort)), tlsCfg)
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() { ln.Close() })
+	x.Logger.Info("control channel listening", zap.Int("port", x.cfg.ControlPort), zap.Bool("tls", tlsCfg != nil))
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			x.Logger.Warn("failed to accept control connection", zap.Error(err))
+			continue
+		}
+		conn := control.NewConn(c)
+		if err := x.handleSession(ctx, conn, tracker); err != nil {
+			x.Logger.Error("test session failed", zap.Stringer("peer", conn.RemoteAddr()), zap.Error(err))
+			_ = conn.SendError(err)
+		}
+		conn.Close()
+	}
+}
+
+func (x *Xdperf) handleSession(ctx context.Context, conn *control.Conn, tracker *seqTracker) error {
+	// sessions run one at a time, a silent client must not hold the server
+	if err := conn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return err
+	}
+	var hello helloMsg
+	if err := conn.Recv(ctx, control.TypeHello, &hello); err != nil {
+		return err
+	}
+	if hello.Version != control.ProtocolVersion {
+		return fmt.Errorf("protocol version mismatch: client %d, server %d", hello.Version, control.ProtocolVersion)
+	}
+	if !control.CheckToken(x.cfg.Token, hello.Token) {
+		return fmt.Errorf("invalid token")
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	p := hello.Params
+	x.Logger.Info("test requested", zap.Stringer("peer", conn.RemoteAddr()), zap.Any("params", p))
+	cfg, err := x.paramsConfig(p)
+	if err != nil {
+		return err
+	}
+	// the next session starts from the server's own config again
+	base := x.cfg
+	defer func() { x.cfg = base }()
+	x.cfg = cfg
+	if err := x.initRxConfigMap(); err != nil {
+		return err
+	}
+	if err := x.resetRxStats(); err != nil {
+		return err
+	}
+	tracker.reset()
+
+	transmit := p.Reverse || p.Bidir
+	if transmit {
+		if err := x.prepareReverseTX(p); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Send(control.TypeReady, nil); err != nil {
+		return err
+	}
+
+	var sampler *groupSampler
+	if p.Groups {
+		sampleCtx, stopSampling := context.WithCancel(ctx)
+		defer stopSampling()
+		sampler = newGroupSampler()
+		go sampler.run(sampleCtx, x)
+	}
+
+	txCtx, stopTX := context.WithCancel(ctx)
+	defer stopTX()
+	txDone := make(chan error, 1)
+	if transmit {
+		go func() {
+			err := x.runTXPacket(txCtx)
+			if p.Reverse {
+				// the client only receives, it stops on this
+				if serr := conn.Send(control.TypeTxDone, nil); err == nil {
+					err = serr
+				}
+			}
+			txDone <- err
+		}()
+	} else {
+		txDone <- nil
+	}
+
+	var done doneMsg
+	if err := conn.Recv(ctx, control.TypeDone, &done); err != nil {
+		return err
+	}
+	stopTX()
+	if err := <-txDone; err != nil {
+		return fmt.Errorf("server transmission failed: %w", err)
+	}
+	time.Sleep(drainTime)
+
+	res, err := x.collectResults(p.TestID, tracker, sampler)
+	if err != nil {
+		return err
+	}
+	if transmit {
+		if res.TxPackets, res.TxBytes, err = readStats(x.bpfobjs.StatsMap); err != nil {
+			return fmt.Errorf("failed to read tx stats: %w", err)
+		}
+	}
+	x.Logger.Info("test finished",
+		zap.String("test_id", p.TestID),
+		zap.Uint64("tx_packets", done.TxPackets),
+		zap.Uint64("rx_packets", res.RxPackets),
+	)
+	return conn.Send(control.TypeResults, res)
+}
+
+// paramsConfig returns the server config with the client's test params
+// applied, checked like the command line options before any of them is
+// used.
+func (x *Xdperf) paramsConfig(p TestParams) (Config, error) {
+	cfg := x.cfg
+	cfg.Seq = p.Seq
+	cfg.Latency = p.Latency
+	cfg.LatencyClock = p.LatencyClock
+	cfg.StampOffset = p.StampOffset
+	if p.Reverse || p.Bidir {
+		cfg.Count = p.Count
+		cfg.Duration = p.Duration
+		cfg.Parallelism = p.Parallelism
+		cfg.StreamGroup = p.StreamGroup
+		if p.RatePPS < 0 || math.IsNaN(p.RatePPS) || math.IsInf(p.RatePPS, 0) {
+			return cfg, fmt.Errorf("invalid test params: rate must be a non-negative number")
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid test params: %w", err)
+	}
+	return cfg, nil
+}
+
+// prepareReverseTX loads the client's templates, with source and destination
+// swapped, into the TX maps of the server. x.cfg already holds the params,
+// see paramsConfig.
+func (x *Xdperf) prepareReverseTX(p TestParams) error {
+	if len(p.Templates) == 0 {
+		return fmt.Errorf("no templates to transmit")
+	}
+	x.txRatePPS = p.RatePPS
+	x.txStreamGroups = nil
+
+	entries := make([]*TxOverrideEntry, 0, len(p.Templates))
+	for i, t := range p.Templates {
+		data, err := reverseTemplate(t, x.Device.HardwareAddr)
+		if err != nil {
+			return fmt.Errorf("failed to reverse template %d: %w", i, err)
+		}
+		e := &TxOverrideEntry{Data: data, Length: uint16(len(data))}
+		if x.cfg.Seq || x.cfg.Latency {
+			if err := x.setStampLayout(e); err != nil {
+				return fmt.Errorf("failed to place stamp in template %d: %w", i, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := zeroPerCPU[coreelf.BpfDatarec](x.bpfobjs.StatsMap, 1); err != nil {
+		return fmt.Errorf("failed to reset tx stats map: %w", err)
+	}
+	return x.initEbpfMap(entries)
+}
+
+func (x *Xdperf) clientTLSConfig(host string) (*tls.Config, error) {
+	if !x.cfg.TLS {
+		return nil, nil
+	}
+	return control.ClientTLSConfig(host, x.cfg.TLSCA, x.cfg.TLSInsecure)
+}
+
+// connectPeer negotiates the test with the server and waits until its
+// receiver is armed.
+func (x *Xdperf) connectPeer(ctx context.Context, params TestParams) (*control.Conn, error) {
+	addr := x.cfg.Peer
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(control.DefaultPort))
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	tlsCfg, err := x.clientTLSConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := control.Dial(ctx, addr, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	hello := helloMsg{
+		Version: control.ProtocolVersion,
+		Token:   x.cfg.Token,
+		Params:  params,
+	}
+	if err := conn.Send(control.TypeHello, &hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Recv(ctx, control.TypeReady, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	x.Logger.Info("peer ready", zap.String("peer", addr), zap.String("test_id", params.TestID))
+	return conn, nil
+}
+
+// finishPeer reports the TX counters and returns the server's results.
+// serverTX, when set, delivers the server's tx_done of a reverse test: the
+// server sends it before the results once its transmission stopped.
+func (x *Xdperf) finishPeer(ctx context.Context, conn *control.Conn, serverTX <-chan error) (*TestResults, error) {
+	packets, bytes, err := readStats(x.bpfobjs.StatsMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tx stats: %w", err)
+	}
+	if err := conn.Send(control.TypeDone, &doneMsg{TxPackets: packets, TxBytes: bytes}); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, drainTime+10*time.Second)
+	defer cancel()
+	if serverTX != nil {
+		select {
+		case err := <-serverTX:
+			if err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no tx_done from the server: %w", ctx.Err())
+		}
+	}
+	var res TestResults
+	if err := conn.Recv(ctx, control.TypeResults, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// printTestSummary prints one direction of a test. txPackets is 0 when the
+// sender is unknown.
+func printTestSummary(direction string, txPackets, txBytes uint64, res *TestResults) {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	if res.TestID != "" {
+		p.Printf("test %s, %s\n", res.TestID, direction)
+	} else {
+		p.Printf("%s\n", direction)
+	}
+	if txPackets > 0 {
+		p.Printf("  sent:     %d packets, %d bytes\n", txPackets, txBytes)
+	}
+	p.Printf("  received: %d packets, %d bytes\n", res.RxPackets, res.RxBytes)
+	if txPackets >= res.RxPackets && txPackets > 0 {
+		lost := txPackets - res.RxPackets
+		p.Printf("  loss:     %d packets (%.3f%%)\n", lost, float64(lost)*100/float64(txPackets))
+	}
+	if len(res.Streams) > 0 {
+		printSeqStats(res.Streams)
+	}
+	if res.Latency != nil {
+		fmt.Printf("  one-way %s\n", res.Latency)
+	}
+}
@@ -0,0 +1,156 @@
+package xdperf
+
+import (
+	"context"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/takehaya/xdperf/pkg/control"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"go.uber.org/zap"
+)
+
+func TestParamsConfig(t *testing.T) {
+	server := Config{
+		PluginName:  "simpleudp",
+		Device:      "eth0",
+		Parallelism: 4,
+		ServerFlag:  true,
+		RxAction:    "drop",
+		Count:       7,
+	}
+	reverse := TestParams{Reverse: true, Count: 1000, Duration: time.Second, Parallelism: 2, RatePPS: 1e6}
+
+	tests := []struct {
+		name    string
+		params  func(p *TestParams)
+		wantErr string
+	}{
+		{name: "valid", params: func(p *TestParams) {}},
+		{name: "no parallelism", params: func(p *TestParams) { p.Parallelism = 0 }, wantErr: "parallelism"},
+		{name: "negative count", params: func(p *TestParams) { p.Count = -1 }, wantErr: "count"},
+		{name: "negative duration", params: func(p *TestParams) { p.Duration = -time.Second }, wantErr: "duration"},
+		{name: "stream group", params: func(p *TestParams) { p.StreamGroup = 1 << 16 }, wantErr: "stream group"},
+		{name: "odd stamp offset", params: func(p *TestParams) { p.StampOffset = 3 }, wantErr: "stamp offset"},
+		{name: "latency clock", params: func(p *TestParams) { p.LatencyClock = "tai" }, wantErr: "latency clock"},
+		{name: "negative rate", params: func(p *TestParams) { p.RatePPS = -1 }, wantErr: "rate"},
+		{name: "nan rate", params: func(p *TestParams) { p.RatePPS = math.NaN() }, wantErr: "rate"},
+		{
+			// only a transmitting server takes the TX params
+			name:   "receive only",
+			params: func(p *TestParams) { p.Reverse, p.Parallelism, p.Count = false, 0, -1 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &Xdperf{cfg: server}
+			p := reverse
+			tt.params(&p)
+			cfg, err := x.paramsConfig(p)
+			if !reflect.DeepEqual(x.cfg, server) {
+				t.Errorf("server config changed: %+v", x.cfg)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Reverse && (cfg.Count != p.Count || cfg.Parallelism != p.Parallelism || cfg.Duration != p.Duration) {
+				t.Errorf("config %+v does not hold the params %+v", cfg, p)
+			}
+			if !p.Reverse && (cfg.Count != server.Count || cfg.Parallelism != server.Parallelism) {
+				t.Errorf("receive only config %+v took the TX params", cfg)
+			}
+		})
+	}
+}
+
+// Every session starts from the server's own config, not from the params of
+// the session before it.
+func TestHandleSessionRestoresConfig(t *testing.T) {
+	obj, err := coreelf.ReadCollection()
+	if err != nil {
+		t.Skipf("failed to load eBPF objects: %v", err)
+	}
+	defer obj.Close()
+	server := Config{
+		PluginName:  "simpleudp",
+		Device:      "eth0",
+		Parallelism: 4,
+		ServerFlag:  true,
+		RxAction:    "drop",
+		Count:       7,
+		NoToken:     true,
+	}
+	x := &Xdperf{
+		Logger:  zap.NewNop(),
+		bpfobjs: obj,
+		Device:  &net.Interface{Name: "eth0", HardwareAddr: testSrcMAC},
+		cfg:     server,
+	}
+	tracker := newSeqTracker()
+
+	// session runs the server side of a session over a pipe, client plays
+	// the client side.
+	session := func(client func(c *control.Conn) error) error {
+		cc, sc := net.Pipe()
+		defer cc.Close()
+		defer sc.Close()
+		clientErr := make(chan error, 1)
+		go func() { clientErr <- client(control.NewConn(cc)) }()
+		err := x.handleSession(context.Background(), control.NewConn(sc), tracker)
+		sc.Close()
+		if cerr := <-clientErr; err == nil && cerr != nil {
+			t.Errorf("client: %v", cerr)
+		}
+		return err
+	}
+	hello := func(p TestParams) *helloMsg {
+		return &helloMsg{Version: control.ProtocolVersion, Params: p}
+	}
+
+	// a reverse session that fails after taking its params
+	reverse := TestParams{Reverse: true, Count: 1000, Duration: time.Second, Parallelism: 2, StreamGroup: 3}
+	err = session(func(c *control.Conn) error {
+		return c.Send(control.TypeHello, hello(reverse))
+	})
+	if err == nil || !strings.Contains(err.Error(), "no templates") {
+		t.Fatalf("reverse session err = %v, want no templates", err)
+	}
+	if !reflect.DeepEqual(x.cfg, server) {
+		t.Fatalf("config after the reverse session: %+v", x.cfg)
+	}
+
+	// a receive-only session right after it
+	err = session(func(c *control.Conn) error {
+		if err := c.Send(control.TypeHello, hello(TestParams{Seq: true})); err != nil {
+			return err
+		}
+		if err := c.Recv(context.Background(), control.TypeReady, nil); err != nil {
+			return err
+		}
+		if x.cfg.Count != server.Count || x.cfg.Parallelism != server.Parallelism ||
+			x.cfg.Duration != server.Duration || x.cfg.StreamGroup != server.StreamGroup || !x.cfg.Seq {
+			t.Errorf("receive only session runs with %+v", x.cfg)
+		}
+		if err := c.Send(control.TypeDone, &doneMsg{}); err != nil {
+			return err
+		}
+		var res TestResults
+		return c.Recv(context.Background(), control.TypeResults, &res)
+	})
+	if err != nil {
+		t.Fatalf("receive only session: %v", err)
+	}
+	if !reflect.DeepEqual(x.cfg, server) {
+		t.Fatalf("config after the receive only session: %+v", x.cfg)
+	}
+}
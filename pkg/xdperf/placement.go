@@ -0,0 +1,182 @@
+package xdperf
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/cilium/ebpf"
+	"github.com/takehaya/xdperf/pkg/sysinfo"
+	"go.uber.org/zap"
+)
+
+// placeWorkers resolves the cpu of every TX worker: the first --parallelism
+// cpus of --cpus, else cpus of the device's NUMA node avoiding its IRQ
+// cores, else cpus 0 to parallelism-1.
+func (x *Xdperf) placeWorkers() error {
+	n := x.cfg.Parallelism
+	if len(x.txCPUs) == n {
+		return nil
+	}
+	possible, err := ebpf.PossibleCPU()
+	if err != nil {
+		return fmt.Errorf("failed get possible CPU: %w", err)
+	}
+
+	var cpus []int
+	if x.cfg.CPUs != "" {
+		list, err := sysinfo.ParseCPUList(x.cfg.CPUs)
+		if err != nil {
+			return err
+		}
+		if len(list) < n {
+			return fmt.Errorf("--cpus lists %d cpus, parallelism is %d", len(list), n)
+		}
+		cpus = list[:n]
+	} else {
+		cpus = x.autoPlacement(n)
+	}
+	for _, c := range cpus {
+		if c >= possible {
+			return fmt.Errorf("cpu %d does not exist (%d possible)", c, possible)
+		}
+	}
+	queues, err := x.workerQueues(n)
+	if err != nil {
+		return err
+	}
+	x.txCPUs = cpus
+	x.txQueues = queues
+	x.checkPlacement()
+	x.Logger.Info("tx workers placed", zap.Ints("cpus", cpus), zap.Ints("queues", queues))
+	return nil
+}
+
+// workerQueues resolves the device queue of every TX worker: the first n
+// queues of --queues, else worker w uses queue w modulo the rx queues.
+func (x *Xdperf) workerQueues(n int) ([]int, error) {
+	nrx, err := sysinfo.RxQueues(x.Device.Name)
+	if err != nil {
+		return nil, err
+	}
+	if nrx == 0 {
+		return nil, fmt.Errorf("%s has no rx queues", x.Device.Name)
+	}
+	queues := make([]int, n)
+	if x.cfg.Queues == "" {
+		for w := range queues {
+			queues[w] = w % nrx
+		}
+		return queues, nil
+	}
+	list, err := sysinfo.ParseList(x.cfg.Queues, "queue")
+	if err != nil {
+		return nil, fmt.Errorf("invalid --queues: %w", err)
+	}
+	if len(list) < n {
+		return nil, fmt.Errorf("--queues lists %d queues, parallelism is %d", len(list), n)
+	}
+	for w := range queues {
+		if list[w] >= nrx {
+			return nil, fmt.Errorf("queue %d does not exist, %s has %d rx queues", list[w], x.Device.Name, nrx)
+		}
+		queues[w] = list[w]
+	}
+	return queues, nil
+}
+
+// autoPlacement picks n cpus local to the device, IRQ cores last.
+func (x *Xdperf) autoPlacement(n int) []int {
+	fallback := make([]int, n)
+	for i := range fallback {
+		fallback[i] = i
+	}
+	online, err := sysinfo.OnlineCPUs()
+	if err != nil {
+		x.Logger.Debug("cpu placement unavailable", zap.Error(err))
+		return fallback
+	}
+	node, err := sysinfo.NUMANode(x.Device.Name)
+	if err != nil || node < 0 {
+		return fallback
+	}
+	local, err := sysinfo.NodeCPUs(node)
+	if err != nil {
+		x.Logger.Debug("cpu placement unavailable", zap.Error(err))
+		return fallback
+	}
+	irq, err := sysinfo.IRQCPUs(x.Device.Name)
+	if err != nil {
+		x.Logger.Debug("failed to read irq affinity", zap.Error(err))
+	}
+
+	var free, busy, remote []int
+	for _, c := range online {
+		switch {
+		case !slices.Contains(local, c):
+			remote = append(remote, c)
+		case slices.Contains(irq, c):
+			busy = append(busy, c)
+		default:
+			free = append(free, c)
+		}
+	}
+	cpus := append(append(free, busy...), remote...)
+	if len(cpus) < n {
+		return fallback
+	}
+	if n > len(free)+len(busy) {
+		x.Logger.Warn("numa node of the device has too few cpus, some workers run on a remote node",
+			zap.Int("node", node), zap.Int("local_cpus", len(free)+len(busy)))
+	}
+	return cpus[:n]
+}
+
+// checkPlacement warns about workers on the IRQ cores or off the NUMA node
+// of the device.
+func (x *Xdperf) checkPlacement() {
+	irq, err := sysinfo.IRQCPUs(x.Device.Name)
+	if err == nil {
+		var shared []int
+		for _, c := range x.txCPUs {
+			if slices.Contains(irq, c) {
+				shared = append(shared, c)
+			}
+		}
+		if len(shared) > 0 {
+			x.Logger.Warn("tx workers share cores with the device irqs", zap.Ints("cpus", shared))
+		}
+	}
+	node, err := sysinfo.NUMANode(x.Device.Name)
+	if err != nil || node < 0 {
+		return
+	}
+	local, err := sysinfo.NodeCPUs(node)
+	if err != nil {
+		return
+	}
+	var remote []int
+	for _, c := range x.txCPUs {
+		if !slices.Contains(local, c) {
+			remote = append(remote, c)
+		}
+	}
+	if len(remote) > 0 {
+		x.Logger.Warn("tx workers are not on the numa node of the device", zap.Int("node", node), zap.Ints("cpus", remote))
+	}
+}
+
+// cpuWorkers maps every possible cpu to the index of the worker running on
+// it. CPUs without a worker keep their own number, their entries are never
+// read.
+func (x *Xdperf) cpuWorkers(numCpus int) []int {
+	workers := make([]int, numCpus)
+	for cpu := range workers {
+		workers[cpu] = cpu
+	}
+	for w, cpu := range x.txCPUs {
+		if cpu < numCpus {
+			workers[cpu] = w
+		}
+	}
+	return workers
+}
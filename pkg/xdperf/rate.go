@@ -0,0 +1,80 @@
+package xdperf
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Rate is a target TX rate in packets or bits per second.
+type Rate struct {
+	Value float64
+	Bits  bool // Value is in bits per second
+}
+
+var rateRe = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([kKMGT]?)(pps|bps)$`)
+
+var rateScale = map[string]float64{
+	"":  1,
+	"k": 1e3,
+	"K": 1e3,
+	"M": 1e6,
+	"G": 1e9,
+	"T": 1e12,
+}
+
+// ParseRate parses rates such as "10Mpps", "500kpps" or "40Gbps". An empty
+// string is no rate (as fast as possible).
+func ParseRate(s string) (Rate, error) {
+	if s == "" {
+		return Rate{}, nil
+	}
+	m := rateRe.FindStringSubmatch(s)
+	if m == nil {
+		return Rate{}, fmt.Errorf("invalid rate %q, e.g. 10Mpps or 40Gbps", s)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || v <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q", s)
+	}
+	return Rate{Value: v * rateScale[m[2]], Bits: m[3] == "bps"}, nil
+}
+
+// PPS converts the rate to packets per second. Bit rates count the bytes of
+// the generated frames, like the TX stats do.
+func (r Rate) PPS(avgFrameLen float64) float64 {
+	if !r.Bits {
+		return r.Value
+	}
+	if avgFrameLen <= 0 {
+		return 0
+	}
+	return r.Value / (avgFrameLen * 8)
+}
+
+func (r Rate) String() string {
+	if r.Bits {
+		return fmt.Sprintf("%.0f bps", r.Value)
+	}
+	return fmt.Sprintf("%.0f pps", r.Value)
+}
+
+// targetRatePPS resolves --rate, or the rate suggested by the plugin, into
+// packets per second for the given templates. 0 means as fast as possible.
+func (x *Xdperf) targetRatePPS(entries []*TxOverrideEntry) (float64, error) {
+	r, err := ParseRate(x.cfg.Rate)
+	if err != nil {
+		return 0, err
+	}
+	if r.Value == 0 {
+		return float64(x.pluginRatePPS), nil
+	}
+	var total float64
+	for _, e := range entries {
+		total += float64(e.Length)
+	}
+	if len(entries) == 0 {
+		return 0, fmt.Errorf("no templates to compute the rate for")
+	}
+	return r.PPS(total / float64(len(entries))), nil
+}
@@ -0,0 +1,57 @@
+package xdperf
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Rate
+		wantErr bool
+	}{
+		{in: "", want: Rate{}},
+		{in: "100pps", want: Rate{Value: 100}},
+		{in: "500kpps", want: Rate{Value: 500e3}},
+		{in: "500Kpps", want: Rate{Value: 500e3}},
+		{in: "1.5Mpps", want: Rate{Value: 1.5e6}},
+		{in: "10 Mpps", want: Rate{Value: 10e6}},
+		{in: "40Gbps", want: Rate{Value: 40e9, Bits: true}},
+		{in: "1Tbps", want: Rate{Value: 1e12, Bits: true}},
+		{in: "1000", wantErr: true},
+		{in: "10mpps", wantErr: true},
+		{in: "10Mbit", wantErr: true},
+		{in: "-1pps", wantErr: true},
+		{in: "0pps", wantErr: true},
+		{in: "1e6pps", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRate(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRate(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRate(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRatePPS(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   Rate
+		avgLen float64
+		want   float64
+	}{
+		{"packets", Rate{Value: 1e6}, 64, 1e6},
+		{"bits", Rate{Value: 1e9, Bits: true}, 125, 1e6},
+		{"bits without frames", Rate{Value: 1e9, Bits: true}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rate.PPS(tt.avgLen); got != tt.want {
+				t.Errorf("PPS(%v) = %v, want %v", tt.avgLen, got, tt.want)
+			}
+		})
+	}
+}
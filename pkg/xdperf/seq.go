@@ -0,0 +1,241 @@
+package xdperf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"go.uber.org/zap"
+	"golang.org/x/text/message"
+)
+
+// keep in sync with struct xdperf_stamp in src/xdp_prog.h
+const stampSize = 24
+
+// keep in sync with RX_F_* and SEQ_EVENT_* in src/xdp_prog.h
+const (
+	rxFlagSeq uint32 = 1 << 0
+
+	seqEventGap  uint32 = 0
+	seqEventFill uint32 = 1
+)
+
+// maxMissingRanges bounds the number of missing ranges kept per stream.
+const maxMissingRanges = 4096
+
+// StreamID splits a stamped stream id into the stream group and TX cpu.
+func StreamID(id uint32) (group uint16, cpu uint16) {
+	return uint16(id >> 16), uint16(id)
+}
+
+func (x *Xdperf) setStampLayout(e *TxOverrideEntry) error {
+	lay, err := parseTemplateLayout(e.Data[:e.Length])
+	if err != nil {
+		return err
+	}
+	off, err := lay.stampOffset(x.cfg.StampOffset, int(e.Length), stampSize)
+	if err != nil {
+		return err
+	}
+	e.StampOff = uint16(off)
+	e.L4CsumOff = uint16(lay.L4CsumOffset)
+	e.L4Proto = uint8(lay.L4Proto)
+	return checkStampOverlap(e, stampSize)
+}
+
+type SeqRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+type StreamStats struct {
+	StreamID  uint32     `json:"stream_id"`
+	Received  uint64     `json:"received"`
+	Lost      uint64     `json:"lost"`
+	Duplicate uint64     `json:"duplicate"`
+	Reordered uint64     `json:"reordered"`
+	Missing   []SeqRange `json:"missing,omitempty"`
+	// Truncated is set when more missing ranges were seen than kept.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// seqEvent mirrors struct seq_event in src/xdp_prog.h
+type seqEvent struct {
+	StreamID uint32
+	Kind     uint32
+	Start    uint64
+	End      uint64
+}
+
+// seqTracker keeps the missing sequence ranges of every stream from the
+// gap and fill events of xdp_rx.
+type seqTracker struct {
+	mu        sync.Mutex
+	missing   map[uint32][]SeqRange
+	truncated map[uint32]bool
+}
+
+func newSeqTracker() *seqTracker {
+	return &seqTracker{
+		missing:   make(map[uint32][]SeqRange),
+		truncated: make(map[uint32]bool),
+	}
+}
+
+// reset forgets every missing range, e.g. before a new test.
+func (t *seqTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.missing = make(map[uint32][]SeqRange)
+	t.truncated = make(map[uint32]bool)
+}
+
+func (t *seqTracker) apply(ev seqEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// events of several RX cpus can arrive out of order, ranges are kept
+	// sorted and merged so that they can be searched
+	ranges := t.missing[ev.StreamID]
+	switch ev.Kind {
+	case seqEventGap:
+		r := SeqRange{Start: ev.Start, End: ev.End}
+		// ranges[i:j] overlap or touch r
+		i := sort.Search(len(ranges), func(i int) bool { return ranges[i].End+1 >= r.Start })
+		j := i
+		for ; j < len(ranges) && ranges[j].Start <= r.End+1; j++ {
+			r.Start = min(r.Start, ranges[j].Start)
+			r.End = max(r.End, ranges[j].End)
+		}
+		if i == j && len(ranges) >= maxMissingRanges {
+			t.truncated[ev.StreamID] = true
+			return
+		}
+		t.missing[ev.StreamID] = slices.Replace(ranges, i, j, r)
+	case seqEventFill:
+		i := sort.Search(len(ranges), func(i int) bool { return ranges[i].End >= ev.Start })
+		if i == len(ranges) || ranges[i].Start > ev.Start {
+			return
+		}
+		r := ranges[i]
+		switch {
+		case r.Start == r.End:
+			ranges = append(ranges[:i], ranges[i+1:]...)
+		case ev.Start == r.Start:
+			ranges[i].Start++
+		case ev.Start == r.End:
+			ranges[i].End--
+		default:
+			ranges = append(ranges[:i+1], ranges[i:]...)
+			ranges[i].End = ev.Start - 1
+			ranges[i+1].Start = ev.Start + 1
+		}
+		t.missing[ev.StreamID] = ranges
+	}
+}
+
+// run consumes rx_seq_events until ctx is cancelled.
+func (t *seqTracker) run(ctx context.Context, m *ebpf.Map, logger *zap.Logger) error {
+	rd, err := ringbuf.NewReader(m)
+	if err != nil {
+		return fmt.Errorf("failed to open seq event ring buffer: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		rd.Close()
+	}()
+
+	var rec ringbuf.Record
+	for {
+		if err := rd.ReadInto(&rec); err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return nil
+			}
+			logger.Warn("failed to read seq event", zap.Error(err))
+			continue
+		}
+		var ev seqEvent
+		if err := binary.Read(bytes.NewReader(rec.RawSample), binary.NativeEndian, &ev); err != nil {
+			logger.Warn("failed to decode seq event", zap.Error(err))
+			continue
+		}
+		t.apply(ev)
+	}
+}
+
+// readSeqStats returns the per-stream counters of rx_seq_map sorted by stream id.
+func (x *Xdperf) readSeqStats(t *seqTracker) ([]StreamStats, error) {
+	var (
+		key    uint32
+		val    coreelf.BpfRxStream
+		result []StreamStats
+	)
+	iter := x.bpfobjs.RxSeqMap.Iterate()
+	for iter.Next(&key, &val) {
+		st := StreamStats{
+			StreamID:  key,
+			Received:  val.Received,
+			Lost:      val.Lost,
+			Duplicate: val.Duplicate,
+			Reordered: val.Reordered,
+		}
+		if t != nil {
+			t.mu.Lock()
+			st.Missing = append([]SeqRange(nil), t.missing[key]...)
+			st.Truncated = t.truncated[key]
+			t.mu.Unlock()
+		}
+		result = append(result, st)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rx seq map: %w", err)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].StreamID < result[j].StreamID })
+	return result, nil
+}
+
+// seqSummary returns the loss counters summed over all streams.
+func (x *Xdperf) seqSummary() string {
+	if x.rxFlags.Load()&rxFlagSeq == 0 {
+		return ""
+	}
+	stats, err := x.readSeqStats(nil)
+	if err != nil {
+		return err.Error()
+	}
+	var lost, dup, reordered uint64
+	for _, st := range stats {
+		lost += st.Lost
+		dup += st.Duplicate
+		reordered += st.Reordered
+	}
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	return p.Sprintf("seq: lost %d, duplicate %d, reordered %d", lost, dup, reordered)
+}
+
+func printSeqStats(stats []StreamStats) {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	for _, st := range stats {
+		group, cpu := StreamID(st.StreamID)
+		p.Printf("stream %d/cpu %d: received %d, lost %d, duplicate %d, reordered %d\n",
+			group, cpu, st.Received, st.Lost, st.Duplicate, st.Reordered)
+		for _, r := range st.Missing {
+			if r.Start == r.End {
+				p.Printf("  missing %d\n", r.Start)
+			} else {
+				p.Printf("  missing %d-%d\n", r.Start, r.End)
+			}
+		}
+		if st.Truncated {
+			p.Printf("  (more than %d missing ranges, list truncated)\n", maxMissingRanges)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package xdperf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeqTrackerApply(t *testing.T) {
+	gap := func(start, end uint64) seqEvent {
+		return seqEvent{StreamID: 1, Kind: seqEventGap, Start: start, End: end}
+	}
+	fill := func(seq uint64) seqEvent {
+		return seqEvent{StreamID: 1, Kind: seqEventFill, Start: seq, End: seq}
+	}
+
+	tests := []struct {
+		name   string
+		events []seqEvent
+		want   []SeqRange
+	}{
+		{
+			name:   "gaps",
+			events: []seqEvent{gap(3, 5), gap(9, 9)},
+			want:   []SeqRange{{3, 5}, {9, 9}},
+		},
+		{
+			name:   "fill start",
+			events: []seqEvent{gap(3, 5), fill(3)},
+			want:   []SeqRange{{4, 5}},
+		},
+		{
+			name:   "fill end",
+			events: []seqEvent{gap(3, 5), fill(5)},
+			want:   []SeqRange{{3, 4}},
+		},
+		{
+			name:   "fill middle splits",
+			events: []seqEvent{gap(3, 7), gap(10, 12), fill(5)},
+			want:   []SeqRange{{3, 4}, {6, 7}, {10, 12}},
+		},
+		{
+			name:   "fill single",
+			events: []seqEvent{gap(3, 3), gap(6, 8), fill(3)},
+			want:   []SeqRange{{6, 8}},
+		},
+		{
+			name:   "gaps out of order",
+			events: []seqEvent{gap(9, 9), gap(3, 5), gap(20, 22), fill(4)},
+			want:   []SeqRange{{3, 3}, {5, 5}, {9, 9}, {20, 22}},
+		},
+		{
+			name:   "overlapping gaps merge",
+			events: []seqEvent{gap(10, 12), gap(3, 5), gap(4, 11)},
+			want:   []SeqRange{{3, 12}},
+		},
+		{
+			name:   "adjacent gaps merge",
+			events: []seqEvent{gap(6, 8), gap(3, 5), gap(9, 9), gap(11, 11)},
+			want:   []SeqRange{{3, 9}, {11, 11}},
+		},
+		{
+			name:   "fill after out of order gaps",
+			events: []seqEvent{gap(30, 30), gap(10, 12), fill(30), fill(11)},
+			want:   []SeqRange{{10, 10}, {12, 12}},
+		},
+		{
+			name:   "fill outside",
+			events: []seqEvent{gap(3, 5), fill(2), fill(6)},
+			want:   []SeqRange{{3, 5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newSeqTracker()
+			for _, ev := range tt.events {
+				tr.apply(ev)
+			}
+			if got := tr.missing[1]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missing = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeqTrackerTruncate(t *testing.T) {
+	tr := newSeqTracker()
+	for i := range uint64(maxMissingRanges + 1) {
+		tr.apply(seqEvent{StreamID: 7, Kind: seqEventGap, Start: 2 * i, End: 2 * i})
+	}
+	if got := len(tr.missing[7]); got != maxMissingRanges {
+		t.Errorf("kept %d ranges, want %d", got, maxMissingRanges)
+	}
+	if !tr.truncated[7] {
+		t.Error("stream not marked truncated")
+	}
+	if tr.truncated[1] {
+		t.Error("other stream marked truncated")
+	}
+}
@@ -0,0 +1,149 @@
+package xdperf
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"go.uber.org/zap"
+	"golang.org/x/text/message"
+)
+
+// keep in sync with RX_ACTION_* in src/xdp_prog.h
+const (
+	rxActionDrop uint32 = iota
+	rxActionPass
+	rxActionRedirect
+	rxActionReflect
+)
+
+var rxActions = map[string]uint32{
+	"drop":     rxActionDrop,
+	"pass":     rxActionPass,
+	"redirect": rxActionRedirect,
+	"reflect":  rxActionReflect,
+}
+
+var xdpModes = map[string]link.XDPAttachFlags{
+	"":        0, // let the kernel decide
+	"native":  link.XDPDriverMode,
+	"generic": link.XDPGenericMode,
+	"offload": link.XDPOffloadMode,
+}
+
+func (x *Xdperf) initRxConfigMap() error {
+	key := uint32(0)
+	cfg := coreelf.BpfRxConfig{
+		Action:   rxActions[x.cfg.RxAction],
+		StampOff: uint32(x.cfg.StampOffset),
+	}
+	if x.cfg.Seq {
+		cfg.Flags |= rxFlagSeq
+	}
+	if x.cfg.Latency {
+		offset, err := clockOffset(x.cfg.LatencyClock)
+		if err != nil {
+			return err
+		}
+		cfg.Flags |= rxFlagLatency
+		cfg.ClockOffset = offset
+	}
+	if err := x.bpfobjs.RxConfigMap.Put(&key, &cfg); err != nil {
+		return fmt.Errorf("failed put rx config map: %w", err)
+	}
+	x.rxFlags.Store(cfg.Flags)
+
+	if cfg.Action != rxActionRedirect {
+		return nil
+	}
+	dev, err := net.InterfaceByName(x.cfg.RedirectDevice)
+	if err != nil {
+		return fmt.Errorf("failed get redirect device %s: %w", x.cfg.RedirectDevice, err)
+	}
+	ifindex := uint32(dev.Index)
+	if err := x.bpfobjs.RxRedirectMap.Put(&key, &ifindex); err != nil {
+		return fmt.Errorf("failed put rx redirect map: %w", err)
+	}
+	return nil
+}
+
+// attachRX attaches xdp_rx to the device and returns the link to detach it.
+func (x *Xdperf) attachRX() (link.Link, error) {
+	return x.attachRXTo(x.Device)
+}
+
+func (x *Xdperf) attachRXTo(dev *net.Interface) (link.Link, error) {
+	if err := x.initRxConfigMap(); err != nil {
+		return nil, fmt.Errorf("failed to init rx config map: %w", err)
+	}
+	l, err := link.AttachXDP(link.XDPOptions{
+		Program:   x.bpfobjs.XdpRx,
+		Interface: dev.Index,
+		Flags:     xdpModes[x.cfg.XDPMode],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach xdp_rx to %s: %w", dev.Name, err)
+	}
+	return l, nil
+}
+
+func (x *Xdperf) StartServer(ctx context.Context) error {
+	x.Logger.Info("start server mode",
+		zap.String("device", x.Device.Name),
+		zap.String("action", x.cfg.RxAction),
+	)
+
+	l, err := x.attachRX()
+	if err != nil {
+		x.Logger.Error("failed to attach rx program", zap.Error(err))
+		return err
+	}
+	defer l.Close()
+	x.Logger.Info("rx program attached")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go x.ShowRxStats(ctx)
+
+	tracker := newSeqTracker()
+	go func() {
+		if err := tracker.run(ctx, x.bpfobjs.RxSeqEvents, x.Logger); err != nil {
+			x.Logger.Error("seq tracker stopped", zap.Error(err))
+		}
+	}()
+
+	if x.cfg.ControlPort > 0 {
+		go func() {
+			if err := x.serveControl(ctx, tracker); err != nil {
+				x.Logger.Error("control channel stopped", zap.Error(err))
+			}
+		}()
+	}
+
+	waitSignal(ctx)
+	x.Logger.Info("Shutting down server...")
+	cancel()
+
+	packets, bytes, err := readStats(x.bpfobjs.RxStatsMap)
+	if err != nil {
+		return fmt.Errorf("failed to read rx stats: %w", err)
+	}
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	p.Printf("total: %d packets, %d bytes received\n", packets, bytes)
+
+	if x.cfg.Seq {
+		stats, err := x.readSeqStats(tracker)
+		if err != nil {
+			return err
+		}
+		printSeqStats(stats)
+	}
+	if x.cfg.Latency {
+		if err := x.printLatency(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package xdperf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/takehaya/xdperf/pkg/control"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"github.com/takehaya/xdperf/pkg/rfc2544"
+	"github.com/takehaya/xdperf/pkg/y1564"
+)
+
+// RunStep sends the loads of a Y.1564 step. Every service transmits from
+// its own CPUs and stamps its ID as stream group, so the receiver measures
+// loss and delay per service.
+func (x *Xdperf) RunStep(ctx context.Context, st y1564.Step) ([]y1564.Measurement, error) {
+	n := x.cfg.Parallelism
+	if len(st.Loads) > n {
+		return nil, fmt.Errorf("%d services need a parallelism of at least %d, got %d", len(st.Loads), len(st.Loads), n)
+	}
+
+	if err := x.placeWorkers(); err != nil {
+		return nil, err
+	}
+	x.cfg.Seq = true
+	x.cfg.Latency = true
+	sets := make([][]*TxOverrideEntry, n)
+	groups := make([]uint32, n)
+	cpus := make([][]int, len(st.Loads))
+	var workers []*txWorker
+	for i, l := range st.Loads {
+		if l.ID < 0 || l.ID >= LatencyClasses {
+			return nil, fmt.Errorf("at most %d services are supported", LatencyClasses)
+		}
+		s := l.Service
+		cached, err := x.sizedTemplates(ctx, s.Name, s.FrameSize-rfc2544.FCSLen, s.PluginConfig)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", s.Name, err)
+		}
+		stamped, err := x.stampedCopies(cached)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", s.Name, err)
+		}
+		lo, hi := i*n/len(st.Loads), (i+1)*n/len(st.Loads)
+		for w := lo; w < hi; w++ {
+			sets[w] = stamped
+			groups[w] = uint32(l.ID)
+			cpus[i] = append(cpus[i], x.txCPUs[w])
+			workers = append(workers, &txWorker{idx: w, cpu: x.txCPUs[w], rate: l.RatePPS / float64(hi-lo)})
+		}
+	}
+	x.txStreamGroups = groups
+	if err := x.initEbpfMapSets(sets); err != nil {
+		return nil, err
+	}
+	if err := zeroPerCPU[coreelf.BpfDatarec](x.bpfobjs.StatsMap, 1); err != nil {
+		return nil, fmt.Errorf("failed to reset tx stats map: %w", err)
+	}
+
+	// arm the receiver
+	var (
+		conn    *control.Conn
+		sampler *groupSampler
+	)
+	if x.cfg.Peer != "" {
+		params := x.testParams(nil)
+		params.Duration = st.Duration
+		params.Count = 0
+		params.Groups = true
+		var err error
+		if conn, err = x.connectPeer(ctx, params); err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+	} else {
+		if err := x.initRxConfigMap(); err != nil {
+			return nil, err
+		}
+		if err := x.resetRxStats(); err != nil {
+			return nil, err
+		}
+		sampleCtx, stopSampling := context.WithCancel(ctx)
+		defer stopSampling()
+		sampler = newGroupSampler()
+		go sampler.run(sampleCtx, x)
+	}
+
+	start := time.Now()
+	if err := x.runWorkers(ctx, workers, st.Duration); err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+
+	var groupStats []GroupStats
+	if conn != nil {
+		res, err := x.finishPeer(ctx, conn, nil)
+		if err != nil {
+			return nil, err
+		}
+		groupStats = res.Groups
+	} else {
+		time.Sleep(drainTime)
+		streams, err := x.readSeqStats(nil)
+		if err != nil {
+			return nil, err
+		}
+		if groupStats, err = x.readGroupStats(streams, sampler); err != nil {
+			return nil, err
+		}
+	}
+
+	recs := make([]coreelf.BpfDatarec, ebpf.MustPossibleCPU())
+	var zero uint32
+	if err := x.bpfobjs.StatsMap.Lookup(&zero, &recs); err != nil {
+		return nil, fmt.Errorf("failed to read tx stats: %w", err)
+	}
+
+	ms := make([]y1564.Measurement, len(st.Loads))
+	for i, l := range st.Loads {
+		m := &ms[i]
+		m.Elapsed = elapsed
+		for _, cpu := range cpus[i] {
+			m.Sent += recs[cpu].RxPackets
+		}
+		for _, g := range groupStats {
+			if int(g.Group) != l.ID {
+				continue
+			}
+			m.Received = g.Received
+			if g.Latency != nil && g.Latency.Count > 0 {
+				m.Latency = &y1564.Latency{
+					Min:  g.Latency.Min,
+					Mean: g.Latency.Mean,
+					P99:  g.Latency.P99,
+					Max:  g.Latency.Max,
+				}
+			}
+			for _, iv := range g.Intervals {
+				m.Intervals = append(m.Intervals, y1564.Interval{Received: iv.Received, Lost: iv.Lost})
+			}
+		}
+	}
+	return ms, nil
+}
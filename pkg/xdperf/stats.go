@@ -10,11 +10,72 @@ import (
 	"golang.org/x/text/message"
 )
 
+// ShowStats prints the per-second TX rate aggregated from stats_map.
+// With pacing the actual rate is compared to the target, and in round-trip
+// mode the latency of the reflected packets follows.
 func (x *Xdperf) ShowStats(ctx context.Context) {
+	var extras []func() string
+	if x.txRatePPS > 0 {
+		extras = append(extras, x.rateReporter(x.txRatePPS))
+	}
+	if x.cfg.RTT {
+		extras = append(extras, x.latencyReporter())
+	}
+	x.showStats(ctx, x.bpfobjs.StatsMap, "xmit", extras...)
+}
+
+// ShowRxStats prints the per-second RX rate aggregated from rx_stats_map.
+// Loss counters and latency follow while they are measured.
+func (x *Xdperf) ShowRxStats(ctx context.Context) {
+	x.showStats(ctx, x.bpfobjs.RxStatsMap, "recv", x.seqSummary, x.latencyReporter())
+}
+
+// rateReporter returns a stats line generator comparing the TX rate of the
+// last interval and of the whole run to target.
+func (x *Xdperf) rateReporter(target float64) func() string {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	var (
+		start, prev    time.Time
+		first, prevPkt uint64
+	)
+	return func() string {
+		packets, _, err := readStats(x.bpfobjs.StatsMap)
+		if err != nil {
+			return err.Error()
+		}
+		now := time.Now()
+		if start.IsZero() {
+			start, prev = now, now
+			first, prevPkt = packets, packets
+			return p.Sprintf("target %.0f pps", target)
+		}
+		cur := float64(packets-prevPkt) / now.Sub(prev).Seconds()
+		avg := float64(packets-first) / now.Sub(start).Seconds()
+		prev, prevPkt = now, packets
+		return p.Sprintf("target %.0f pps, actual %.0f pps (%.1f%%), average %.0f pps (%.1f%%)",
+			target, cur, cur*100/target, avg, avg*100/target)
+	}
+}
+
+// readStats sums the per-CPU datarec of the given stats map.
+func readStats(m *ebpf.Map) (packets uint64, bytes uint64, err error) {
+	recs := make([]coreelf.BpfDatarec, ebpf.MustPossibleCPU())
+	var key uint32
+	if err := m.Lookup(&key, &recs); err != nil {
+		return 0, 0, err
+	}
+	for _, rec := range recs {
+		packets += rec.RxPackets
+		bytes += rec.RxBytes
+	}
+	return packets, bytes, nil
+}
+
+// showStats prints the rate of m every second, followed by one indented
+// line per non-empty extra.
+func (x *Xdperf) showStats(ctx context.Context, m *ebpf.Map, unit string, extras ...func() string) {
 	var prevPackets uint64
 	var prevBytes uint64
-	possibleCPUs := ebpf.MustPossibleCPU()
-	recs := make([]coreelf.BpfDatarec, possibleCPUs)
 	p := message.NewPrinter(message.MatchLanguage("en"))
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
@@ -22,23 +83,22 @@ func (x *Xdperf) ShowStats(ctx context.Context) {
 	for {
 		select {
 		case <-ticker.C:
-			var key uint32
-			err := x.bpfobjs.StatsMap.Lookup(&key, &recs)
+			sumPackets, sumBytes, err := readStats(m)
 			if err != nil {
-				fmt.Printf("failed to lookup stats_map: %v\n", err)
+				fmt.Printf("failed to lookup stats map: %v\n", err)
 				continue
 			}
-			var sumPackets uint64
-			var sumBytes uint64
-			for _, rec := range recs {
-				sumPackets += rec.RxPackets
-				sumBytes += rec.RxBytes
-			}
 			deltaPackets := sumPackets - prevPackets
 			deltaBytes := sumBytes - prevBytes
 			prevPackets = sumPackets
 			prevBytes = sumBytes
-			p.Printf("%d xmit/s, %.2f Mbps\n", deltaPackets, float64(deltaBytes*8)/1024/1024)
+			// Mbps is 10^6 bits per second, as in the summary and --rate
+			p.Printf("%d %s/s, %.2f Mbps\n", deltaPackets, unit, float64(deltaBytes*8)/1e6)
+			for _, extra := range extras {
+				if line := extra(); line != "" {
+					fmt.Printf("  %s\n", line)
+				}
+			}
 		case <-ctx.Done():
 			return
 		}
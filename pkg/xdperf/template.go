@@ -0,0 +1,179 @@
+package xdperf
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// templateLayout holds the header offsets of a template frame.
+// Offsets are from the start of the frame, 0 means the header is absent.
+type templateLayout struct {
+	L3Offset      int
+	L3Len         int
+	L4Offset      int
+	PayloadOffset int
+	IPv4          bool
+	L4Proto       layers.IPProtocol
+	L4CsumOffset  int
+	IPCsumOffset  int
+}
+
+func parseTemplateLayout(data []byte) (*templateLayout, error) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	if errLayer := packet.ErrorLayer(); errLayer != nil {
+		return nil, fmt.Errorf("failed to decode template: %w", errLayer.Error())
+	}
+
+	lay := &templateLayout{}
+	off := 0
+	for _, l := range packet.Layers() {
+		switch l.LayerType() {
+		case layers.LayerTypeIPv4:
+			lay.L3Offset = off
+			lay.L3Len = len(l.LayerContents())
+			lay.IPv4 = true
+			lay.IPCsumOffset = off + 10
+		case layers.LayerTypeIPv6:
+			lay.L3Offset = off
+			lay.L3Len = len(l.LayerContents())
+		case layers.LayerTypeUDP:
+			lay.L4Offset = off
+			lay.L4Proto = layers.IPProtocolUDP
+			lay.L4CsumOffset = off + 6
+			lay.PayloadOffset = off + len(l.LayerContents())
+		case layers.LayerTypeTCP:
+			lay.L4Offset = off
+			lay.L4Proto = layers.IPProtocolTCP
+			lay.L4CsumOffset = off + 16
+			lay.PayloadOffset = off + len(l.LayerContents())
+		}
+		if lay.L4Offset != 0 {
+			break
+		}
+		off += len(l.LayerContents())
+	}
+	return lay, nil
+}
+
+// stampOffset returns the absolute offset of the sequence stamp placed
+// payloadOff bytes into the L4 payload.
+func (l *templateLayout) stampOffset(payloadOff int, frameLen int, stampLen int) (int, error) {
+	if l.L4Offset == 0 {
+		return 0, fmt.Errorf("template has no UDP/TCP header")
+	}
+	off := l.PayloadOffset + payloadOff
+	if off+stampLen > frameLen {
+		return 0, fmt.Errorf("stamp at offset %d (%d bytes) exceeds frame length %d", off, stampLen, frameLen)
+	}
+	// the incremental checksum update works on 16-bit words
+	if (off-l.L4Offset)%2 != 0 {
+		return 0, fmt.Errorf("stamp offset %d must be even", payloadOff)
+	}
+	return off, nil
+}
+
+// reverseTemplate returns a copy of a template addressed back to its sender:
+// MAC, IP addresses and L4 ports are swapped and srcMAC becomes the source.
+// Checksums stay valid since the swapped fields are summed in any order.
+func reverseTemplate(data []byte, srcMAC net.HardwareAddr) ([]byte, error) {
+	lay, err := parseTemplateLayout(data)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(nil), data...)
+	if len(out) < 12 || len(srcMAC) != 6 {
+		return nil, fmt.Errorf("invalid ethernet header")
+	}
+	copy(out[0:6], data[6:12])
+	copy(out[6:12], srcMAC)
+
+	swap := func(a, b, n int) {
+		tmp := make([]byte, n)
+		copy(tmp, out[a:a+n])
+		copy(out[a:a+n], out[b:b+n])
+		copy(out[b:b+n], tmp)
+	}
+	if lay.IPv4 {
+		swap(lay.L3Offset+12, lay.L3Offset+16, 4)
+	} else if lay.L3Offset != 0 {
+		swap(lay.L3Offset+8, lay.L3Offset+24, 16)
+	}
+	if lay.L4Offset != 0 {
+		swap(lay.L4Offset, lay.L4Offset+2, 2)
+	}
+	return out, nil
+}
+
+// resizeTemplate returns a copy of a template grown or shrunk to frameLen
+// bytes by changing its L4 payload. The payload is repeated to fill, and
+// lengths and checksums are recomputed.
+func resizeTemplate(data []byte, frameLen int) ([]byte, error) {
+	lay, err := parseTemplateLayout(data)
+	if err != nil {
+		return nil, err
+	}
+	if lay.L4Offset == 0 {
+		return nil, fmt.Errorf("template has no UDP/TCP header to resize")
+	}
+	payloadLen := frameLen - lay.PayloadOffset
+	if payloadLen < 0 {
+		return nil, fmt.Errorf("frame length %d is below the header size %d", frameLen, lay.PayloadOffset)
+	}
+
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	// the payload as bounded by the IP length, without ethernet padding
+	var old []byte
+	if app := packet.ApplicationLayer(); app != nil {
+		old = app.Payload()
+	}
+	payload := make([]byte, payloadLen)
+	if len(old) > 0 {
+		for i := 0; i < payloadLen; i += len(old) {
+			copy(payload[i:], old)
+		}
+	}
+
+	var (
+		ls []gopacket.SerializableLayer
+		nl gopacket.NetworkLayer
+	)
+	for _, l := range packet.Layers() {
+		switch v := l.(type) {
+		case *layers.IPv4:
+			nl = v
+		case *layers.IPv6:
+			nl = v
+		case *layers.UDP:
+			if err := v.SetNetworkLayerForChecksum(nl); err != nil {
+				return nil, err
+			}
+		case *layers.TCP:
+			if err := v.SetNetworkLayerForChecksum(nl); err != nil {
+				return nil, err
+			}
+		}
+		sl, ok := l.(gopacket.SerializableLayer)
+		if !ok {
+			return nil, fmt.Errorf("layer %s cannot be serialized", l.LayerType())
+		}
+		ls = append(ls, sl)
+		if l.LayerType() == layers.LayerTypeUDP || l.LayerType() == layers.LayerTypeTCP {
+			break
+		}
+	}
+	ls = append(ls, gopacket.Payload(payload))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		return nil, fmt.Errorf("failed to serialize resized template: %w", err)
+	}
+	out := buf.Bytes()
+	if len(out) != frameLen {
+		return nil, fmt.Errorf("resized template is %d bytes, want %d", len(out), frameLen)
+	}
+	return append([]byte(nil), out...), nil
+}
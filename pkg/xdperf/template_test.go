@@ -0,0 +1,211 @@
+package xdperf
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testSrcMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	testDstMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+// testFrame serializes an Ethernet frame over IPv4 or IPv6 with a UDP or TCP
+// header, checksums computed.
+func testFrame(t testing.TB, ipv6 bool, tcp bool, payload []byte) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	var l3 gopacket.NetworkLayer
+	var l3s gopacket.SerializableLayer
+	proto := layers.IPProtocolUDP
+	if tcp {
+		proto = layers.IPProtocolTCP
+	}
+	if ipv6 {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: proto,
+			SrcIP:      net.ParseIP("2001:db8::1"),
+			DstIP:      net.ParseIP("2001:db8::2"),
+		}
+		l3, l3s = ip, ip
+	} else {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: proto,
+			SrcIP:    net.IPv4(192, 0, 2, 1),
+			DstIP:    net.IPv4(192, 0, 2, 2),
+		}
+		l3, l3s = ip, ip
+	}
+	var l4 gopacket.SerializableLayer
+	if tcp {
+		h := &layers.TCP{SrcPort: 1000, DstPort: 2000, Seq: 1, SYN: true, Window: 1024}
+		if err := h.SetNetworkLayerForChecksum(l3); err != nil {
+			t.Fatal(err)
+		}
+		l4 = h
+	} else {
+		h := &layers.UDP{SrcPort: 1000, DstPort: 2000}
+		if err := h.SetNetworkLayerForChecksum(l3); err != nil {
+			t.Fatal(err)
+		}
+		l4 = h
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, l3s, l4, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReverseTemplate(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 9}
+	tests := []struct {
+		name      string
+		ipv6, tcp bool
+	}{
+		{"ipv4 udp", false, false},
+		{"ipv4 tcp", false, true},
+		{"ipv6 udp", true, false},
+		{"ipv6 tcp", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := testFrame(t, tt.ipv6, tt.tcp, []byte("xdperf reverse test"))
+			orig := append([]byte(nil), in...)
+			out, err := reverseTemplate(in, mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(in, orig) {
+				t.Error("input template modified")
+			}
+
+			pkt := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+			if el := pkt.ErrorLayer(); el != nil {
+				t.Fatalf("failed to decode: %v", el.Error())
+			}
+			eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+			if !bytes.Equal(eth.DstMAC, testSrcMAC) || !bytes.Equal(eth.SrcMAC, mac) {
+				t.Errorf("MACs = %v -> %v, want %v -> %v", eth.SrcMAC, eth.DstMAC, mac, testSrcMAC)
+			}
+			src, dst := pkt.NetworkLayer().NetworkFlow().Endpoints()
+			if src.String() != "192.0.2.2" && src.String() != "2001:db8::2" {
+				t.Errorf("source address %v, want the original destination", src)
+			}
+			if dst.String() != "192.0.2.1" && dst.String() != "2001:db8::1" {
+				t.Errorf("destination address %v, want the original source", dst)
+			}
+			sp, dp := pkt.TransportLayer().TransportFlow().Endpoints()
+			if sp.String() != "2000" || dp.String() != "1000" {
+				t.Errorf("ports %v -> %v, want 2000 -> 1000", sp, dp)
+			}
+
+			// the checksums of the reversed frame are still valid
+			want := testReserialize(t, out)
+			if !bytes.Equal(out, want) {
+				t.Errorf("checksums do not match a freshly serialized frame")
+			}
+		})
+	}
+}
+
+func TestReverseTemplateBadMAC(t *testing.T) {
+	in := testFrame(t, false, false, []byte("payload"))
+	if _, err := reverseTemplate(in, net.HardwareAddr{1, 2, 3}); err == nil {
+		t.Error("want an error for a short MAC address")
+	}
+}
+
+// testReserialize re-serializes a frame with its checksums recomputed.
+func testReserialize(t *testing.T, data []byte) []byte {
+	t.Helper()
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	var ls []gopacket.SerializableLayer
+	for _, l := range pkt.Layers() {
+		switch v := l.(type) {
+		case *layers.UDP:
+			if err := v.SetNetworkLayerForChecksum(pkt.NetworkLayer()); err != nil {
+				t.Fatal(err)
+			}
+		case *layers.TCP:
+			if err := v.SetNetworkLayerForChecksum(pkt.NetworkLayer()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if s, ok := l.(gopacket.SerializableLayer); ok {
+			ls = append(ls, s)
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResizeTemplate(t *testing.T) {
+	// fill repeats s up to n bytes
+	fill := func(s string, n int) string {
+		return strings.Repeat(s, n/len(s)+1)[:n]
+	}
+	tests := []struct {
+		name      string
+		ipv6, tcp bool
+		payload   string
+		frameLen  int
+		want      string // payload of the result
+		wantErr   bool
+	}{
+		{name: "grow", payload: "abc", frameLen: 100, want: fill("abc", 58)},
+		{name: "shrink", payload: fill("abcdefgh", 40), frameLen: 64, want: fill("abcdefgh", 22)},
+		{name: "same", payload: fill("abc", 30), frameLen: 72, want: fill("abc", 30)},
+		{name: "from empty", payload: "", frameLen: 64, want: fill("\x00", 22)},
+		{name: "ipv6 tcp", ipv6: true, tcp: true, payload: "xy", frameLen: 79, want: "xyxyx"},
+		{name: "below ethernet minimum", payload: "abc", frameLen: 50, wantErr: true},
+		{name: "below headers", payload: "abc", frameLen: 41, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := testFrame(t, tt.ipv6, tt.tcp, []byte(tt.payload))
+			out, err := resizeTemplate(in, tt.frameLen)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want an error, got %d bytes", len(out))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != tt.frameLen {
+				t.Fatalf("%d bytes, want %d", len(out), tt.frameLen)
+			}
+			pkt := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+			if el := pkt.ErrorLayer(); el != nil {
+				t.Fatalf("failed to decode: %v", el.Error())
+			}
+			var payload []byte
+			if app := pkt.ApplicationLayer(); app != nil {
+				payload = app.Payload()
+			}
+			if string(payload) != tt.want {
+				t.Errorf("payload %q, want %q", payload, tt.want)
+			}
+			// lengths and checksums match a freshly serialized frame
+			if want := testReserialize(t, out); !bytes.Equal(out, want) {
+				t.Error("lengths or checksums not recomputed")
+			}
+		})
+	}
+}
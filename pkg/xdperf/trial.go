@@ -0,0 +1,218 @@
+package xdperf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"github.com/takehaya/xdperf/pkg/rfc2544"
+	"go.uber.org/zap"
+)
+
+// probePayloadSize is the payload asked from the plugin to learn its header
+// overhead.
+const probePayloadSize = 64
+
+// PrepareTrials arms the receiver of a trial series: the peer over the
+// control channel or xdp_rx on the local RX device.
+func (x *Xdperf) PrepareTrials(ctx context.Context) error {
+	x.trialTemplates = make(map[string][]*TxOverrideEntry)
+	if x.cfg.Peer != "" {
+		return nil
+	}
+	if x.cfg.RxDevice == "" {
+		return fmt.Errorf("trials need a peer or a local rx device")
+	}
+	dev, err := net.InterfaceByName(x.cfg.RxDevice)
+	if err != nil {
+		return fmt.Errorf("failed get rx device %s: %w", x.cfg.RxDevice, err)
+	}
+	l, err := x.attachRXTo(dev)
+	if err != nil {
+		return err
+	}
+	x.cleanupFnList = append(x.cleanupFnList, func(ctx context.Context) error {
+		return l.Close()
+	})
+	x.Logger.Info("rx program attached", zap.String("device", dev.Name))
+	return nil
+}
+
+// sizedTemplates returns templates of exactly frameLen bytes (without FCS)
+// by adjusting the plugin's payload_size. overrides are passed to the plugin
+// as well; name identifies them in the cache.
+func (x *Xdperf) sizedTemplates(ctx context.Context, name string, frameLen int, overrides map[string]interface{}) ([]*TxOverrideEntry, error) {
+	cacheKey := fmt.Sprintf("%s/%d", name, frameLen)
+	if entries, ok := x.trialTemplates[cacheKey]; ok {
+		return entries, nil
+	}
+
+	input := make(map[string]interface{}, len(overrides)+1)
+	for k, v := range overrides {
+		input[k] = v
+	}
+	input["payload_size"] = probePayloadSize
+	probe, err := x.callPlugin(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(probe) == 0 {
+		return nil, fmt.Errorf("plugin returned no template")
+	}
+	overhead := int(probe[0].Template.BasePacket.Length) - probePayloadSize
+	payload := frameLen - overhead
+	if payload < 0 {
+		return nil, fmt.Errorf("frame length %d is below the plugin's header size %d", frameLen, overhead)
+	}
+
+	input["payload_size"] = payload
+	resp, err := x.callPlugin(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := x.convToTxOverrideEntry(resp)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if int(e.Length) != frameLen {
+			return nil, fmt.Errorf("plugin does not honor payload_size: got %d bytes, want %d", e.Length, frameLen)
+		}
+	}
+	x.trialTemplates[cacheKey] = entries
+	return entries, nil
+}
+
+// stampedCopies returns copies of the templates with the stamp layout set
+// when seq or latency is stamped.
+func (x *Xdperf) stampedCopies(cached []*TxOverrideEntry) ([]*TxOverrideEntry, error) {
+	entries := make([]*TxOverrideEntry, 0, len(cached))
+	for _, c := range cached {
+		e := &TxOverrideEntry{Data: c.Data, Length: c.Length}
+		if err := copyModifiers(e, c); err != nil {
+			return nil, err
+		}
+		if x.cfg.Seq || x.cfg.Latency {
+			if err := x.setStampLayout(e); err != nil {
+				return nil, fmt.Errorf("frame too small for a stamp: %w", err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// RunTrial sends one RFC 2544 trial and counts what the receiver got.
+func (x *Xdperf) RunTrial(ctx context.Context, t rfc2544.Trial) (*rfc2544.TrialResult, error) {
+	cached, err := x.sizedTemplates(ctx, "", t.FrameSize-rfc2544.FCSLen, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	x.cfg.Latency = t.Latency
+	x.txStreamGroups = nil
+	entries, err := x.stampedCopies(cached)
+	if err != nil {
+		return nil, err
+	}
+	if err := x.initEbpfMap(entries); err != nil {
+		return nil, err
+	}
+	if err := zeroPerCPU[coreelf.BpfDatarec](x.bpfobjs.StatsMap, 1); err != nil {
+		return nil, fmt.Errorf("failed to reset tx stats map: %w", err)
+	}
+
+	spec := txSpec{RatePPS: t.RatePPS, Duration: t.Duration}
+	if t.Count > 0 {
+		spec = txSpec{Count: t.Count}
+	}
+
+	if x.cfg.Peer != "" {
+		return x.runPeerTrial(ctx, spec)
+	}
+	return x.runLocalTrial(ctx, spec)
+}
+
+func (x *Xdperf) runPeerTrial(ctx context.Context, spec txSpec) (*rfc2544.TrialResult, error) {
+	params := x.testParams(nil)
+	params.Duration = spec.Duration
+	params.Count = int(spec.Count)
+	conn, err := x.connectPeer(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := x.transmit(ctx, spec); err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+
+	res, err := x.finishPeer(ctx, conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	sent, _, err := readStats(x.bpfobjs.StatsMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tx stats: %w", err)
+	}
+	tr := &rfc2544.TrialResult{Sent: sent, Received: res.RxPackets, Elapsed: elapsed}
+	if res.Latency != nil {
+		tr.Latency = res.Latency.trialLatency()
+	}
+	return tr, nil
+}
+
+func (x *Xdperf) runLocalTrial(ctx context.Context, spec txSpec) (*rfc2544.TrialResult, error) {
+	if err := x.initRxConfigMap(); err != nil {
+		return nil, err
+	}
+	if err := x.resetRxStats(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	if err := x.transmit(ctx, spec); err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	time.Sleep(drainTime)
+
+	sent, _, err := readStats(x.bpfobjs.StatsMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tx stats: %w", err)
+	}
+	received, _, err := readStats(x.bpfobjs.RxStatsMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rx stats: %w", err)
+	}
+	tr := &rfc2544.TrialResult{Sent: sent, Received: received, Elapsed: elapsed}
+	if x.cfg.Latency {
+		snap, err := x.readLatency()
+		if err != nil {
+			return nil, err
+		}
+		if snap.Count > 0 {
+			sum := snap.Summary()
+			tr.Latency = sum.trialLatency()
+		}
+	}
+	return tr, nil
+}
+
+func (s *LatencySummary) trialLatency() *rfc2544.Latency {
+	if s.Count == 0 {
+		return nil
+	}
+	return &rfc2544.Latency{
+		Min:  s.Min,
+		Mean: s.Mean,
+		P50:  s.P50,
+		P99:  s.P99,
+		P999: s.P999,
+		Max:  s.Max,
+	}
+}
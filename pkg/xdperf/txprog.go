@@ -0,0 +1,140 @@
+package xdperf
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/takehaya/xdperf/pkg/coreelf"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// A user TX program (--tx-prog) replaces the variants of
+// choiceTXBPFProgram. Its maps named like xdperf's are replaced by
+// xdperf's, so it reads the loaded templates and per-cpu state and its
+// packets are counted like those of the built-in programs.
+
+// txProgRequired are the maps a user TX program must declare.
+var txProgRequired = []string{"tx_override_map", "seq_state_map", "stats_map"}
+
+// txProgSized are the maps sized by xdperf at load time, see loadTxMaps.
+// Their max_entries in the object do not matter.
+var txProgSized = map[string]bool{
+	"tx_override_map": true,
+	"tx_tail_map":     true,
+	"tx_index_map":    true,
+	"mod_state_map":   true,
+}
+
+// xdpProgSpec reads the object at path and returns it with the name of the
+// XDP program in section, or of its only XDP program when section is empty.
+func xdpProgSpec(path, section string) (*ebpf.CollectionSpec, string, error) {
+	spec, err := ebpf.LoadCollectionSpec(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var names []string
+	for name, p := range spec.Programs {
+		if p.Type != ebpf.XDP {
+			continue
+		}
+		if section == "" || p.SectionName == section || name == section {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	switch {
+	case len(names) == 0 && section == "":
+		return nil, "", fmt.Errorf("%s has no XDP program", path)
+	case len(names) == 0:
+		return nil, "", fmt.Errorf("%s has no XDP program in section %q", path, section)
+	case len(names) > 1:
+		return nil, "", fmt.Errorf("%s has several XDP programs (%s), select one by section",
+			path, strings.Join(names, ", "))
+	}
+	return spec, names[0], nil
+}
+
+// loadXDPProg loads the program name of spec alone, with its maps and the
+// given replacements.
+func loadXDPProg(spec *ebpf.CollectionSpec, name string, replacements map[string]*ebpf.Map) (*ebpf.Program, error) {
+	for n := range spec.Programs {
+		if n != name {
+			delete(spec.Programs, n)
+		}
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{MapReplacements: replacements})
+	if err != nil {
+		var verr *ebpf.VerifierError
+		if errors.As(err, &verr) {
+			fmt.Printf("%+v\n", verr)
+		}
+		return nil, err
+	}
+	defer coll.Close()
+	return coll.DetachProgram(name), nil
+}
+
+// txProgSpec reads --tx-prog and checks that it declares the required maps.
+func txProgSpec(path, section string) (*ebpf.CollectionSpec, string, error) {
+	spec, name, err := xdpProgSpec(path, section)
+	if err != nil {
+		return nil, "", fmt.Errorf("tx program: %w", err)
+	}
+	for _, m := range txProgRequired {
+		if _, ok := spec.Maps[m]; !ok {
+			return nil, "", fmt.Errorf("tx program %s does not declare the %s map", path, m)
+		}
+	}
+	return spec, name, nil
+}
+
+// loadTxProg loads --tx-prog with xdperf's maps in place of its own. The
+// template maps must be sized first, loadTxMaps drops the program when it
+// resizes them.
+func (x *Xdperf) loadTxProg() error {
+	spec, name, err := txProgSpec(x.cfg.TxProg, x.cfg.TxSection)
+	if err != nil {
+		return err
+	}
+	ps := spec.Programs[name]
+	if x.maxTxLen() > maxTemplateSize && ps.Flags&unix.BPF_F_XDP_HAS_FRAGS == 0 {
+		return fmt.Errorf("templates over %d bytes need a program in an xdp.frags section, %s is in %s",
+			maxTemplateSize, name, ps.SectionName)
+	}
+	shared := coreelf.TxMaps(x.bpfobjs)
+	replacements := make(map[string]*ebpf.Map)
+	for n, ms := range spec.Maps {
+		m, ok := shared[n]
+		if !ok {
+			continue
+		}
+		if txProgSized[n] {
+			ms.MaxEntries = m.MaxEntries()
+		}
+		if err := ms.Compatible(m); err != nil {
+			return fmt.Errorf("map %s of %s does not match xdperf's (see src/xdp_prog.h): %w", n, x.cfg.TxProg, err)
+		}
+		replacements[n] = m
+	}
+
+	prog, err := loadXDPProg(spec, name, replacements)
+	if err != nil {
+		return fmt.Errorf("failed to load tx program %s: %w", x.cfg.TxProg, err)
+	}
+	x.txProg = prog
+	x.Logger.Info("tx program loaded", zap.String("path", x.cfg.TxProg), zap.String("program", name),
+		zap.Int("shared_maps", len(replacements)))
+	return nil
+}
+
+// closeTxProg drops the loaded --tx-prog.
+func (x *Xdperf) closeTxProg() {
+	if x.txProg != nil {
+		x.txProg.Close()
+		x.txProg = nil
+	}
+}
@@ -0,0 +1,42 @@
+package xdperf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTxProgSpec(t *testing.T) {
+	// xdperf's own object, one program in xdp.frags and several in xdp
+	const obj = "../coreelf/bpf_bpfel.o"
+	tests := []struct {
+		name    string
+		path    string
+		section string
+		want    string
+		wantErr string
+	}{
+		{name: "unique section", path: obj, section: "xdp.frags", want: "xdp_tx_frags"},
+		{name: "program name", path: obj, section: "xdp_rx", want: "xdp_rx"},
+		{name: "ambiguous section", path: obj, section: "xdp", wantErr: "several XDP programs"},
+		{name: "no section", path: obj, wantErr: "select one by section"},
+		{name: "missing section", path: obj, section: "xdp.nope", wantErr: `no XDP program in section "xdp.nope"`},
+		{name: "missing object", path: "testdata/none.o", wantErr: "failed to read testdata/none.o"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, name, err := txProgSpec(tt.path, tt.section)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.want || spec.Programs[name] == nil {
+				t.Errorf("program %q, want %q", name, tt.want)
+			}
+		})
+	}
+}
@@ -7,18 +7,20 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"runtime"
-	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/takehaya/xdperf/pkg/control"
 	"github.com/takehaya/xdperf/pkg/coreelf"
 	"github.com/takehaya/xdperf/pkg/logger"
 	"github.com/takehaya/xdperf/pkg/plugin"
+	"github.com/takehaya/xdperf/pkg/sysinfo"
 	"go.uber.org/zap"
-	"golang.org/x/sys/unix"
+	"golang.org/x/text/message"
 )
 
 type CancelFunc func(ctx context.Context) error
@@ -29,6 +31,34 @@ type Xdperf struct {
 	bpfobjs       *coreelf.BpfObjects
 	Device        *net.Interface
 	cfg           Config
+
+	// trial state (rfc2544, y1564)
+	trialTemplates map[string][]*TxOverrideEntry
+	// txStreamGroups overrides the stream group stamped by each cpu
+	txStreamGroups []uint32
+
+	// txRatePPS is the paced TX rate of runTXPacket, 0 = as fast as possible
+	txRatePPS float64
+	// pluginRatePPS is the rate suggested by the plugin metadata
+	pluginRatePPS uint64
+	// distribution is the template strategy of the run, see distribute.go
+	distribution string
+	// txCPUs is the cpu of every TX worker, see placement.go
+	txCPUs []int
+	// txQueues is the device queue of every TX worker
+	txQueues []int
+	// liveFrameMax caches liveFrameLimit
+	liveFrameMax int
+	// txSets are the templates last loaded for the workers, set w%len is
+	// sent by worker w
+	txSets [][]*TxOverrideEntry
+	// txSizes are the sizes of the loaded template maps, see loadTxMaps
+	txSizes coreelf.TxSizes
+	// txProg is the loaded --tx-prog, see txprog.go
+	txProg *ebpf.Program
+
+	// RX_F_* currently programmed into rx_config_map
+	rxFlags atomic.Uint32
 }
 
 func NewXdperf(cfg Config) (*Xdperf, error) {
@@ -53,6 +83,13 @@ func NewXdperf(cfg Config) (*Xdperf, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to load eBPF objects: %w", err)
 	}
+	if cfg.TxProg != "" {
+		// fail before the run, the program is loaded with the templates
+		if _, _, err := txProgSpec(cfg.TxProg, cfg.TxSection); err != nil {
+			obj.Close()
+			return nil, err
+		}
+	}
 	cleanupFnList = append(cleanupFnList, func(ctx context.Context) error {
 		return obj.Close()
 	})
@@ -82,7 +119,10 @@ type GeneratorResponse struct {
 }
 
 type PacketTemplate struct {
-	BasePacket BasePacket `json:"base_packet"`
+	BasePacket BasePacket               `json:"base_packet"`
+	Layers     []plugin.LayerDefinition `json:"layers"`
+	Modifiers  []plugin.ModifierDef     `json:"modifiers"`
+	Checksums  []plugin.ChecksumDef     `json:"checksums"`
 }
 
 type BasePacket struct {
@@ -91,27 +131,186 @@ type BasePacket struct {
 }
 
 type Metadata struct {
-	PacketCount uint64 `json:"packet_count"`
-	RatePPS     uint64 `json:"rate_pps"`
+	PacketCount  uint64             `json:"packet_count"`
+	RatePPS      uint64             `json:"rate_pps"`
+	IMIX         *plugin.IMIXConfig `json:"imix,omitempty"`
+	CPU          *uint32            `json:"cpu,omitempty"`          // TX cpu of the template for cpu-hint
+	Distribution string             `json:"distribution,omitempty"` // default strategy of the templates
 }
 
 func (x *Xdperf) StartClient(ctx context.Context) error {
 	x.Logger.Info("start client mode")
 
-	resp, err := x.callPlugin(ctx)
+	entries, err := x.prepareTemplates(ctx)
 	if err != nil {
-		x.Logger.Error("failed to load plugin", zap.Error(err))
 		return err
 	}
+
+	// in reverse mode the server transmits and the client only receives
+	transmit := !x.cfg.Reverse
+	receive := x.cfg.Reverse || x.cfg.Bidir || x.cfg.RTT
+
+	var tracker *seqTracker
+	if receive {
+		// reflected or reverse packets come back on the same device
+		l, err := x.attachRX()
+		if err != nil {
+			x.Logger.Error("failed to attach rx program", zap.Error(err))
+			return err
+		}
+		defer l.Close()
+		x.Logger.Info("rx program attached")
+
+		tracker = newSeqTracker()
+		trackCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			if err := tracker.run(trackCtx, x.bpfobjs.RxSeqEvents, x.Logger); err != nil {
+				x.Logger.Error("seq tracker stopped", zap.Error(err))
+			}
+		}()
+	}
+
+	if transmit {
+		// cpu hints name the cpu of a worker
+		if err := x.placeWorkers(); err != nil {
+			return fmt.Errorf("failed to place tx workers: %w", err)
+		}
+		sets, err := distributeTemplates(entries, x.txCPUs, x.distribution)
+		if err != nil {
+			return err
+		}
+		x.Logger.Info("templates distributed", zap.String("distribution", x.distribution), zap.Int("sets", len(sets)))
+		if err := x.initEbpfMapSets(sets); err != nil {
+			x.Logger.Error("failed to init ebpf map", zap.Error(err))
+			return err
+		}
+		x.Logger.Info("ebpf map initialization successful")
+	}
+
+	// in reverse mode the rate paces the server
+	if x.txRatePPS, err = x.targetRatePPS(entries); err != nil {
+		return err
+	}
+	if x.txRatePPS > 0 {
+		x.Logger.Info("tx pacing enabled", zap.Float64("rate_pps", x.txRatePPS))
+	}
+
+	var peer *control.Conn
+	var serverTX chan error
+	if x.cfg.Peer != "" {
+		peer, err = x.connectPeer(ctx, x.testParams(entries))
+		if err != nil {
+			x.Logger.Error("failed to negotiate with peer", zap.Error(err))
+			return err
+		}
+		defer peer.Close()
+	}
+
+	if transmit {
+		if err := x.runTXPacket(ctx); err != nil {
+			x.Logger.Error("failed to run TX packet", zap.Error(err))
+			return err
+		}
+		x.Logger.Info("TX packet processing started")
+	} else {
+		statsCtx, cancel := context.WithCancel(ctx)
+		go x.ShowRxStats(statsCtx)
+		if x.cfg.Duration > 0 {
+			var stop context.CancelFunc
+			statsCtx, stop = context.WithTimeout(statsCtx, x.cfg.Duration)
+			defer stop()
+		}
+		if peer != nil {
+			// the server reports when it stops, e.g. after --count packets
+			serverTX = make(chan error, 1)
+			go func() {
+				err := peer.Recv(ctx, control.TypeTxDone, nil)
+				cancel()
+				serverTX <- err
+			}()
+		}
+		waitSignal(statsCtx)
+		cancel()
+	}
+
+	var res *TestResults
+	if peer != nil {
+		res, err = x.finishPeer(ctx, peer, serverTX)
+		if err != nil {
+			x.Logger.Error("failed to get results from peer", zap.Error(err))
+			return err
+		}
+	}
+
+	if transmit && res != nil {
+		txPackets, txBytes, err := readStats(x.bpfobjs.StatsMap)
+		if err != nil {
+			return fmt.Errorf("failed to read tx stats: %w", err)
+		}
+		printTestSummary("client -> server", txPackets, txBytes, res)
+	}
+	if receive && !x.cfg.RTT {
+		local, err := x.collectResults("", tracker, nil)
+		if err != nil {
+			return err
+		}
+		if res != nil {
+			local.TestID = res.TestID
+			printTestSummary("server -> client", res.TxPackets, res.TxBytes, local)
+		} else {
+			printTestSummary("received", 0, 0, local)
+		}
+	}
+	if x.cfg.RTT {
+		if err := x.printLatency(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareTemplates calls the plugin and converts its response into TX entries.
+func (x *Xdperf) prepareTemplates(ctx context.Context) ([]*TxOverrideEntry, error) {
+	resp, err := x.callPlugin(ctx, nil)
+	if err != nil {
+		x.Logger.Error("failed to load plugin", zap.Error(err))
+		return nil, err
+	}
 	x.Logger.Info("plugin call successful", zap.Any("response", resp))
 
+	// every template may suggest the rate of its own stream
+	x.pluginRatePPS = 0
+	for _, r := range resp {
+		x.pluginRatePPS += r.Metadata.RatePPS
+	}
+
 	entries, err := x.convToTxOverrideEntry(resp)
 	if err != nil {
 		x.Logger.Error("failed to convert to tx override entry", zap.Error(err))
-		return err
+		return nil, err
 	}
 	x.Logger.Info("conversion to tx override entry successful", zap.Int("entry_count", len(entries)))
 
+	// --imix takes precedence over the mix suggested by the plugin
+	patterns, err := ParseIMIX(x.cfg.IMIX)
+	if err != nil {
+		return nil, err
+	}
+	if patterns == nil {
+		patterns = pluginIMIX(resp)
+	}
+	x.distribution = distribution(x.cfg.Distribution, resp)
+	if patterns != nil {
+		if x.distribution != distReplicate {
+			return nil, fmt.Errorf("imix cannot be combined with the %s distribution", x.distribution)
+		}
+		if entries, err = x.applyIMIX(patterns, entries); err != nil {
+			return nil, err
+		}
+		x.Logger.Info("imix schedule built", zap.Int("patterns", len(patterns)), zap.Int("slots", len(entries)))
+	}
+
 	for i, e := range entries {
 		packet := gopacket.NewPacket(e.Data, layers.LayerTypeEthernet, gopacket.Default)
 		x.Logger.Info("constructed packet from entry", zap.Int("entry_index", i))
@@ -119,23 +318,12 @@ func (x *Xdperf) StartClient(ctx context.Context) error {
 			x.Logger.Info("packet layer", zap.String("layer_type", fmt.Sprintf("%T", layer)), zap.Any("layer", layer))
 		}
 	}
-
-	if err := x.initEbpfMap(entries); err != nil {
-		x.Logger.Error("failed to init ebpf map", zap.Error(err))
-		return err
-	}
-	x.Logger.Info("ebpf map initialization successful")
-
-	if err := x.runTXPacket(ctx); err != nil {
-		x.Logger.Error("failed to run TX packet", zap.Error(err))
-		return err
-	}
-	x.Logger.Info("TX packet processing started")
-
-	return nil
+	return entries, nil
 }
 
-func (x *Xdperf) callPlugin(ctx context.Context) ([]*GeneratorResponse, error) {
+// callPlugin asks the plugin for templates. The input is the plugin config
+// file, the required params and overrides, in increasing priority.
+func (x *Xdperf) callPlugin(ctx context.Context, overrides map[string]interface{}) ([]*GeneratorResponse, error) {
 	wasmPlugin, err := x.PluginManager.GetPlugin(x.cfg.PluginName)
 	if err != nil {
 		return nil, fmt.Errorf("failed get plugin: %w", err)
@@ -145,9 +333,14 @@ func (x *Xdperf) callPlugin(ctx context.Context) ([]*GeneratorResponse, error) {
 	x.Logger.Info("testing simple plugin communication")
 
 	// test input
-	input := map[string]interface{}{
-		"count":           x.cfg.Count,
-		"device_mac_addr": x.Device.HardwareAddr,
+	input := map[string]interface{}{}
+	for k, v := range x.cfg.LoadedPluginConfig {
+		input[k] = v
+	}
+	input["count"] = x.cfg.Count
+	input["device_mac_addr"] = x.Device.HardwareAddr
+	for k, v := range overrides {
+		input[k] = v
 	}
 
 	x.Logger.Info("calling plugin", zap.Any("input", input))
@@ -188,99 +381,163 @@ func (x *Xdperf) convToTxOverrideEntry(resp []*GeneratorResponse) ([]*TxOverride
 		entry := &TxOverrideEntry{
 			Data:   data,
 			Length: r.Template.BasePacket.Length,
+			CPU:    r.Metadata.CPU,
+		}
+		if err := compileModifiers(entry, r.Template.Modifiers, r.Template.Layers); err != nil {
+			return nil, fmt.Errorf("failed to compile modifiers: %w", err)
+		}
+		skip, err := checksumSkip(data[:entry.Length], r.Template.Checksums)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum defs: %w", err)
+		}
+		entry.CsumSkip = skip
+		if x.cfg.Seq || x.cfg.Latency {
+			if err := x.setStampLayout(entry); err != nil {
+				return nil, fmt.Errorf("failed to place sequence stamp: %w", err)
+			}
 		}
 		entries = append(entries, entry)
 	}
 	return entries, nil
 }
 
+// choiceTXBPFProgram returns the cheapest TX program that does what the
+// loaded templates need:
+//   - xdp_tx_fixed: one template per worker without rewrites, the live
+//     frames are the template itself so nothing is copied
+//   - xdp_tx_multi: several templates copied in turn
+//   - xdp_tx_mods: field modifiers
+//   - xdp_tx: field modifiers and sequence / timestamp stamps
+//   - xdp_tx_frags: xdp_tx for templates over maxTemplateSize
+//
+// --tx-prog replaces them all.
 func (x *Xdperf) choiceTXBPFProgram() *ebpf.Program {
-	// For simplicity, we always use TX program here.
-	// In the future, we may choose different programs based on the plugin response.
-	return x.bpfobjs.XdpTx
+	switch {
+	case x.txProg != nil:
+		return x.txProg
+	case x.maxTxLen() > maxTemplateSize:
+		return x.bpfobjs.XdpTxFrags
+	case x.txStamped():
+		return x.bpfobjs.XdpTx
+	case x.txModified():
+		return x.bpfobjs.XdpTxMods
+	case x.txFixed():
+		return x.bpfobjs.XdpTxFixed
+	default:
+		return x.bpfobjs.XdpTxMulti
+	}
 }
 
-func (x *Xdperf) runTXPacket(ctx context.Context) error {
-	in, err := x.BuildSamplePacket()
-	if err != nil {
-		return fmt.Errorf("failed to build sample packet: %w", err)
+// txStamped reports whether a loaded template gets a sequence or timestamp
+// stamp.
+func (x *Xdperf) txStamped() bool {
+	if !x.cfg.Seq && !x.cfg.Latency {
+		return false
 	}
-	// TODO: カウント数 / スレッド数 にして送信しているが、あまりの部分については超えるようにケアする必要がある
-	runOpts := &ebpf.RunOptions{
-		Data:   in,
-		Repeat: uint32(x.cfg.Count / x.cfg.Parallelism),
-		Flags:  unix.BPF_F_TEST_XDP_LIVE_FRAMES,
+	for _, set := range x.txSets {
+		for _, e := range set {
+			if e.StampOff != 0 {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	var wg sync.WaitGroup
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go x.ShowStats(ctx)
-	prog := x.choiceTXBPFProgram()
+// txModified reports whether a loaded template has field modifiers.
+func (x *Xdperf) txModified() bool {
+	for _, set := range x.txSets {
+		for _, e := range set {
+			if len(e.Mods) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	for i := range x.cfg.Parallelism {
-		p, err := prog.Clone()
-		if err != nil {
-			return fmt.Errorf("failed to clone XDP program: %w", err)
+// txFixed reports whether every worker sends a single template as it is.
+// The live frame pages are only initialised once, so xdp_tx_fixed is not
+// used on veth where the peer can hand a page back modified.
+func (x *Xdperf) txFixed() bool {
+	if len(x.txSets) == 0 || x.txModified() || x.txStamped() {
+		return false
+	}
+	for _, set := range x.txSets {
+		for _, e := range set[1:] {
+			if e != set[0] {
+				return false
+			}
 		}
-		wg.Add(1)
-		go func(cpu int) {
-			defer wg.Done()
-			go func() {
-				defer p.Close()
-				if err := x.run(ctx, cpu, p, runOpts); err != nil {
-					fmt.Printf("error in run: %v\n", err)
-				}
-			}()
-			<-ctx.Done()
-		}(i)
 	}
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	<-sig
-	x.Logger.Info("Exec done. Shutting down client...")
-	cancel()
-	wg.Wait()
+	drv, _, err := sysinfo.Driver(x.Device.Name)
+	return err != nil || drv != "veth"
+}
 
-	return nil
+// txFrame returns the test run data of worker w: its template for
+// xdp_tx_fixed, otherwise a frame the TX program overwrites.
+func (x *Xdperf) txFrame(prog *ebpf.Program, w int) ([]byte, error) {
+	if prog == x.bpfobjs.XdpTxFixed {
+		e := x.txSets[w%len(x.txSets)][0]
+		return e.Data[:e.Length], nil
+	}
+	return x.BuildSamplePacket()
 }
 
-func (x *Xdperf) run(ctx context.Context, cpu int, xdpProg *ebpf.Program, runOpts *ebpf.RunOptions) error {
-	runtime.LockOSThread()
-	var cpuset unix.CPUSet
-	cpuset.Set(cpu)
-	if err := unix.SchedSetaffinity(unix.Gettid(), &cpuset); err != nil {
-		return fmt.Errorf("failed to set CPU affinity: %v", err)
+// runTXPacket transmits until --count or --duration is reached, ctx is
+// done or SIGINT/SIGTERM arrives, then prints a summary.
+func (x *Xdperf) runTXPacket(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go x.ShowStats(ctx)
+	go func() {
+		waitSignal(ctx)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := x.transmit(ctx, txSpec{
+		RatePPS:  x.txRatePPS,
+		Duration: x.cfg.Duration,
+		Count:    uint64(x.cfg.Count),
+	})
+	elapsed := time.Since(start)
+	cancel()
+	x.Logger.Info("Exec done. Shutting down client...")
+	if err != nil {
+		return fmt.Errorf("transmission failed: %w", err)
 	}
-	ret, err := xdpProg.Run(runOpts)
+	return x.printTxSummary(elapsed)
+}
+
+// printTxSummary prints the TX counters and the average rate of a run.
+func (x *Xdperf) printTxSummary(elapsed time.Duration) error {
+	packets, bytes, err := readStats(x.bpfobjs.StatsMap)
 	if err != nil {
-		return fmt.Errorf("bpf_prog_run failed: %w", err)
-	}
-	if ret != 0 {
-		return fmt.Errorf("bpf_prog_run returned non-zero: %d", ret)
-	}
-
-	// interval := float64(time.Second) * float64(x.cfg.Count) * float64(x.cfg.Parallelism) / float64(x.cfg.PPS)
-	// ticker := time.NewTicker(time.Duration(interval))
-	// defer ticker.Stop()
-	// for {
-	// 	select {
-	// 	case <-ticker.C:
-	// 		ret, err := xdpProg.Run(runOpts)
-	// 		if err != nil {
-	// 			return fmt.Errorf("bpf_prog_run failed: %w", err)
-	// 		}
-	// 		if ret != 0 {
-	// 			return fmt.Errorf("bpf_prog_run returned non-zero: %d", ret)
-	// 		}
-	// 	case <-ctx.Done():
-	// 		return nil
-	// 	}
-	// }
+		return fmt.Errorf("failed to read tx stats: %w", err)
+	}
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	secs := elapsed.Seconds()
+	p.Printf("sent %d packets, %d bytes in %v\n", packets, bytes, elapsed.Round(time.Millisecond))
+	if secs > 0 {
+		p.Printf("average %.0f pps, %.2f Mbps\n", float64(packets)/secs, float64(bytes*8)/secs/1e6)
+	}
 	return nil
 }
 
+// waitSignal blocks until SIGINT/SIGTERM or ctx is done.
+func waitSignal(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case <-sig:
+	case <-ctx.Done():
+	}
+}
+
 func (x *Xdperf) Close() {
+	x.closeTxProg()
 	for _, fn := range x.cleanupFnList {
 		if err := fn(context.Background()); err != nil {
 			x.Logger.Error("failed to cleanup", zap.Error(err))
@@ -0,0 +1,74 @@
+package y1564
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+func verdict(pass bool, reason string) string {
+	if pass {
+		return "PASS"
+	}
+	if reason == "" {
+		return "FAIL"
+	}
+	return "FAIL " + reason
+}
+
+func delay(d Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return time.Duration(d).String()
+}
+
+// WriteText prints the report as service configuration and performance
+// tables.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ITU-T Y.1564 service activation test")
+	fmt.Fprintln(w)
+
+	if len(r.Configuration) > 0 {
+		fmt.Fprintln(w, "Service configuration test")
+		fmt.Fprintln(tw, "Service\tStep\tOffered (Mbps)\tIR (Mbps)\tFLR (%)\tFTD\tFDV\tResult\t")
+		for _, c := range r.Configuration {
+			for _, st := range c.Steps {
+				step := st.Kind
+				if st.Kind == StepCIR {
+					step = fmt.Sprintf("cir %.0f%%", st.Percent)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%.2f\t%.2f\t%.4f\t%s\t%s\t%s\t\n",
+					c.Service, step, st.OfferedMbps, st.IRMbps, st.FLR,
+					delay(st.FTD), delay(st.FDV), verdict(st.Pass, st.Reason))
+			}
+			if c.Error != "" {
+				fmt.Fprintf(tw, "%s\t\t\t\t\t\t\tERROR %s\t\n", c.Service, c.Error)
+			}
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Performance) > 0 || r.PerformanceError != "" {
+		fmt.Fprintln(w, "Service performance test")
+		if r.PerformanceError != "" {
+			fmt.Fprintf(w, "ERROR %s\n", r.PerformanceError)
+		}
+		if len(r.Performance) > 0 {
+			fmt.Fprintln(tw, "Service\tIR (Mbps)\tFLR (%)\tFTD\tFDV\tAvailability (%)\tResult\t")
+			for _, p := range r.Performance {
+				fmt.Fprintf(tw, "%s\t%.2f\t%.4f\t%s\t%s\t%.3f\t%s\t\n",
+					p.Service, p.IRMbps, p.FLR, delay(p.FTD), delay(p.FDV),
+					p.Availability, verdict(p.Pass, p.Reason))
+			}
+			tw.Flush()
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Overall: %s\n", verdict(r.Pass, ""))
+	return nil
+}
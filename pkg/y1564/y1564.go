@@ -0,0 +1,514 @@
+// Package y1564 implements the Ethernet service activation test methodology
+// of ITU-T Y.1564 (EtherSAM): a service configuration test stepping every
+// service through CIR, EIR and policing, followed by a service performance
+// test of all services at once.
+package y1564
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type Test string
+
+const (
+	TestConfiguration Test = "configuration"
+	TestPerformance   Test = "performance"
+)
+
+var AllTests = []Test{TestConfiguration, TestPerformance}
+
+// DefaultCIRSteps are the CIR steps in percent of the service configuration
+// test.
+var DefaultCIRSteps = []float64{25, 50, 75, 100}
+
+const (
+	// policingOvershoot is added to CIR+EIR in the policing step, in
+	// percent of CIR.
+	policingOvershoot = 25
+
+	// a second is severely errored above this frame loss ratio (Y.1563)
+	sesThreshold = 0.5
+	// consecutive severely errored seconds that start an unavailable
+	// period, and consecutive other seconds that end it
+	unavailableSeconds = 10
+)
+
+// Duration is a time.Duration read from a string such as "10ms" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10ms\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Acceptance is the service acceptance criteria (SAC) of a service. Zero
+// values are not checked.
+type Acceptance struct {
+	FLR          float64  `json:"flr_percent"`          // frame loss ratio
+	FTD          Duration `json:"ftd"`                  // mean frame transfer delay
+	FDV          Duration `json:"fdv"`                  // frame delay variation
+	Availability float64  `json:"availability_percent"` // performance test only
+}
+
+// Service is one service under test. PluginConfig is passed to the plugin
+// to build the frames of the service.
+type Service struct {
+	Name         string                 `json:"name"`
+	FrameSize    int                    `json:"frame_size"` // bytes including FCS
+	CIR          float64                `json:"cir_mbps"`
+	EIR          float64                `json:"eir_mbps"`
+	PluginConfig map[string]interface{} `json:"plugin_config"`
+	Acceptance   Acceptance             `json:"acceptance"`
+}
+
+// PPS converts an information rate in Mbps to frames per second.
+func (s *Service) PPS(mbps float64) float64 {
+	return mbps * 1e6 / float64(s.FrameSize*8)
+}
+
+// LoadServices reads a JSON file of the form {"services": [...]}.
+func LoadServices(path string) ([]Service, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read services file: %w", err)
+	}
+	var f struct {
+		Services []Service `json:"services"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse services file: %w", err)
+	}
+	return f.Services, nil
+}
+
+// Load is one service transmitting at a fixed rate during a step. ID is the
+// index of the service and tells the services apart at the receiver.
+type Load struct {
+	ID      int
+	Service *Service
+	RatePPS float64
+}
+
+type Step struct {
+	Loads    []Load
+	Duration time.Duration
+}
+
+// Interval is what a service received during one second.
+type Interval struct {
+	Received uint64
+	Lost     uint64
+}
+
+type Latency struct {
+	Min  time.Duration `json:"min"`
+	Mean time.Duration `json:"mean"`
+	P99  time.Duration `json:"p99"`
+	Max  time.Duration `json:"max"`
+}
+
+// Measurement is the outcome of a step for one load.
+type Measurement struct {
+	Sent      uint64
+	Received  uint64
+	Elapsed   time.Duration
+	Latency   *Latency
+	Intervals []Interval
+}
+
+// Tester runs steps against the network under test. The measurements are
+// in the order of the step's loads.
+type Tester interface {
+	RunStep(ctx context.Context, s Step) ([]Measurement, error)
+}
+
+type Config struct {
+	Tests               []Test
+	Services            []Service
+	CIRSteps            []float64 // percent of CIR
+	StepDuration        time.Duration
+	PerformanceDuration time.Duration
+	Margin              float64 // accepted information rate deviation in percent
+	SkipPolicing        bool
+	Progress            func(format string, args ...interface{})
+}
+
+func (c *Config) Validate() error {
+	if len(c.Services) == 0 {
+		return fmt.Errorf("no services")
+	}
+	names := make(map[string]bool)
+	for i, s := range c.Services {
+		if s.Name == "" {
+			return fmt.Errorf("service %d has no name", i)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate service %s", s.Name)
+		}
+		names[s.Name] = true
+		if s.FrameSize < 64 {
+			return fmt.Errorf("service %s: frame size %d is below the ethernet minimum of 64", s.Name, s.FrameSize)
+		}
+		if s.CIR <= 0 {
+			return fmt.Errorf("service %s: cir must be positive", s.Name)
+		}
+		if s.EIR < 0 {
+			return fmt.Errorf("service %s: eir must not be negative", s.Name)
+		}
+		a := s.Acceptance
+		if a.FLR < 0 || a.FLR > 100 || a.Availability < 0 || a.Availability > 100 || a.FTD < 0 || a.FDV < 0 {
+			return fmt.Errorf("service %s: invalid acceptance criteria", s.Name)
+		}
+	}
+	if len(c.CIRSteps) == 0 {
+		return fmt.Errorf("no cir steps")
+	}
+	for _, p := range c.CIRSteps {
+		if p <= 0 || p > 100 {
+			return fmt.Errorf("cir step %v must be between 0 and 100", p)
+		}
+	}
+	if c.StepDuration <= 0 || c.PerformanceDuration <= 0 {
+		return fmt.Errorf("durations must be positive")
+	}
+	if c.Margin < 0 || c.Margin >= 100 {
+		return fmt.Errorf("margin must be between 0 and 100")
+	}
+	return nil
+}
+
+func (c *Config) has(t Test) bool {
+	for _, tt := range c.Tests {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) progress(format string, args ...interface{}) {
+	if c.Progress != nil {
+		c.Progress(format, args...)
+	}
+}
+
+const (
+	StepCIR      = "cir"
+	StepEIR      = "eir"
+	StepPolicing = "policing"
+)
+
+// StepResult is one step of the service configuration test.
+type StepResult struct {
+	Kind        string   `json:"kind"`
+	Percent     float64  `json:"percent,omitempty"` // of CIR for cir steps
+	OfferedMbps float64  `json:"offered_mbps"`
+	IRMbps      float64  `json:"ir_mbps"`
+	FLR         float64  `json:"flr_percent"`
+	FTD         Duration `json:"ftd,omitempty"`
+	FDV         Duration `json:"fdv,omitempty"`
+	Pass        bool     `json:"pass"`
+	Reason      string   `json:"reason,omitempty"`
+}
+
+type ConfigurationResult struct {
+	Service string       `json:"service"`
+	Steps   []StepResult `json:"steps"`
+	Pass    bool         `json:"pass"`
+	Error   string       `json:"error,omitempty"`
+}
+
+type PerformanceResult struct {
+	Service      string   `json:"service"`
+	IRMbps       float64  `json:"ir_mbps"`
+	FLR          float64  `json:"flr_percent"`
+	FTD          Duration `json:"ftd,omitempty"`
+	FDV          Duration `json:"fdv,omitempty"`
+	Availability float64  `json:"availability_percent"`
+	Pass         bool     `json:"pass"`
+	Reason       string   `json:"reason,omitempty"`
+}
+
+type Report struct {
+	Configuration []ConfigurationResult `json:"configuration,omitempty"`
+	Performance   []PerformanceResult   `json:"performance,omitempty"`
+	// PerformanceError is set when the performance test could not run.
+	PerformanceError string `json:"performance_error,omitempty"`
+	Pass             bool   `json:"pass"`
+}
+
+// Run executes the selected tests. A failing service is recorded in the
+// report and the suite continues; only context cancellation aborts it. The
+// report of a cancelled run holds the services tested so far, the
+// interrupted one included, and does not pass.
+func Run(ctx context.Context, t Tester, cfg Config) (*Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	r := &Report{Pass: true}
+	if cfg.has(TestConfiguration) {
+		for i := range cfg.Services {
+			res := configuration(ctx, t, &cfg, i)
+			r.Pass = r.Pass && res.Pass
+			r.Configuration = append(r.Configuration, res)
+			if err := ctx.Err(); err != nil {
+				r.Pass = false
+				return r, err
+			}
+		}
+	}
+	if cfg.has(TestPerformance) {
+		res, err := performance(ctx, t, &cfg)
+		if err != nil {
+			r.PerformanceError = err.Error()
+			r.Pass = false
+		}
+		for _, p := range res {
+			r.Pass = r.Pass && p.Pass
+		}
+		r.Performance = res
+		if err := ctx.Err(); err != nil {
+			r.Pass = false
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// FLR is the frame loss ratio in percent.
+func (m *Measurement) FLR() float64 {
+	if m.Sent == 0 || m.Received >= m.Sent {
+		return 0
+	}
+	return float64(m.Sent-m.Received) * 100 / float64(m.Sent)
+}
+
+// IRMbps is the received information rate of frames of the given size.
+func (m *Measurement) IRMbps(frameSize int) float64 {
+	if m.Elapsed <= 0 {
+		return 0
+	}
+	return float64(m.Received) * float64(frameSize*8) / m.Elapsed.Seconds() / 1e6
+}
+
+// delays returns FTD (mean delay) and FDV (p99 minus minimum delay).
+func (m *Measurement) delays() (ftd, fdv time.Duration, ok bool) {
+	if m.Latency == nil {
+		return 0, 0, false
+	}
+	return m.Latency.Mean, m.Latency.P99 - m.Latency.Min, true
+}
+
+// checkSAC compares FLR, FTD and FDV to the acceptance criteria and returns
+// the first violation.
+func checkSAC(a Acceptance, flr float64, ftd, fdv time.Duration, haveDelay bool) string {
+	if flr > a.FLR {
+		return fmt.Sprintf("flr %.4f%% > %.4f%%", flr, a.FLR)
+	}
+	if (a.FTD > 0 || a.FDV > 0) && !haveDelay {
+		return "no delay samples"
+	}
+	if a.FTD > 0 && ftd > time.Duration(a.FTD) {
+		return fmt.Sprintf("ftd %v > %v", ftd, time.Duration(a.FTD))
+	}
+	if a.FDV > 0 && fdv > time.Duration(a.FDV) {
+		return fmt.Sprintf("fdv %v > %v", fdv, time.Duration(a.FDV))
+	}
+	return ""
+}
+
+func (c *Config) runOne(ctx context.Context, t Tester, id int, mbps float64) (*Measurement, error) {
+	s := &c.Services[id]
+	ms, err := t.RunStep(ctx, Step{
+		Loads:    []Load{{ID: id, Service: s, RatePPS: s.PPS(mbps)}},
+		Duration: c.StepDuration,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ms) != 1 {
+		return nil, fmt.Errorf("tester returned %d measurements for 1 load", len(ms))
+	}
+	return &ms[0], nil
+}
+
+func configuration(ctx context.Context, t Tester, cfg *Config, id int) ConfigurationResult {
+	s := &cfg.Services[id]
+	res := ConfigurationResult{Service: s.Name, Pass: true}
+	margin := cfg.Margin / 100
+
+	add := func(st StepResult) {
+		res.Pass = res.Pass && st.Pass
+		res.Steps = append(res.Steps, st)
+		verdict := "pass"
+		if !st.Pass {
+			verdict = "fail: " + st.Reason
+		}
+		cfg.progress("y1564 configuration %s %s %.1f Mbps: ir %.1f Mbps, flr %.4f%%, %s",
+			s.Name, st.Kind, st.OfferedMbps, st.IRMbps, st.FLR, verdict)
+	}
+	measure := func(kind string, pct, mbps float64) (*Measurement, StepResult, bool) {
+		m, err := cfg.runOne(ctx, t, id, mbps)
+		if err != nil {
+			res.Pass = false
+			res.Error = err.Error()
+			return nil, StepResult{}, false
+		}
+		st := StepResult{
+			Kind:        kind,
+			Percent:     pct,
+			OfferedMbps: mbps,
+			IRMbps:      m.IRMbps(s.FrameSize),
+			FLR:         m.FLR(),
+		}
+		if ftd, fdv, ok := m.delays(); ok {
+			st.FTD, st.FDV = Duration(ftd), Duration(fdv)
+		}
+		return m, st, true
+	}
+
+	// CIR steps: every SAC must hold
+	for _, pct := range cfg.CIRSteps {
+		mbps := s.CIR * pct / 100
+		m, st, ok := measure(StepCIR, pct, mbps)
+		if !ok {
+			return res
+		}
+		ftd, fdv, haveDelay := m.delays()
+		st.Reason = checkSAC(s.Acceptance, st.FLR, ftd, fdv, haveDelay)
+		if st.Reason == "" && st.IRMbps < mbps*(1-margin) {
+			st.Reason = fmt.Sprintf("ir %.1f Mbps below %.1f Mbps", st.IRMbps, mbps)
+		}
+		st.Pass = st.Reason == ""
+		add(st)
+	}
+
+	// EIR step: at least CIR must get through, excess frames may be lost
+	if s.EIR > 0 {
+		_, st, ok := measure(StepEIR, 0, s.CIR+s.EIR)
+		if !ok {
+			return res
+		}
+		if st.IRMbps < s.CIR*(1-margin) {
+			st.Reason = fmt.Sprintf("ir %.1f Mbps below cir %.1f Mbps", st.IRMbps, s.CIR)
+		}
+		st.Pass = st.Reason == ""
+		add(st)
+	}
+
+	// policing step: the overshoot must be policed down to CIR+EIR
+	if !cfg.SkipPolicing {
+		limit := s.CIR + s.EIR
+		_, st, ok := measure(StepPolicing, 0, limit+s.CIR*policingOvershoot/100)
+		if !ok {
+			return res
+		}
+		switch {
+		case st.IRMbps > limit*(1+margin):
+			st.Reason = fmt.Sprintf("ir %.1f Mbps above cir+eir %.1f Mbps, not policed", st.IRMbps, limit)
+		case st.IRMbps < s.CIR*(1-margin):
+			st.Reason = fmt.Sprintf("ir %.1f Mbps below cir %.1f Mbps", st.IRMbps, s.CIR)
+		}
+		st.Pass = st.Reason == ""
+		add(st)
+	}
+	return res
+}
+
+func performance(ctx context.Context, t Tester, cfg *Config) ([]PerformanceResult, error) {
+	step := Step{Duration: cfg.PerformanceDuration}
+	for i := range cfg.Services {
+		s := &cfg.Services[i]
+		step.Loads = append(step.Loads, Load{ID: i, Service: s, RatePPS: s.PPS(s.CIR)})
+	}
+	cfg.progress("y1564 performance: %d services for %v", len(step.Loads), cfg.PerformanceDuration)
+	ms, err := t.RunStep(ctx, step)
+	if err != nil {
+		return nil, err
+	}
+	if len(ms) != len(step.Loads) {
+		return nil, fmt.Errorf("tester returned %d measurements for %d loads", len(ms), len(step.Loads))
+	}
+
+	results := make([]PerformanceResult, 0, len(ms))
+	for i := range ms {
+		s, m := &cfg.Services[i], &ms[i]
+		pr := PerformanceResult{
+			Service:      s.Name,
+			IRMbps:       m.IRMbps(s.FrameSize),
+			FLR:          m.FLR(),
+			Availability: Availability(m.Intervals),
+		}
+		ftd, fdv, haveDelay := m.delays()
+		if haveDelay {
+			pr.FTD, pr.FDV = Duration(ftd), Duration(fdv)
+		}
+		pr.Reason = checkSAC(s.Acceptance, pr.FLR, ftd, fdv, haveDelay)
+		if pr.Reason == "" && s.Acceptance.Availability > 0 && pr.Availability < s.Acceptance.Availability {
+			pr.Reason = fmt.Sprintf("availability %.3f%% < %.3f%%", pr.Availability, s.Acceptance.Availability)
+		}
+		pr.Pass = pr.Reason == ""
+		results = append(results, pr)
+	}
+	return results, nil
+}
+
+// Availability returns the percentage of available seconds following
+// Y.1563: a second is severely errored when more than half of its frames
+// are lost or none arrive, 10 consecutive severely errored seconds start an
+// unavailable period and 10 consecutive other seconds end it.
+func Availability(intervals []Interval) float64 {
+	if len(intervals) == 0 {
+		return 0
+	}
+	ses := make([]bool, len(intervals))
+	for i, iv := range intervals {
+		total := iv.Received + iv.Lost
+		ses[i] = iv.Received == 0 || float64(iv.Lost)/float64(total) > sesThreshold
+	}
+
+	// run reports whether the next unavailableSeconds seconds from i are
+	// all severely errored (v) or all not (!v)
+	run := func(i int, v bool) bool {
+		if i+unavailableSeconds > len(ses) {
+			return false
+		}
+		for _, e := range ses[i : i+unavailableSeconds] {
+			if e != v {
+				return false
+			}
+		}
+		return true
+	}
+
+	unavailable := 0
+	available := true
+	for i := 0; i < len(ses); {
+		if available && run(i, true) {
+			available = false
+		} else if !available && run(i, false) {
+			available = true
+		}
+		if !available {
+			unavailable++
+		}
+		i++
+	}
+	return float64(len(ses)-unavailable) * 100 / float64(len(ses))
+}
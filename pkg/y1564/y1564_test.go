@@ -0,0 +1,332 @@
+package y1564
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNetwork polices every service to limit Mbps (0 = no policer), or
+// down to overload Mbps when set, then loses a fixed percentage of the
+// frames.
+type fakeNetwork struct {
+	limit     float64
+	overload  float64
+	loss      float64 // percent
+	latency   *Latency
+	intervals []Interval
+	err       error
+	steps     []Step
+	// cancel is called instead of running step cancelAt (1-based)
+	cancel   func()
+	cancelAt int
+}
+
+func (n *fakeNetwork) RunStep(ctx context.Context, s Step) ([]Measurement, error) {
+	n.steps = append(n.steps, s)
+	if n.cancel != nil && len(n.steps) == n.cancelAt {
+		n.cancel()
+		return nil, ctx.Err()
+	}
+	if n.err != nil {
+		return nil, n.err
+	}
+	ms := make([]Measurement, len(s.Loads))
+	for i, l := range s.Loads {
+		recvPPS := l.RatePPS
+		if n.limit > 0 && recvPPS > l.Service.PPS(n.limit) {
+			recvPPS = l.Service.PPS(n.limit)
+			if n.overload > 0 {
+				recvPPS = l.Service.PPS(n.overload)
+			}
+		}
+		ms[i] = Measurement{
+			Sent:      uint64(l.RatePPS * s.Duration.Seconds()),
+			Received:  uint64(recvPPS * s.Duration.Seconds() * (1 - n.loss/100)),
+			Elapsed:   s.Duration,
+			Latency:   n.latency,
+			Intervals: n.intervals,
+		}
+	}
+	return ms, nil
+}
+
+func testService(eir float64, a Acceptance) Service {
+	return Service{Name: "svc", FrameSize: 1000, CIR: 100, EIR: eir, Acceptance: a}
+}
+
+func testConfig(tests []Test, services ...Service) Config {
+	return Config{
+		Tests:               tests,
+		Services:            services,
+		CIRSteps:            DefaultCIRSteps,
+		StepDuration:        time.Second,
+		PerformanceDuration: 10 * time.Second,
+		Margin:              1,
+	}
+}
+
+func TestConfigurationSAC(t *testing.T) {
+	lat := &Latency{Min: 10 * time.Microsecond, Mean: 20 * time.Microsecond, P99: 50 * time.Microsecond, Max: 80 * time.Microsecond}
+	sac := Acceptance{FLR: 0.1, FTD: Duration(time.Millisecond), FDV: Duration(time.Millisecond)}
+
+	tests := []struct {
+		name     string
+		service  Service
+		net      fakeNetwork
+		pass     bool
+		failStep string // kind of the first failing step
+		reason   string
+	}{
+		{
+			name:    "policed at cir",
+			service: testService(0, sac),
+			net:     fakeNetwork{limit: 100, latency: lat},
+			pass:    true,
+		},
+		{
+			name:    "policed at cir+eir",
+			service: testService(50, sac),
+			net:     fakeNetwork{limit: 150, latency: lat},
+			pass:    true,
+		},
+		{
+			name:    "loss within flr",
+			service: testService(0, sac),
+			net:     fakeNetwork{limit: 100, loss: 0.05, latency: lat},
+			pass:    true,
+		},
+		{
+			name:     "not policed",
+			service:  testService(50, sac),
+			net:      fakeNetwork{latency: lat},
+			failStep: StepPolicing,
+			reason:   "not policed",
+		},
+		{
+			name:     "loss above flr",
+			service:  testService(0, sac),
+			net:      fakeNetwork{limit: 100, loss: 1, latency: lat},
+			failStep: StepCIR,
+			reason:   "flr",
+		},
+		{
+			name:     "below cir",
+			service:  testService(0, Acceptance{FLR: 100}),
+			net:      fakeNetwork{limit: 60},
+			failStep: StepCIR,
+			reason:   "below",
+		},
+		{
+			name:     "eir below cir",
+			service:  testService(50, Acceptance{FLR: 100}),
+			net:      fakeNetwork{limit: 100, overload: 80},
+			failStep: StepEIR,
+			reason:   "below cir",
+		},
+		{
+			name:     "ftd",
+			service:  testService(0, Acceptance{FTD: Duration(10 * time.Microsecond)}),
+			net:      fakeNetwork{limit: 100, latency: lat},
+			failStep: StepCIR,
+			reason:   "ftd",
+		},
+		{
+			name:     "fdv",
+			service:  testService(0, Acceptance{FDV: Duration(30 * time.Microsecond)}),
+			net:      fakeNetwork{limit: 100, latency: lat},
+			failStep: StepCIR,
+			reason:   "fdv",
+		},
+		{
+			name:     "no delay samples",
+			service:  testService(0, sac),
+			net:      fakeNetwork{limit: 100},
+			failStep: StepCIR,
+			reason:   "no delay samples",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig([]Test{TestConfiguration}, tt.service)
+			rep, err := Run(context.Background(), &tt.net, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := rep.Configuration[0]
+			if res.Pass != tt.pass || rep.Pass != tt.pass {
+				t.Fatalf("pass = %v, report pass = %v, want %v: %+v", res.Pass, rep.Pass, tt.pass, res.Steps)
+			}
+			// 4 cir steps, the eir step and the policing step
+			want := len(cfg.CIRSteps) + 1
+			if tt.service.EIR > 0 {
+				want++
+			}
+			if len(res.Steps) != want {
+				t.Errorf("%d steps, want %d", len(res.Steps), want)
+			}
+			if tt.pass {
+				return
+			}
+			for _, st := range res.Steps {
+				if st.Pass {
+					continue
+				}
+				if st.Kind != tt.failStep || !strings.Contains(st.Reason, tt.reason) {
+					t.Errorf("first failure %s: %q, want %s: %q", st.Kind, st.Reason, tt.failStep, tt.reason)
+				}
+				return
+			}
+			t.Error("no failing step")
+		})
+	}
+}
+
+func TestConfigurationSteps(t *testing.T) {
+	net := &fakeNetwork{limit: 150}
+	cfg := testConfig([]Test{TestConfiguration}, testService(50, Acceptance{}))
+	if _, err := Run(context.Background(), net, cfg); err != nil {
+		t.Fatal(err)
+	}
+	// 25/50/75/100% of cir, cir+eir, cir+eir plus a quarter of cir
+	want := []float64{25, 50, 75, 100, 150, 175}
+	if len(net.steps) != len(want) {
+		t.Fatalf("%d steps, want %d", len(net.steps), len(want))
+	}
+	for i, st := range net.steps {
+		l := st.Loads[0]
+		if got := l.RatePPS * 1000 * 8 / 1e6; math.Abs(got-want[i]) > 1e-9 {
+			t.Errorf("step %d offers %.1f Mbps, want %.1f", i, got, want[i])
+		}
+		if st.Duration != cfg.StepDuration {
+			t.Errorf("step %d lasts %v, want %v", i, st.Duration, cfg.StepDuration)
+		}
+	}
+}
+
+func TestPerformanceSAC(t *testing.T) {
+	good := make([]Interval, 10)
+	for i := range good {
+		good[i] = Interval{Received: 12500}
+	}
+	bad := make([]Interval, 20)
+	for i := range bad {
+		bad[i] = Interval{Received: 12500}
+		if i >= 10 {
+			bad[i] = Interval{Lost: 12500}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		sac    Acceptance
+		net    fakeNetwork
+		pass   bool
+		reason string
+	}{
+		{"pass", Acceptance{Availability: 99}, fakeNetwork{limit: 100, intervals: good}, true, ""},
+		{"flr", Acceptance{}, fakeNetwork{limit: 100, loss: 1, intervals: good}, false, "flr"},
+		{"availability", Acceptance{FLR: 100, Availability: 99}, fakeNetwork{limit: 100, intervals: bad}, false, "availability"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svcs := []Service{testService(0, tt.sac), testService(0, tt.sac)}
+			svcs[1].Name = "svc2"
+			cfg := testConfig([]Test{TestPerformance}, svcs...)
+			rep, err := Run(context.Background(), &tt.net, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.net.steps) != 1 || len(tt.net.steps[0].Loads) != 2 {
+				t.Fatalf("want one step with both services, got %+v", tt.net.steps)
+			}
+			if rep.Pass != tt.pass || len(rep.Performance) != 2 {
+				t.Fatalf("pass = %v, want %v: %+v", rep.Pass, tt.pass, rep.Performance)
+			}
+			for _, pr := range rep.Performance {
+				if pr.Pass != tt.pass || !strings.Contains(pr.Reason, tt.reason) {
+					t.Errorf("%s: pass = %v %q, want %v %q", pr.Service, pr.Pass, pr.Reason, tt.pass, tt.reason)
+				}
+			}
+		})
+	}
+}
+
+func TestPerformanceError(t *testing.T) {
+	cfg := testConfig(AllTests, testService(0, Acceptance{}))
+	rep, err := Run(context.Background(), &fakeNetwork{err: errors.New("no peer")}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Pass || rep.Configuration[0].Error != "no peer" || rep.PerformanceError != "no peer" {
+		t.Errorf("report %+v", rep)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	svcs := []Service{testService(0, Acceptance{}), testService(0, Acceptance{}), testService(0, Acceptance{})}
+	svcs[1].Name, svcs[2].Name = "svc2", "svc3"
+	cfg := testConfig(AllTests, svcs...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the second step of the second service is interrupted, every service
+	// runs the cir steps and the policing step
+	steps := len(cfg.CIRSteps) + 1
+	net := &fakeNetwork{limit: 100, cancel: cancel, cancelAt: steps + 2}
+
+	rep, err := Run(ctx, net, cfg)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	if rep == nil {
+		t.Fatal("no partial report")
+	}
+	if rep.Pass {
+		t.Error("an interrupted run passes")
+	}
+	if len(rep.Configuration) != 2 || !rep.Configuration[0].Pass || rep.Configuration[1].Error == "" {
+		t.Errorf("configuration %+v, want the first service and the interrupted second one", rep.Configuration)
+	}
+	if len(rep.Performance) != 0 || rep.PerformanceError != "" {
+		t.Errorf("performance ran after the interruption: %+v %q", rep.Performance, rep.PerformanceError)
+	}
+	if len(net.steps) != net.cancelAt {
+		t.Errorf("%d steps, want none after step %d", len(net.steps), net.cancelAt)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	// seconds of the given pattern: '.' without loss, 'x' severely errored
+	intervals := func(pattern string) []Interval {
+		ivs := make([]Interval, len(pattern))
+		for i, c := range pattern {
+			ivs[i] = Interval{Received: 100}
+			if c == 'x' {
+				ivs[i] = Interval{Received: 40, Lost: 60}
+			}
+		}
+		return ivs
+	}
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    float64
+	}{
+		{"empty", "", 0},
+		{"all available", "..........", 100},
+		{"short errored burst", ".........xxxxxxxxx..", 100},
+		{"unavailable period", "xxxxxxxxxx..........", 50},
+		{"ends after ten good seconds", "xxxxxxxxxx.....x..........", 100 * 10.0 / 26},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Availability(intervals(tt.pattern)); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Availability(%s) = %v, want %v", tt.pattern, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "encoding/json"
+
 // plugin Request (configuration structure)
 type GeneratorRequest struct {
 	SrcIP       string `json:"src_ip" default:"192.168.1.1"`
@@ -8,6 +10,10 @@ type GeneratorRequest struct {
 	DstPort     uint16 `json:"dst_port" default:"5678"`
 	PayloadSize int    `json:"payload_size" default:"1024"`
 
+	// per-packet field modifiers and checksum defs, passed through to the template
+	Modifiers json.RawMessage `json:"modifiers"`
+	Checksums json.RawMessage `json:"checksums"`
+
 	// required param
 	Count         uint64 `json:"count" default:"1"`
 	DeviceMacAddr []byte `json:"device_mac_addr"`
@@ -20,7 +26,9 @@ type GeneratorResponse struct {
 }
 
 type PacketTemplate struct {
-	BasePacket BasePacket `json:"base_packet"`
+	BasePacket BasePacket      `json:"base_packet"`
+	Modifiers  json.RawMessage `json:"modifiers,omitempty"`
+	Checksums  json.RawMessage `json:"checksums,omitempty"`
 }
 
 type BasePacket struct {
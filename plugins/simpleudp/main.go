@@ -69,6 +69,8 @@ func plugin_process(inputPtr, inputLen, outputPtr, outputMaxLen uint32) int32 {
 					Data:   packetBytes,
 					Length: uint16(len(packetBytes)),
 				},
+				Modifiers: req.Modifiers,
+				Checksums: req.Checksums,
 			},
 			Metadata: Metadata{
 				PacketCount: 1,
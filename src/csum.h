@@ -0,0 +1,42 @@
+#ifndef XDP_CSUM_H
+#define XDP_CSUM_H
+#include <bpf/bpf_helpers.h>
+#include <linux/bpf.h>
+#include <stdbool.h>
+
+static __always_inline __u16 csum_fold(__u32 csum) {
+  csum = (csum & 0xffff) + (csum >> 16);
+  csum = (csum & 0xffff) + (csum >> 16);
+  return (__u16)~csum;
+}
+
+// Incrementally update the checksum at csum after the bytes old were replaced
+// by new (RFC 1624). len must be a multiple of 4 and the field must start on
+// an even offset from the checksummed area.
+static __always_inline void csum_replace(__u16 *csum, void *old, void *new,
+                                         __u32 len, bool udp) {
+  if (udp && *csum == 0) // checksum disabled
+    return;
+  __s64 diff = bpf_csum_diff(old, len, new, len, ~((__u32)*csum) & 0xffff);
+  if (diff < 0)
+    return;
+  __u16 res = csum_fold((__u32)diff);
+  if (udp && res == 0)
+    res = 0xffff;
+  *csum = res;
+}
+
+// Incrementally update the checksum at csum after the 16-bit word old was
+// replaced by new (RFC 1624, eqn. 3). The words are taken as stored.
+static __always_inline void csum_replace16(__u16 *csum, __u16 old, __u16 new,
+                                           bool udp) {
+  if (udp && *csum == 0) // checksum disabled
+    return;
+  __u32 sum = (__u16)~*csum + (__u16)~old + new;
+  __u16 res = csum_fold(sum);
+  if (udp && res == 0)
+    res = 0xffff;
+  *csum = res;
+}
+
+#endif // XDP_CSUM_H
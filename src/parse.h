@@ -0,0 +1,125 @@
+#ifndef XDP_PARSE_H
+#define XDP_PARSE_H
+#include <bpf/bpf_endian.h>
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/if_vlan.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/ipv6.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+
+struct vlan_hdr {
+  __be16 h_vlan_TCI;
+  __be16 h_vlan_encapsulated_proto;
+};
+
+struct hdr_cursor {
+  struct ethhdr *eth;
+  void *l3;
+  void *l4;
+  void *payload;
+  __u16 l3proto; // host byte order ETH_P_*
+  __u8 l4proto;  // IPPROTO_UDP or IPPROTO_TCP
+};
+
+// Parse up to the UDP/TCP payload. Returns 0 on success.
+// VLAN tags (up to two), IPv4 options and a bare IPv6 header are handled.
+static __always_inline int parse_packet(void *data, void *data_end,
+                                        struct hdr_cursor *h) {
+  struct ethhdr *eth = data;
+  if ((void *)(eth + 1) > data_end)
+    return -1;
+  h->eth = eth;
+
+  void *cur = eth + 1;
+  __u16 proto = eth->h_proto;
+#pragma unroll
+  for (int i = 0; i < 2; i++) {
+    if (proto != bpf_htons(ETH_P_8021Q) && proto != bpf_htons(ETH_P_8021AD))
+      break;
+    struct vlan_hdr *vh = cur;
+    if ((void *)(vh + 1) > data_end)
+      return -1;
+    proto = vh->h_vlan_encapsulated_proto;
+    cur = vh + 1;
+  }
+
+  h->l3 = cur;
+  h->l3proto = bpf_ntohs(proto);
+  if (proto == bpf_htons(ETH_P_IP)) {
+    struct iphdr *iph = cur;
+    if ((void *)(iph + 1) > data_end)
+      return -1;
+    __u32 ihl = iph->ihl * 4;
+    if (ihl < sizeof(*iph))
+      return -1;
+    h->l4proto = iph->protocol;
+    cur += ihl;
+  } else if (proto == bpf_htons(ETH_P_IPV6)) {
+    struct ipv6hdr *ip6h = cur;
+    if ((void *)(ip6h + 1) > data_end)
+      return -1;
+    h->l4proto = ip6h->nexthdr;
+    cur = ip6h + 1;
+  } else {
+    return -1;
+  }
+
+  h->l4 = cur;
+  if (h->l4proto == IPPROTO_UDP) {
+    struct udphdr *udph = cur;
+    if ((void *)(udph + 1) > data_end)
+      return -1;
+    h->payload = udph + 1;
+    return 0;
+  }
+  if (h->l4proto == IPPROTO_TCP) {
+    struct tcphdr *tcph = cur;
+    if ((void *)(tcph + 1) > data_end)
+      return -1;
+    __u32 doff = tcph->doff * 4;
+    if (doff < sizeof(*tcph))
+      return -1;
+    h->payload = cur + doff;
+    return 0;
+  }
+  return -1;
+}
+
+// Swap MAC, IP addresses and L4 ports so the frame goes back to its sender.
+// Checksums stay valid since the sums are order independent.
+static __always_inline void reflect_packet(void *data_end,
+                                           struct hdr_cursor *h) {
+  __u8 mac[ETH_ALEN];
+  __builtin_memcpy(mac, h->eth->h_dest, ETH_ALEN);
+  __builtin_memcpy(h->eth->h_dest, h->eth->h_source, ETH_ALEN);
+  __builtin_memcpy(h->eth->h_source, mac, ETH_ALEN);
+
+  if (h->l3proto == ETH_P_IP) {
+    struct iphdr *iph = h->l3;
+    if ((void *)(iph + 1) > data_end)
+      return;
+    __be32 addr = iph->saddr;
+    iph->saddr = iph->daddr;
+    iph->daddr = addr;
+  } else if (h->l3proto == ETH_P_IPV6) {
+    struct ipv6hdr *ip6h = h->l3;
+    if ((void *)(ip6h + 1) > data_end)
+      return;
+    struct in6_addr addr = ip6h->saddr;
+    ip6h->saddr = ip6h->daddr;
+    ip6h->daddr = addr;
+  }
+
+  // source and dest ports are the first 4 bytes for both UDP and TCP
+  __be16 *ports = h->l4;
+  if ((void *)(ports + 2) > data_end)
+    return;
+  __be16 port = ports[0];
+  ports[0] = ports[1];
+  ports[1] = port;
+}
+
+#endif // XDP_PARSE_H
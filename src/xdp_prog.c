@@ -1,4 +1,6 @@
 #include "xdp_prog.h"
+#include "csum.h"
+#include "parse.h"
 #include "xdpcap.h"
 
 #include <bpf/bpf_endian.h>
@@ -11,57 +13,275 @@
 
 char _license[] SEC("license") = "GPL";
 
-SEC("xdp")
-int xdp_tx(struct xdp_md *ctx) {
+// offset of a field of size bytes within the first MAX_TEMPLATE_SIZE bytes of
+// the frame, 0 = unset or out of range. clang tests the offset on a copy of
+// the register, so the verifier would not see the bound on the offset added
+// to the packet pointer: the mask, a no-op after the checks, restores it.
+static __always_inline __u32 template_off(__u32 off, __u32 size) {
+  if (off == 0 || off > MAX_TEMPLATE_SIZE - size)
+    return 0;
+  barrier_var(off);
+  return off & (MAX_TEMPLATE_SIZE - 1);
+}
+
+// write the per-cpu sequence / timestamp stamp and fix the L4 checksum
+static __always_inline int stamp_packet(void *data, void *data_end,
+                                        struct pkt_template *pt,
+                                        struct tx_config *cfg) {
+  __u32 off = template_off(pt->stamp_off, sizeof(struct xdperf_stamp));
+  if (off == 0)
+    return 0;
+
+  struct xdperf_stamp st = {
+      .magic = bpf_htonl(XDPERF_STAMP_MAGIC),
+      .stream_id =
+          bpf_htonl(cfg->stream_group << 16 | bpf_get_smp_processor_id()),
+  };
+  if (cfg->flags & TX_F_STAMP_SEQ) {
+    __u32 zero = 0;
+    __u64 *seq = bpf_map_lookup_elem(&tx_seq_map, &zero);
+    if (!seq)
+      return -1;
+    st.seq = bpf_cpu_to_be64(*seq);
+    (*seq)++;
+  }
+  if (cfg->flags & TX_F_STAMP_TS)
+    st.tstamp = bpf_cpu_to_be64(bpf_ktime_get_ns() + cfg->clock_offset);
+
+  void *sp = data + off;
+  if (sp + sizeof(st) > data_end)
+    return -1;
+
+  __u32 coff = template_off(pt->l4_csum_off, sizeof(__u16));
+  if (coff != 0) {
+    __u16 *csum = data + coff;
+    if ((void *)(csum + 1) > data_end)
+      return -1;
+    csum_replace(csum, pt->data + off, &st, sizeof(st),
+                 pt->l4_proto == IPPROTO_UDP);
+  }
+  __builtin_memcpy(sp, &st, sizeof(st));
+  return 0;
+}
+
+// apply the field modifiers of the template and fix the checksums covering
+// them, one 16-bit word at a time
+static __always_inline int apply_modifiers(void *data, void *data_end,
+                                           struct pkt_template *pt, __u32 idx,
+                                           struct tx_config *cfg) {
+  __u32 nr = pt->nr_mods;
+  if (nr == 0)
+    return 0;
+
+  __u64 n = 0;
+  __u64 *cnt = bpf_map_lookup_elem(&mod_state_map, &idx);
+  if (cnt) {
+    n = *cnt;
+    (*cnt)++;
+  }
+  __u64 k = n;
+  if (cfg && cfg->mod_stride)
+    k = n * cfg->mod_stride + cfg->mod_offset;
+
+  __u16 *ip_csum = NULL, *l4_csum = NULL;
+  __u32 coff = template_off(pt->ip_csum_off, sizeof(__u16));
+  if (coff != 0) {
+    ip_csum = data + coff;
+    if ((void *)(ip_csum + 1) > data_end)
+      return -1;
+  }
+  coff = template_off(pt->l4_csum_off, sizeof(__u16));
+  if (coff != 0) {
+    l4_csum = data + coff;
+    if ((void *)(l4_csum + 1) > data_end)
+      return -1;
+  }
+  bool udp = pt->l4_proto == IPPROTO_UDP;
+
+  for (int i = 0; i < MAX_MODIFIERS; i++) {
+    if (i >= nr)
+      break;
+    struct modifier *m = &pt->mods[i];
+    __u32 off = m->offset & ~1;
+    if (off > MAX_TEMPLATE_SIZE - 2 * sizeof(__u16))
+      return -1;
+    __u16 *w = data + off;
+    if ((void *)(w + 1) > data_end)
+      return -1;
+
+    __u64 r = m->op == MOD_OP_RANDOM ? bpf_get_prandom_u32() : k * m->step;
+    __u32 v = m->min + (m->span ? (__u32)(r % m->span) : (__u32)r);
+
+    // the second word is only touched inside the length check: the
+    // verifier does not tie a later m->len test to it
+    __u16 old0 = w[0], old1 = 0, new1 = 0;
+    bool wide = false;
+    switch (m->len) {
+    case 4:
+      if ((void *)(w + 2) > data_end)
+        return -1;
+      old1 = w[1];
+      new1 = bpf_htons(v);
+      w[0] = bpf_htons(v >> 16);
+      w[1] = new1;
+      wide = true;
+      break;
+    case 2:
+      w[0] = bpf_htons(v);
+      break;
+    default:
+      // constant indexes, w plus a variable one loses the packet range
+      if (m->offset & 1)
+        ((__u8 *)w)[1] = v;
+      else
+        ((__u8 *)w)[0] = v;
+    }
+
+    if ((m->flags & MOD_F_IP_CSUM) && ip_csum) {
+      csum_replace16(ip_csum, old0, w[0], false);
+      if (wide)
+        csum_replace16(ip_csum, old1, new1, false);
+    }
+    if ((m->flags & MOD_F_L4_CSUM) && l4_csum) {
+      csum_replace16(l4_csum, old0, w[0], udp);
+      if (wide)
+        csum_replace16(l4_csum, old1, new1, udp);
+    }
+  }
+  return 0;
+}
+
+// copy the template into the frame with at most two helper calls instead of
+// a per-byte loop: the first MAX_TEMPLATE_SIZE bytes from the template and
+// the rest, if any, from the tx_tail_map slot of the template.
+// bpf_xdp_store_bytes handles frames spanning several buffers. The copy is
+// not skipped for recycled live frame pages: a page can come back modified,
+// e.g. by a reflecting XDP program on a veth peer.
+static __always_inline int copy_template(struct xdp_md *ctx,
+                                         struct pkt_template *pt, __u32 tlen) {
+  // a clamp would be tested on a copy of the register passed to the
+  // helper, the mask (a no-op below MAX_TEMPLATE_SIZE) bounds it instead
+  __u32 head = MAX_TEMPLATE_SIZE;
+  if (tlen < MAX_TEMPLATE_SIZE)
+    head = tlen & (MAX_TEMPLATE_SIZE - 1);
+  if (head == 0)
+    return -1;
+  if (bpf_xdp_store_bytes(ctx, 0, pt->data, head) < 0)
+    return -1;
+  if (tlen <= MAX_TEMPLATE_SIZE)
+    return 0;
+
+  __u32 slot = pt->tail;
+  struct pkt_tail *tail = bpf_map_lookup_elem(&tx_tail_map, &slot);
+  if (!tail)
+    return -1;
+  // the barrier keeps the bound check clang would drop for the tlen one,
+  // which it tests on a copy of the register
+  __u64 rest = tlen - MAX_TEMPLATE_SIZE;
+  barrier_var(rest);
+  if (rest == 0 || rest > sizeof(tail->data))
+    return -1;
+  if (bpf_xdp_store_bytes(ctx, MAX_TEMPLATE_SIZE, tail->data, rest) < 0)
+    return -1;
+  return 0;
+}
+
+// the per-byte copy copy_template replaced, kept as the baseline of
+// xdp_tx_byteloop
+static __always_inline int copy_template_bytes(void *data, void *data_end,
+                                               struct pkt_template *pt,
+                                               __u32 tlen) {
+  for (int i = 0; i < MAX_TEMPLATE_SIZE; i++) {
+    if (i >= (int)tlen)
+      break;
+
+    void *dp = data + i;
+    if (dp + 1 > data_end)
+      return -1;
+
+    *(__u8 *)dp = pt->data[i];
+  }
+  return 0;
+}
+
+// features of a TX program variant, constant per entry point so that the
+// verifier never sees the code a variant does not use
+#define TX_PROG_FRAGS (1 << 0)    // multi-buffer frames
+#define TX_PROG_MODS (1 << 1)     // field modifiers
+#define TX_PROG_STAMP (1 << 2)    // sequence / timestamp stamps
+#define TX_PROG_BYTELOOP (1 << 3) // per-byte template copy, bench baseline
+
+// send the next template of this cpu
+static __always_inline int tx_template(struct xdp_md *ctx, __u32 feat) {
+  bool frags = feat & TX_PROG_FRAGS;
   void *data = (void *)(long)ctx->data;
   void *data_end = (void *)(long)ctx->data_end;
   __u32 zero = 0;
 
-  __u32 *pidx = bpf_map_lookup_elem(&seq_state_map, &zero);
-  __u32 idx = pidx ? *pidx : 0;
-  if (idx >= MAX_PACKET_ENTRY)
+  struct tx_state *st = bpf_map_lookup_elem(&seq_state_map, &zero);
+  __u32 idx = 0, count = 1;
+  if (st) {
+    count = st->count;
+    if (count == 0)
+      count = 1;
+    idx = st->order == TX_ORDER_RANDOM ? bpf_get_prandom_u32() % count
+                                       : st->idx;
+  }
+  if (idx >= count)
     idx = 0;
 
-  struct pkt_template *pt = bpf_map_lookup_elem(&tx_override_map, &idx);
+  __u32 *id = bpf_map_lookup_elem(&tx_index_map, &idx);
+  if (!id)
+    return XDP_ABORTED;
+  struct pkt_template *pt = bpf_map_lookup_elem(&tx_override_map, id);
   if (!pt)
     return XDP_ABORTED;
 
   __u32 tlen = pt->len;
-  if (tlen > MAX_TEMPLATE_SIZE)
-    tlen = MAX_TEMPLATE_SIZE;
+  __u32 max_len = frags ? MAX_FRAME_SIZE : MAX_TEMPLATE_SIZE;
+  if (tlen > max_len)
+    tlen = max_len;
 
-  __u32 cur_len = data_end - data;
+  __u32 cur_len = frags ? bpf_xdp_get_buff_len(ctx) : data_end - data;
   if (cur_len != tlen) {
     int delta = (int)tlen - (int)cur_len;
     if (bpf_xdp_adjust_tail(ctx, delta) < 0)
       return XDP_ABORTED;
     data = (void *)(long)ctx->data;
     data_end = (void *)(long)ctx->data_end;
-    if (data + tlen > data_end)
-      return XDP_ABORTED;
   }
 
   // override payload
-  if (data + tlen > data_end)
+  if (!frags && data + tlen > data_end)
+    return XDP_ABORTED;
+  if (feat & TX_PROG_BYTELOOP) {
+    if (copy_template_bytes(data, data_end, pt, tlen) < 0)
+      return XDP_ABORTED;
+  } else if (copy_template(ctx, pt, tlen) < 0) {
     return XDP_ABORTED;
+  }
 
-  for (int i = 0; i < MAX_TEMPLATE_SIZE; i++) {
-    if (i >= (int)tlen)
-      break;
+  // rewrites stay within the linear part and the first MAX_TEMPLATE_SIZE
+  // bytes of the template
+  struct tx_config *cfg = NULL;
+  if (feat & (TX_PROG_MODS | TX_PROG_STAMP))
+    cfg = bpf_map_lookup_elem(&tx_config_map, &zero);
+  if ((feat & TX_PROG_MODS) &&
+      apply_modifiers(data, data_end, pt, idx, cfg) < 0)
+    return XDP_ABORTED;
 
-    void *dp = data + i;
-    if (dp + 1 > data_end)
+  if ((feat & TX_PROG_STAMP) && cfg &&
+      (cfg->flags & (TX_F_STAMP_SEQ | TX_F_STAMP_TS))) {
+    if (stamp_packet(data, data_end, pt, cfg) < 0)
       return XDP_ABORTED;
-
-    *(__u8 *)dp = pt->data[i];
   }
 
   // next index
-  if (pidx) {
+  if (st && st->order != TX_ORDER_RANDOM) {
     __u32 next = idx + 1;
-    if (next >= MAX_PACKET_ENTRY)
+    if (next >= count)
       next = 0;
-    *pidx = next;
+    st->idx = next;
   }
 
   // sended packet stats
@@ -69,6 +289,223 @@ int xdp_tx(struct xdp_md *ctx) {
   if (!rec)
     return XDP_ABORTED;
   rec->rx_packets++;
-  rec->rx_bytes += ctx->data_end - ctx->data;
+  rec->rx_bytes += tlen;
   return XDP_TX;
-};
+}
+
+// TX program variants, the host picks the cheapest one the templates allow
+
+// one template per cpu without rewrites: the host passes the template as the
+// test run data, so the live frame pages already hold it and nothing is
+// copied
+SEC("xdp")
+int xdp_tx_fixed(struct xdp_md *ctx) {
+  void *data = (void *)(long)ctx->data;
+  void *data_end = (void *)(long)ctx->data_end;
+  __u32 zero = 0;
+
+  struct datarec *rec = bpf_map_lookup_elem(&stats_map, &zero);
+  if (!rec)
+    return XDP_ABORTED;
+  rec->rx_packets++;
+  rec->rx_bytes += data_end - data;
+  return XDP_TX;
+}
+
+// several templates sent in turn, copied as they are
+SEC("xdp")
+int xdp_tx_multi(struct xdp_md *ctx) { return tx_template(ctx, 0); }
+
+SEC("xdp")
+int xdp_tx_mods(struct xdp_md *ctx) { return tx_template(ctx, TX_PROG_MODS); }
+
+// every feature
+SEC("xdp")
+int xdp_tx(struct xdp_md *ctx) {
+  return tx_template(ctx, TX_PROG_MODS | TX_PROG_STAMP);
+}
+
+// jumbo templates, selected by the host when a template exceeds
+// MAX_TEMPLATE_SIZE
+SEC("xdp.frags")
+int xdp_tx_frags(struct xdp_md *ctx) {
+  return tx_template(ctx, TX_PROG_FRAGS | TX_PROG_MODS | TX_PROG_STAMP);
+}
+
+// xdp_tx with the per-byte template copy it had before bpf_xdp_store_bytes,
+// the baseline of xdperf bench --baseline
+SEC("xdp")
+int xdp_tx_byteloop(struct xdp_md *ctx) {
+  return tx_template(ctx, TX_PROG_BYTELOOP | TX_PROG_MODS | TX_PROG_STAMP);
+}
+
+static __always_inline void emit_seq_event(__u32 stream_id, __u32 kind,
+                                           __u64 start, __u64 end) {
+  struct seq_event *ev =
+      bpf_ringbuf_reserve(&rx_seq_events, sizeof(struct seq_event), 0);
+  if (!ev)
+    return;
+  ev->stream_id = stream_id;
+  ev->kind = kind;
+  ev->start = start;
+  ev->end = end;
+  bpf_ringbuf_submit(ev, 0);
+}
+
+// account one stamped packet against its stream
+static __always_inline void track_seq(__u32 stream_id, __u64 seq) {
+  struct rx_stream *s = bpf_map_lookup_elem(&rx_seq_map, &stream_id);
+  if (!s) {
+    struct rx_stream init = {};
+    bpf_map_update_elem(&rx_seq_map, &stream_id, &init, BPF_NOEXIST);
+    s = bpf_map_lookup_elem(&rx_seq_map, &stream_id);
+    if (!s)
+      return;
+  }
+
+  __u32 ev_kind = 0;
+  __u64 ev_start = 0, ev_end = 0;
+  bool ev = false;
+
+  bpf_spin_lock(&s->lock);
+  if (!s->started) {
+    // the first packet seeds the expected sequence: the receiver may start
+    // or reset its stats after the sender
+    s->started = 1;
+    s->top = seq;
+    s->window = 1;
+    s->received++;
+  } else if (seq > s->top) {
+    __u64 d = seq - s->top;
+    s->window = d < SEQ_WINDOW ? (s->window << d) | 1 : 1;
+    if (d > 1) {
+      s->lost += d - 1;
+      ev = true;
+      ev_kind = SEQ_EVENT_GAP;
+      ev_start = s->top + 1;
+      ev_end = seq - 1;
+    }
+    s->top = seq;
+    s->received++;
+  } else {
+    __u64 d = s->top - seq;
+    if (d >= SEQ_WINDOW || (s->window >> d) & 1) {
+      // beyond the window a late packet cannot be told from a duplicate,
+      // it is counted as one and its loss stays counted
+      s->duplicate++;
+    } else {
+      // late arrival: it was counted as lost when the gap opened
+      s->window |= 1ULL << d;
+      s->reordered++;
+      s->received++;
+      if (s->lost > 0)
+        s->lost--;
+      ev = true;
+      ev_kind = SEQ_EVENT_FILL;
+      ev_start = seq;
+      ev_end = seq;
+    }
+  }
+  bpf_spin_unlock(&s->lock);
+
+  if (ev)
+    emit_seq_event(stream_id, ev_kind, ev_start, ev_end);
+}
+
+static __always_inline __u32 log2_u64(__u64 v) {
+  __u32 r = 0;
+#pragma unroll
+  for (int shift = 32; shift > 0; shift >>= 1) {
+    if (v >> shift) {
+      v >>= shift;
+      r += shift;
+    }
+  }
+  return r;
+}
+
+// log-linear bucket: values below LAT_SUB_BUCKETS map 1:1, above that every
+// power of 2 is split into LAT_SUB_BUCKETS linear buckets
+static __always_inline __u32 lat_bucket(__u64 v) {
+  if (v < LAT_SUB_BUCKETS)
+    return v;
+  __u32 msb = log2_u64(v);
+  __u32 sub = (v >> (msb - LAT_SUB_BITS)) & (LAT_SUB_BUCKETS - 1);
+  return (msb - LAT_SUB_BITS + 1) * LAT_SUB_BUCKETS + sub;
+}
+
+static __always_inline void record_latency(struct rx_config *cfg,
+                                           __u32 stream_id, __u64 tstamp) {
+  __u32 class = (stream_id >> 16) & (LAT_CLASSES - 1);
+  struct lat_stats *ls = bpf_map_lookup_elem(&lat_stats_map, &class);
+  if (!ls)
+    return;
+
+  __u64 now = bpf_ktime_get_ns() + cfg->clock_offset;
+  if (now < tstamp) {
+    ls->negative++;
+    return;
+  }
+  __u64 delay = now - tstamp;
+  ls->count++;
+  ls->sum += delay;
+  if (ls->min == 0 || delay < ls->min)
+    ls->min = delay;
+  if (delay > ls->max)
+    ls->max = delay;
+
+  __u32 b = class * LAT_BUCKETS + lat_bucket(delay);
+  __u64 *cnt = bpf_map_lookup_elem(&lat_hist_map, &b);
+  if (cnt)
+    (*cnt)++;
+}
+
+SEC("xdp")
+int xdp_rx(struct xdp_md *ctx) {
+  void *data = (void *)(long)ctx->data;
+  void *data_end = (void *)(long)ctx->data_end;
+  __u32 zero = 0;
+
+  // received packet stats
+  struct datarec *rec = bpf_map_lookup_elem(&rx_stats_map, &zero);
+  if (rec) {
+    rec->rx_packets++;
+    rec->rx_bytes += data_end - data;
+  }
+
+  struct rx_config *cfg = bpf_map_lookup_elem(&rx_config_map, &zero);
+  if (!cfg)
+    return XDP_DROP;
+
+  struct hdr_cursor h = {};
+  int parsed = parse_packet(data, data_end, &h);
+
+  if (parsed == 0 && (cfg->flags & (RX_F_SEQ | RX_F_LATENCY))) {
+    __u32 off = cfg->stamp_off;
+    if (off < MAX_TEMPLATE_SIZE) {
+      struct xdperf_stamp *st = h.payload + off;
+      if ((void *)(st + 1) <= data_end &&
+          st->magic == bpf_htonl(XDPERF_STAMP_MAGIC)) {
+        if (cfg->flags & RX_F_SEQ)
+          track_seq(bpf_ntohl(st->stream_id), bpf_be64_to_cpu(st->seq));
+        if ((cfg->flags & RX_F_LATENCY) && st->tstamp)
+          record_latency(cfg, bpf_ntohl(st->stream_id),
+                         bpf_be64_to_cpu(st->tstamp));
+      }
+    }
+  }
+
+  switch (cfg->action) {
+  case RX_ACTION_PASS:
+    return XDP_PASS;
+  case RX_ACTION_REDIRECT:
+    return bpf_redirect_map(&rx_redirect_map, 0, XDP_DROP);
+  case RX_ACTION_REFLECT:
+    if (parsed != 0)
+      return XDP_DROP;
+    reflect_packet(data_end, &h);
+    return XDP_TX;
+  default:
+    return XDP_DROP;
+  }
+}
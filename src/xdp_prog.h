@@ -16,25 +16,224 @@ struct {
   __uint(max_entries, 1);
 } stats_map SEC(".maps");
 
-#define MAX_PACKET_ENTRY 2048
 #define MAX_TEMPLATE_SIZE 2048
+// xdp_tx_frags: frames up to MAX_FRAME_SIZE, bytes past MAX_TEMPLATE_SIZE are
+// kept in tx_tail_map
+#define MAX_FRAME_SIZE 9216
+
+// per-packet field modifiers of a template
+#define MAX_MODIFIERS 4
+#define MOD_OP_NONE 0
+#define MOD_OP_INC 1    // min + (n * step) % span
+#define MOD_OP_RANDOM 2 // min + random % span
+#define MOD_F_IP_CSUM (1 << 0) // field is covered by the IPv4 header checksum
+#define MOD_F_L4_CSUM (1 << 1) // field is covered by the L4 checksum
+struct modifier {
+  __u16 offset; // from the start of the frame, even unless len is 1
+  __u8 len;     // 1, 2 or 4 bytes, network byte order
+  __u8 op;      // MOD_OP_*
+  __u8 flags;   // MOD_F_*
+  __u32 min;
+  __u32 span; // max - min + 1, 0 = 2^32
+  __u32 step;
+};
+
+// The template maps are sized by the host at load time from the templates
+// of the run, max_entries below are placeholders.
 struct pkt_template {
-  __u32 len;                    // actual length of data
+  __u32 len;                    // frame length, data holds the first bytes
+  __u16 stamp_off;              // offset of struct xdperf_stamp, 0 = none
+  __u16 l4_csum_off;            // offset of the L4 checksum, 0 = none
+  __u8 l4_proto;                // IPPROTO_UDP or IPPROTO_TCP
+  __u8 nr_mods;                 // modifiers in use
+  __u16 ip_csum_off;            // offset of the IPv4 header checksum, 0 = none
+  __u32 tail;                   // tx_tail_map slot when len > MAX_TEMPLATE_SIZE
+  struct modifier mods[MAX_MODIFIERS];
   __u8 data[MAX_TEMPLATE_SIZE]; // raw frame
 };
+// every distinct template once, shared by all cpus
 struct {
-  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
-  __uint(max_entries, MAX_PACKET_ENTRY);
-  __type(key, __u32); // per-cpu id
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32); // template id
   __type(value, struct pkt_template);
 } tx_override_map SEC(".maps");
 
+struct pkt_tail {
+  __u8 data[MAX_FRAME_SIZE - MAX_TEMPLATE_SIZE];
+};
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32); // pkt_template.tail
+  __type(value, struct pkt_tail);
+} tx_tail_map SEC(".maps");
+
+// per-cpu template list: slot -> template id
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32); // slot
+  __type(value, __u32);
+} tx_index_map SEC(".maps");
+
 // random or sequential per-cpu state
+#define TX_ORDER_SEQ 0
+#define TX_ORDER_RANDOM 1
+struct tx_state {
+  __u32 idx;   // next slot
+  __u32 count; // slots of this cpu in tx_index_map
+  __u32 order; // TX_ORDER_*
+};
 struct {
   __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
   __uint(max_entries, 1);
   __type(key, __u32);
-  __type(value, __u32);
+  __type(value, struct tx_state);
 } seq_state_map SEC(".maps");
 
+// sequence and timestamp stamping
+#define XDPERF_STAMP_MAGIC 0x78647066 // "xdpf"
+struct xdperf_stamp {
+  __be32 magic;
+  __be32 stream_id; // stream group << 16 | cpu
+  __be64 seq;
+  __be64 tstamp; // ns, 0 = not stamped
+} __attribute__((packed));
+
+#define TX_F_STAMP_SEQ (1 << 0)
+#define TX_F_STAMP_TS (1 << 1)
+
+// per-cpu so that every TX cpu can stamp its own stream group
+struct tx_config {
+  __u32 flags; // TX_F_*
+  __u32 stream_group;
+  __s64 clock_offset; // added to bpf_ktime_get_ns() for the timestamp
+  // MOD_OP_INC of worker w sends values w, w + stride, w + 2 * stride, ...
+  __u32 mod_stride;
+  __u32 mod_offset;
+};
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, struct tx_config);
+} tx_config_map SEC(".maps");
+
+// per-cpu packet counter of every slot for MOD_OP_INC, sized like
+// tx_index_map
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, __u64);
+} mod_state_map SEC(".maps");
+
+// per-cpu sequence counter
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, __u64);
+} tx_seq_map SEC(".maps");
+
+// server (rx) side
+#define RX_ACTION_DROP 0
+#define RX_ACTION_PASS 1
+#define RX_ACTION_REDIRECT 2
+#define RX_ACTION_REFLECT 3 // swap addresses and send back (round-trip)
+
+#define RX_F_SEQ (1 << 0)
+#define RX_F_LATENCY (1 << 1)
+
+struct rx_config {
+  __u32 action;       // RX_ACTION_*
+  __u32 flags;        // RX_F_*
+  __u32 stamp_off;    // offset of struct xdperf_stamp from the L4 payload
+  __s64 clock_offset; // added to bpf_ktime_get_ns() before taking the delay
+};
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, struct rx_config);
+} rx_config_map SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __type(key, __u32);
+  __type(value, struct datarec);
+  __uint(max_entries, 1);
+} rx_stats_map SEC(".maps");
+
+// redirect target for RX_ACTION_REDIRECT (key 0)
+struct {
+  __uint(type, BPF_MAP_TYPE_DEVMAP);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, __u32);
+} rx_redirect_map SEC(".maps");
+
+// per-stream sequence tracking
+#define MAX_RX_STREAMS 4096
+#define SEQ_WINDOW 64
+struct rx_stream {
+  struct bpf_spin_lock lock;
+  __u32 started;
+  __u64 top;    // highest sequence seen
+  __u64 window; // bit i set = (top - i) seen
+  __u64 received;
+  __u64 lost;
+  __u64 duplicate;
+  __u64 reordered;
+};
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_RX_STREAMS);
+  __type(key, __u32); // stream_id
+  __type(value, struct rx_stream);
+} rx_seq_map SEC(".maps");
+
+// gap and late-arrival notifications for missing range tracking
+#define SEQ_EVENT_GAP 0
+#define SEQ_EVENT_FILL 1
+struct seq_event {
+  __u32 stream_id;
+  __u32 kind; // SEQ_EVENT_*
+  __u64 start;
+  __u64 end;
+};
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 256 * 1024);
+} rx_seq_events SEC(".maps");
+
+// latency histogram: log-linear, LAT_SUB_BUCKETS linear buckets per power of 2
+#define LAT_SUB_BITS 4
+#define LAT_SUB_BUCKETS (1 << LAT_SUB_BITS)
+#define LAT_BUCKETS ((64 - LAT_SUB_BITS + 1) * LAT_SUB_BUCKETS)
+// one histogram per latency class, the class is the stream group modulo
+// LAT_CLASSES: key = class * LAT_BUCKETS + bucket
+#define LAT_CLASSES 16
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, LAT_CLASSES * LAT_BUCKETS);
+  __type(key, __u32);
+  __type(value, __u64);
+} lat_hist_map SEC(".maps");
+
+struct lat_stats {
+  __u64 count;
+  __u64 sum;
+  __u64 min;
+  __u64 max;
+  __u64 negative; // receive time before the stamp (clock skew)
+};
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, LAT_CLASSES);
+  __type(key, __u32);
+  __type(value, struct lat_stats);
+} lat_stats_map SEC(".maps");
+
 #endif // XDP_UTILS_H